@@ -0,0 +1,268 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Access byte
+
+const (
+	AccessRead  Access = 1 << iota // subscribe and receive
+	AccessWrite                    // publish
+)
+
+// an Authorizer decides which topics a client can publish and subscribe to.
+// for reads it's called with the topic filter when the client subscribes,
+// and again with the topic name for every message before it's delivered
+type Authorizer interface {
+	Authorize(clientId string, username string, topic string, a Access) bool
+}
+
+// SetAuthorizer sets the Authorizer that gets checked before every
+// subscribe, publish and delivery. this is not safe to call once the server
+// has started
+func (s *Server) SetAuthorizer(a Authorizer) {
+	s.authorizer = a
+}
+
+// ACL is an Authorizer backed by a rule file, each line of which is
+//
+//	<access> <username|*> <topic filter>
+//
+// where access is one of read, write, readwrite or deny. in the topic filter
+// a level that is exactly %u or %c is replaced with the client's username or
+// client id, and the usual + and # wildcards work. rules are checked in order
+// and the first one that matches decides, if none do access is denied.
+// blank lines and lines starting with # are skipped
+//
+//	readwrite *     devices/%c/#
+//	deny      *     $SYS/#
+//	read      alice $SYS/broker/#
+type ACL struct {
+	path  string
+	lock  sync.RWMutex
+	rules []aclRule
+}
+
+type aclRule struct {
+	deny     bool
+	access   Access
+	username string // empty matches everyone
+	filter   []string
+}
+
+var MalACLFile = errors.New("malformed acl file")
+
+func NewACL(path string) (*ACL, error) {
+	acl := &ACL{path: path}
+	err := acl.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Reload rereads the rule file, if there's an error the old rules are kept
+func (acl *ACL) Reload() error {
+	f, err := os.Open(acl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules := make([]aclRule, 0, 16)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		fields := strings.Fields(l)
+		if len(fields) != 3 {
+			return fmt.Errorf("%w: line %d", MalACLFile, line)
+		}
+
+		rule := aclRule{filter: strings.Split(fields[2], "/")}
+		switch fields[0] {
+		case "read":
+			rule.access = AccessRead
+		case "write":
+			rule.access = AccessWrite
+		case "readwrite":
+			rule.access = AccessRead | AccessWrite
+		case "deny":
+			rule.deny = true
+			rule.access = AccessRead | AccessWrite
+		default:
+			return fmt.Errorf(
+				"%w: line %d: unknown access %q",
+				MalACLFile,
+				line,
+				fields[0],
+			)
+		}
+		if fields[1] != "*" {
+			rule.username = fields[1]
+		}
+		if !validFilter(rule.filter) {
+			return fmt.Errorf(
+				"%w: line %d: invalid topic filter",
+				MalACLFile,
+				line,
+			)
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	acl.lock.Lock()
+	acl.rules = rules
+	acl.lock.Unlock()
+
+	return nil
+}
+
+func (acl *ACL) Authorize(
+	clientId string,
+	username string,
+	topic string,
+	a Access,
+) bool {
+	levels := strings.Split(topic, "/")
+
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	filter := make([]string, 0, 8)
+	for _, rule := range acl.rules {
+		if rule.access&a == 0 {
+			continue
+		}
+		if rule.username != "" && rule.username != username {
+			continue
+		}
+
+		var ok bool
+		filter, ok = rule.expand(filter[:0], clientId, username)
+		if !ok {
+			continue
+		}
+
+		// subscriptions have to fit entirely inside the rule's filter,
+		// everything else is a topic name
+		var matched bool
+		if a == AccessRead {
+			matched = filterCovers(filter, levels)
+		} else {
+			matched = topicMatches(filter, levels)
+		}
+		if matched {
+			return !rule.deny
+		}
+	}
+
+	return false
+}
+
+// expand does the %u and %c substitution, it's not ok if the substitution
+// would leave the filter meaning something other than what it says
+func (r *aclRule) expand(
+	filter []string,
+	clientId string,
+	username string,
+) ([]string, bool) {
+	for _, level := range r.filter {
+		switch level {
+		case "%u":
+			level = username
+		case "%c":
+			level = clientId
+		default:
+			filter = append(filter, level)
+			continue
+		}
+		if level == "" || strings.ContainsAny(level, "/+#") {
+			return filter, false
+		}
+		filter = append(filter, level)
+	}
+	return filter, true
+}
+
+// validFilter checks that # only shows up as the last level
+// and that wildcards take up a whole level
+func validFilter(filter []string) bool {
+	for i, level := range filter {
+		if level == "#" && i != len(filter)-1 {
+			return false
+		}
+		if len(level) > 1 && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches checks if a topic name matches a topic filter
+func topicMatches(filter []string, topic []string) bool {
+	// wildcards at the start of a filter don't match $ topics
+	if len(topic) > 0 &&
+		strings.HasPrefix(topic[0], "$") &&
+		len(filter) > 0 &&
+		(filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+
+	for i, level := range filter {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if level != "+" && level != topic[i] {
+			return false
+		}
+	}
+	return len(filter) == len(topic)
+}
+
+// filterCovers checks if every topic matched by sub is also matched by
+// filter
+func filterCovers(filter []string, sub []string) bool {
+	if len(sub) > 0 &&
+		strings.HasPrefix(sub[0], "$") &&
+		len(filter) > 0 &&
+		(filter[0] == "+" || filter[0] == "#") {
+		return false
+	}
+
+	for i, level := range filter {
+		if level == "#" {
+			return true
+		}
+		if i >= len(sub) {
+			// sub is shorter than the filter
+			return false
+		}
+		switch {
+		case sub[i] == "#":
+			return false
+		case level == "+":
+		case level != sub[i]:
+			return false
+		}
+	}
+	return len(filter) == len(sub)
+}
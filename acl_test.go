@@ -0,0 +1,156 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeACLFile(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl")
+	err := os.WriteFile(path, []byte(rules), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestACLAuthorize(t *testing.T) {
+	acl, err := NewACL(writeACLFile(t, ""+
+		"# comments and blank lines are skipped\n"+
+		"\n"+
+		"read      alice $SYS/broker/#\n"+
+		"deny      *     $SYS/#\n"+
+		"readwrite *     devices/%c/#\n"+
+		"readwrite *     users/%u/+\n"+
+		"deny      *     sensors/secret/#\n"+
+		"read      *     sensors/#\n"+
+		"write     bob   commands/#\n"+
+		"read      *     #\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		clientId string
+		username string
+		topic    string
+		access   Access
+		want     bool
+	}{
+		{"client id", "dev1", "", "devices/dev1/temp", AccessWrite, true},
+		{"client id sub", "dev1", "", "devices/dev1/#", AccessRead, true},
+		{"other client id", "dev1", "", "devices/dev2/temp", AccessWrite, false},
+		{"username", "c", "alice", "users/alice/inbox", AccessWrite, true},
+		{"other username", "c", "alice", "users/bob/inbox", AccessWrite, false},
+		{"no username", "c", "", "users//inbox", AccessWrite, false},
+		{"wildcard client id", "+", "", "devices/+/temp", AccessWrite, false},
+		{"slash client id", "a/b", "", "devices/a/b/temp", AccessWrite, false},
+		{"first match deny", "c", "", "sensors/secret/key", AccessRead, false},
+		{"first match allow", "c", "", "sensors/temp", AccessRead, true},
+		{"read only", "c", "", "sensors/temp", AccessWrite, false},
+		{"user rule", "c", "bob", "commands/reboot", AccessWrite, true},
+		{"user rule other user", "c", "carol", "commands/reboot", AccessWrite, false},
+		{"sub wider than rule", "c", "", "sensors/+/+", AccessRead, true},
+		{"sub covers deny", "c", "", "sensors/#", AccessRead, true},
+		{"sys allowed", "c", "alice", "$SYS/broker/uptime", AccessRead, true},
+		{"sys denied", "c", "bob", "$SYS/broker/uptime", AccessRead, false},
+		{"sys not in #", "c", "bob", "$SYS/other", AccessRead, false},
+		{"sys sub not in #", "c", "bob", "$SYS/#", AccessRead, false},
+		{"hash covers all", "c", "", "anything/at/all", AccessRead, true},
+		{"no rule", "c", "", "anything/at/all", AccessWrite, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := acl.Authorize(tc.clientId, tc.username, tc.topic, tc.access)
+			if got != tc.want {
+				t.Fatalf("Authorize = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestACLSubscriptionCovered(t *testing.T) {
+	acl, err := NewACL(writeACLFile(t, "read * a/+/c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b/c", true},
+		{"a/+/c", true},
+		{"a/#", false},
+		{"a/b/#", false},
+		{"a/b", false},
+		{"a/b/c/d", false},
+		{"#", false},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			got := acl.Authorize("c", "", tc.filter, AccessRead)
+			if got != tc.want {
+				t.Fatalf("Authorize = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestACLMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rules string
+	}{
+		{"too few fields", "read *\n"},
+		{"too many fields", "read * a/b c\n"},
+		{"unknown access", "publish * a/b\n"},
+		{"hash not last", "read * a/#/b\n"},
+		{"partial wildcard", "read * a/b+\n"},
+		{"partial hash", "read * a/b#\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewACL(writeACLFile(t, tc.rules))
+			if !errors.Is(err, MalACLFile) {
+				t.Fatalf("err = %v, want %v", err, MalACLFile)
+			}
+		})
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	path := writeACLFile(t, "read * a/#\n")
+	acl, err := NewACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad file keeps the old rules
+	err = os.WriteFile(path, []byte("read *\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Reload(); !errors.Is(err, MalACLFile) {
+		t.Fatalf("reload = %v, want %v", err, MalACLFile)
+	}
+	if !acl.Authorize("c", "", "a/b", AccessRead) {
+		t.Fatalf("old rules dropped")
+	}
+
+	err = os.WriteFile(path, []byte("read * b/#\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Authorize("c", "", "a/b", AccessRead) {
+		t.Fatalf("old rules kept")
+	}
+	if !acl.Authorize("c", "", "b/c", AccessRead) {
+		t.Fatalf("new rules not loaded")
+	}
+}
@@ -0,0 +1,319 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// ClientInfo is a snapshot of a connected client, for operators
+type ClientInfo struct {
+	Id              string    `json:"id"`
+	Username        string    `json:"username,omitempty"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Listener        string    `json:"listener"`
+	ProtocolVersion byte      `json:"protocol_version"`
+	Keepalive       uint16    `json:"keepalive"`
+	AuthMethod      string    `json:"auth_method,omitempty"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	// packets waiting in the client's outbound queue, including spilled ones
+	Queued int `json:"queued"`
+	// TODO: inflight QoS 1 and 2 counts, once those are delivered at their
+	// QoS instead of 0
+}
+
+type SubscriptionInfo struct {
+	ClientId string `json:"client_id"`
+	Filter   string `json:"filter"`
+}
+
+var InvalidTopic = errors.New("invalid topic name")
+
+// Clients lists the connected clients, sorted by id
+func (s *Server) Clients() []ClientInfo {
+	s.clientsLock.RLock()
+	infos := make([]ClientInfo, 0, len(s.clients))
+	for _, c := range s.clients {
+		infos = append(infos, c.Info())
+	}
+	s.clientsLock.RUnlock()
+
+	slices.SortFunc(infos, func(a, b ClientInfo) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return infos
+}
+
+// Info is a snapshot of the client, the same as Server.Clients has. the
+// Client hooks get for Server.Publish only has an id, username and listener
+func (c *Client) Info() ClientInfo {
+	info := ClientInfo{
+		Id:              c.id,
+		Username:        c.username,
+		Listener:        c.listener.Name,
+		ProtocolVersion: c.version,
+		Keepalive:       c.keepalive,
+		AuthMethod:      c.authMethod,
+		ConnectedAt:     c.connectedAt,
+	}
+	if c.conn != nil {
+		info.RemoteAddr = c.conn.RemoteAddr().String()
+	}
+	if c.queue != nil {
+		info.Queued = c.queue.len()
+	}
+	return info
+}
+
+// Subscriptions lists every network client's subscription, sorted by client
+// id and then filter
+func (s *Server) Subscriptions() []SubscriptionInfo {
+	subs := slices.DeleteFunc(
+		s.topicTrie.Subscriptions(),
+		func(sub SubscriptionInfo) bool {
+			return strings.HasPrefix(sub.ClientId, internalIdPrefix)
+		},
+	)
+	slices.SortFunc(subs, func(a, b SubscriptionInfo) int {
+		if c := strings.Compare(a.ClientId, b.ClientId); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Filter, b.Filter)
+	})
+	return subs
+}
+
+// DisconnectClient sends the client a DISCONNECT with rc, after anything
+// that's already queued for it, and its writePump closes the connection
+// once it's gone out. it returns false if there's no client with that id
+func (s *Server) DisconnectClient(id string, rc packets.ReasonCode) bool {
+	s.clientsLock.RLock()
+	c, ok := s.clients[id]
+	s.clientsLock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	c.queueDisconnect(rc)
+	return true
+}
+
+// DeleteSession throws away everything the server has for a client id,
+// disconnecting it with AA if it's connected. it returns false if there was
+// nothing to delete
+func (s *Server) DeleteSession(id string) bool {
+	// in process subscriptions belong to whoever made them
+	if strings.HasPrefix(id, internalIdPrefix) {
+		return false
+	}
+	// TODO: sessions don't outlive their connections yet, once they do this
+	// needs to clear out the stored session too
+	kicked := s.DisconnectClient(id, packets.AA)
+
+	found := kicked
+	for _, sub := range s.topicTrie.Subscriptions() {
+		if sub.ClientId == id {
+			found = true
+			break
+		}
+	}
+	s.topicTrie.RemoveSubs(id)
+
+	return found
+}
+
+// publish sends a message from the broker itself to everyone subscribed to
+// topic, it skips the write ACL but subscribers still need to be allowed to
+// read it
+func (s *Server) publish(
+	topic string,
+	payload []byte,
+	props *packets.Properties,
+) (int, error) {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return 0, InvalidTopic
+	}
+
+	matches := s.topicTrie.FindMatches(strings.Split(topic, "/"))
+	delivered := 0
+	if len(matches) > 0 {
+		out := outPublish{topic: topic, payload: payload, props: props}
+
+		var msg *Message
+		if len(s.hooks) > 0 {
+			msg = &Message{Topic: topic, Payload: payload, Props: props}
+		}
+		delivered = s.fanOut(matches, &out, msg)
+	}
+	s.metrics.fanout.observe(uint64(delivered))
+
+	return delivered, nil
+}
+
+// propsSize is an upper bound on the encoded size of the properties that
+// can be on a PUBLISH
+func propsSize(props *packets.Properties) int {
+	n := 32 + props.Ct.Len() + props.Rt.Len() + len(props.Cd)
+	for _, up := range props.Up {
+		n += 5 + up.Name.Len() + up.Val.Len()
+	}
+	return n
+}
+
+// AdminHandler serves a JSON API for managing the server:
+//
+//	GET    /clients                    the connected clients
+//	GET    /clients/{id}               one client
+//	POST   /clients/{id}/disconnect    disconnect a client with AA
+//	GET    /subscriptions              every subscription, ?client= filters
+//	DELETE /sessions/{id}              delete a client's session
+//	POST   /publish                    publish a message as the broker,
+//	                                   through the OnPublish hooks
+//
+// there's no authentication on any of it, so only serve it somewhere that
+// only operators can reach, like localhost
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Clients())
+	})
+	mux.HandleFunc(
+		"GET /clients/{id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			s.clientsLock.RLock()
+			c, ok := s.clients[r.PathValue("id")]
+			var info ClientInfo
+			if ok {
+				info = c.Info()
+			}
+			s.clientsLock.RUnlock()
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "no such client")
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		},
+	)
+	mux.HandleFunc(
+		"POST /clients/{id}/disconnect",
+		func(w http.ResponseWriter, r *http.Request) {
+			if !s.DisconnectClient(r.PathValue("id"), packets.AA) {
+				writeJSONError(w, http.StatusNotFound, "no such client")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+	mux.HandleFunc(
+		"GET /subscriptions",
+		func(w http.ResponseWriter, r *http.Request) {
+			subs := s.Subscriptions()
+			if cid := r.URL.Query().Get("client"); cid != "" {
+				subs = slices.DeleteFunc(subs, func(sub SubscriptionInfo) bool {
+					return sub.ClientId != cid
+				})
+			}
+			if subs == nil {
+				subs = []SubscriptionInfo{}
+			}
+			writeJSON(w, http.StatusOK, subs)
+		},
+	)
+	mux.HandleFunc(
+		"DELETE /sessions/{id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			if !s.DeleteSession(r.PathValue("id")) {
+				writeJSONError(w, http.StatusNotFound, "no such session")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+	mux.HandleFunc("POST /publish", s.adminPublish)
+
+	return mux
+}
+
+// StartAdmin serves AdminHandler on addr, it blocks like Start does
+func (s *Server) StartAdmin(addr string) error {
+	return http.ListenAndServe(addr, s.AdminHandler())
+}
+
+type adminPublishReq struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	// if set, Payload is base64 instead of the payload itself
+	Base64         bool              `json:"base64"`
+	ContentType    string            `json:"content_type"`
+	UserProperties map[string]string `json:"user_properties"`
+}
+
+func (s *Server) adminPublish(w http.ResponseWriter, r *http.Request) {
+	req := adminPublishReq{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(MB)))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	payload := []byte(req.Payload)
+	if req.Base64 {
+		payload, err = base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	props := packets.Properties{}
+	props.Zero()
+	props.Ct.WriteString(req.ContentType)
+	// sorted, so the order is the same every time
+	names := make([]string, 0, len(req.UserProperties))
+	for name := range req.UserProperties {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		props.AddUserProp(name, req.UserProperties[name])
+	}
+
+	// admin messages go through the hooks like everyone else's, from a
+	// Client with no id or username on the "admin" listener
+	topic, pprops := req.Topic, &props
+	if len(s.hooks) > 0 {
+		msg := &Message{Topic: topic, Payload: payload, Props: pprops}
+		err := s.hookPublish(s.inProcessClient("admin", "", ""), msg)
+		if err != nil {
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		topic, payload, pprops = msg.Topic, msg.Payload, publishProps(msg.Props)
+	}
+
+	delivered, err := s.publish(topic, payload, pprops)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"delivered": delivered})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,306 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// adminRequest sends a request to the admin API, returning the status and
+// body of the response
+func adminRequest(
+	t *testing.T,
+	s *Server,
+	method string,
+	path string,
+	body string,
+) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, r)
+	b, _ := io.ReadAll(w.Result().Body)
+	return w.Code, string(b)
+}
+
+// adminPost posts body to path on the admin API, returning the status
+func adminPost(t *testing.T, s *Server, path string, body string) (int, string) {
+	t.Helper()
+	return adminRequest(t, s, http.MethodPost, path, body)
+}
+
+// adminGet gets path from the admin API and decodes the JSON it returns
+// into v if it's a 200
+func adminGet(t *testing.T, s *Server, path string, v any) int {
+	t.Helper()
+	status, body := adminRequest(t, s, http.MethodGet, path, "")
+	if status == http.StatusOK {
+		err := json.Unmarshal([]byte(body), v)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", body, err)
+		}
+	}
+	return status
+}
+
+// testDisconnected checks conn gets a DISCONNECT with rc and is then closed
+func testDisconnected(t *testing.T, conn net.Conn, rc packets.ReasonCode) {
+	t.Helper()
+	fh, body := testRead(t, conn)
+	if fh.Pt != packets.DISCONNECT || body[0] != byte(rc) {
+		t.Fatalf("got packet type %d, %v", fh.Pt, body)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open: %v", err)
+	}
+}
+
+// testGone waits for the server to finish cleaning up after client id
+func testGone(t *testing.T, s *Server, id string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for adminGet(t, s, "/clients/"+id, &ClientInfo{}) != http.StatusNotFound {
+		if time.Now().After(deadline) {
+			t.Fatalf("client %q never went away", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	testPing(t, testConnect(t, pl, "b"))
+	testPing(t, testConnect(t, pl, "a"))
+
+	clients := []ClientInfo{}
+	if status := adminGet(t, &s, "/clients", &clients); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if len(clients) != 2 || clients[0].Id != "a" || clients[1].Id != "b" {
+		t.Fatalf("clients = %+v, want a and b", clients)
+	}
+
+	info := ClientInfo{}
+	if status := adminGet(t, &s, "/clients/a", &info); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if info.Id != "a" || info.Listener != "test" ||
+		info.ProtocolVersion != packets.V5 || info.RemoteAddr != "pipe" ||
+		info.ConnectedAt.IsZero() {
+		t.Fatalf("client = %+v", info)
+	}
+
+	status, body := adminRequest(t, &s, http.MethodGet, "/clients/nope", "")
+	if status != http.StatusNotFound || !strings.Contains(body, `"error"`) {
+		t.Fatalf("unknown client = %d %s, want %d", status, body, http.StatusNotFound)
+	}
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	conn := testConnect(t, pl, "a")
+	testPing(t, conn)
+
+	status, _ := adminPost(t, &s, "/clients/nope/disconnect", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("unknown client = %d, want %d", status, http.StatusNotFound)
+	}
+	status, _ = adminPost(t, &s, "/clients/a/disconnect", "")
+	if status != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	testDisconnected(t, conn, packets.AA)
+	testGone(t, &s, "a")
+}
+
+func TestAdminSubscriptions(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	a := testConnect(t, pl, "a")
+	testSubscribe(t, a, "x/#")
+	testSubscribe(t, a, "b")
+	b := testConnect(t, pl, "b")
+	testSubscribe(t, b, "x/y")
+
+	// in process subscriptions aren't anyone's to manage
+	unsubscribe, err := s.Subscribe("x/#", SubscribeOptions{}, func(*Message) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	for _, tc := range []struct {
+		path string
+		want []SubscriptionInfo
+	}{
+		{"/subscriptions", []SubscriptionInfo{{"a", "b"}, {"a", "x/#"}, {"b", "x/y"}}},
+		{"/subscriptions?client=b", []SubscriptionInfo{{"b", "x/y"}}},
+		{"/subscriptions?client=nope", []SubscriptionInfo{}},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			var subs []SubscriptionInfo
+			if status := adminGet(t, &s, tc.path, &subs); status != http.StatusOK {
+				t.Fatalf("status = %d, want %d", status, http.StatusOK)
+			}
+			// an empty list is [], not null
+			if subs == nil || !slices.Equal(subs, tc.want) {
+				t.Fatalf("subscriptions = %+v, want %+v", subs, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdminDeleteSession(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	conn := testConnect(t, pl, "a")
+	testSubscribe(t, conn, "x")
+
+	del := func(id string) int {
+		status, _ := adminRequest(t, &s, http.MethodDelete, "/sessions/"+id, "")
+		return status
+	}
+	if status := del("a"); status != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", status, http.StatusNoContent)
+	}
+	testDisconnected(t, conn, packets.AA)
+	testGone(t, &s, "a")
+	if subs := s.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("subscriptions left behind: %+v", subs)
+	}
+
+	if status := del("a"); status != http.StatusNotFound {
+		t.Fatalf("deleted session = %d, want %d", status, http.StatusNotFound)
+	}
+	if status := del("nope"); status != http.StatusNotFound {
+		t.Fatalf("unknown session = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestAdminPublish(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	sub := testConnect(t, pl, "sub")
+	testSubscribe(t, sub, "a/#")
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"empty topic", `{"topic": "", "payload": "hi"}`, http.StatusBadRequest},
+		{"wildcard", `{"topic": "a/+", "payload": "hi"}`, http.StatusBadRequest},
+		{"bad json", `{"topic": "a"`, http.StatusBadRequest},
+		{"unknown field", `{"topic": "a", "qos": 1}`, http.StatusBadRequest},
+		{"bad base64", `{"topic": "a", "payload": "!", "base64": true}`, http.StatusBadRequest},
+		{"no subscribers", `{"topic": "b", "payload": "hi"}`, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := adminPost(t, &s, "/publish", tc.body)
+			if status != tc.status {
+				t.Fatalf("status = %d, want %d: %s", status, tc.status, body)
+			}
+		})
+	}
+
+	status, body := adminPost(t, &s, "/publish", `{
+		"topic": "a/b",
+		"payload": "aGk=",
+		"base64": true,
+		"content_type": "text/plain",
+		"user_properties": {"k": "v"}
+	}`)
+	if status != http.StatusOK || body != `{"delivered":1}`+"\n" {
+		t.Fatalf("publish = %d %s", status, body)
+	}
+
+	// nothing from the rejected ones got through, just this
+	fh, data := testRead(t, sub)
+	if fh.Pt != packets.PUBLISH {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PUBLISH)
+	}
+	got := packets.Publish{}
+	got.Zero()
+	props := packets.Properties{}
+	props.Zero()
+	if err := packets.DecodePublish(&fh, &got, &props, data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic.String() != "a/b" || string(got.Payload) != "hi" {
+		t.Fatalf("got %q %q", got.Topic.String(), got.Payload)
+	}
+	if props.Ct.String() != "text/plain" || len(props.Up) != 1 ||
+		props.Up[0].Name.String() != "k" || props.Up[0].Val.String() != "v" {
+		t.Fatalf("properties weren't sent")
+	}
+}
+
+func TestAdminPublishHooks(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		publish func(msg *Message) error
+		status  int
+		got     string
+	}{
+		{"accepted", nil, http.StatusOK, "hi"},
+		{
+			"modified",
+			func(msg *Message) error {
+				msg.Payload = []byte("changed")
+				return nil
+			},
+			http.StatusOK,
+			"changed",
+		},
+		{
+			"rejected",
+			func(msg *Message) error { return errors.New("no") },
+			http.StatusForbidden,
+			"",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			log := &hookLog{}
+			s.AddHook(&orderHook{name: "a", log: log, publish: tc.publish})
+			h := &publishHook{}
+			s.AddHook(h)
+			var got string
+			unsubscribe, err := s.Subscribe("a", SubscribeOptions{},
+				func(msg *Message) { got = string(msg.Payload) },
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer unsubscribe()
+
+			status, body := adminPost(t, &s, "/publish",
+				`{"topic": "a", "payload": "hi"}`,
+			)
+			if status != tc.status {
+				t.Fatalf("status = %d, want %d: %s", status, tc.status, body)
+			}
+			if got != tc.got {
+				t.Fatalf("subscriber got %q, want %q", got, tc.got)
+			}
+			// the second hook only runs if the first one let it through
+			if tc.status == http.StatusOK &&
+				(len(h.from) != 1 || h.from[0] != "//admin") {
+				t.Fatalf("hook got %v", h.from)
+			}
+		})
+	}
+}
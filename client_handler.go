@@ -1,12 +1,20 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/andrew-r-thomas/mqtt/packets"
 )
@@ -14,53 +22,404 @@ import (
 // the Client system is a child of the Server system, responsible for handling
 // a single connection
 type Client struct {
-	server    *Server
-	conn      net.Conn
-	id        string
-	session   Session
-	writeChan chan []byte
+	server   *Server
+	listener *Listener
+	conn     net.Conn
+	id       string
+	username string
+	session  Session
+
+	authMethod string
+	authEx     AuthExchange
+
+	version     byte // protocol version from the CONNECT
+	connectedAt time.Time
+
+	maxPacketSize int
+	pubLimiter    publishLimiter
+	pubProps      packets.Properties // only for handlePublish
+
+	// published when the connection ends, unless the client disconnects
+	// normally
+	will *Message
+	// how the connection ended, see setEnd
+	end atomic.Uint32
+
+	queue     *outQueue
+	log       *slog.Logger
 	wg        sync.WaitGroup
 	keepalive uint16
 }
 
+var (
+	NotConnect   = errors.New("first packet was not a connect packet")
+	MalFixedHead = errors.New("malformed fixed header")
+	PacketTooBig = errors.New("packet exceeds maximum packet size")
+)
+
 // SetupClient is called by the Server system upon establishing a new network
 // connection
-func SetupClient(conn net.Conn, s *Server) (ch Client, err error) {
+func SetupClient(
+	conn net.Conn,
+	s *Server,
+	l *Listener,
+) (*Client, error) {
 	// set connection deadline and wait for connect packet
-	conn.SetDeadline(time.Now().Add(s.connDeadline))
-	buf := s.bp.GetBuf()
-	n, err := conn.Read(buf)
+	if s.connDeadline > 0 {
+		conn.SetDeadline(time.Now().Add(s.connDeadline))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// read the PROXY header now so it's covered by the deadline, tls and
+	// websocket conns read theirs underneath the handshake
+	if pc, ok := conn.(*proxyConn); ok {
+		err := pc.readHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxPacketSize := s.maxPacketSize
+	if l.Policy.MaxPacketSize > 0 {
+		maxPacketSize = l.Policy.MaxPacketSize
+	}
+
+	p, err := s.readPacket(conn, maxPacketSize)
 	if err != nil {
-		return
+		return nil, err
+	}
+	defer s.bp.ReturnBuf(p.buf)
+	defer s.fp.ReturnFH(*p.fh)
+	if p.fh.Pt != packets.CONNECT {
+		return nil, NotConnect
+	}
+
+	connect := packets.Connect{}
+	connect.Zero()
+	willProps := packets.Properties{}
+	willProps.Zero()
+	props := packets.Properties{}
+	props.Zero()
+	err = packets.DecodeConnect(
+		&connect,
+		p.buf[len(p.buf)-int(p.fh.RemLen):],
+		&props,
+		&willProps,
+	)
+	if err == nil && connect.Version == packets.V31 && !s.allowV31 {
+		err = fmt.Errorf("%w: MQTT 3.1 isn't allowed", packets.UnsupProtocV)
+	}
+	if errors.Is(err, packets.UnsupProtocV) {
+		// in the 3.1.1 form, since that's what the older clients that are
+		// likely to hit this understand
+		c := Client{server: s, conn: conn, version: packets.V311}
+		c.writeConnack(packets.UPV, nil)
+	} else if err != nil && connect.Version == packets.V5 {
+		c := Client{server: s, conn: conn, version: packets.V5}
+		c.writeConnack(packets.PropsReasonCode(err), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		server:        s,
+		listener:      l,
+		conn:          conn,
+		id:            connect.Id.String(),
+		username:      connect.Username.String(),
+		keepalive:     connect.Keepalive,
+		maxPacketSize: maxPacketSize,
+		version:       connect.Version,
+		connectedAt:   time.Now(),
+		log: s.logger.With(
+			"remote_addr", conn.RemoteAddr().String(),
+			"listener", l.Name,
+		),
+	}
+	c.queue = newOutQueue(c, s.queuePolicy)
+	hasUsername := connect.Flags&0b10000000 != 0
+
+	// 3.1 client ids have to be 1 to 23 characters
+	if c.version == packets.V31 {
+		if n := utf8.RuneCountInString(c.id); n == 0 || n > 23 {
+			c.writeConnack(packets.CInV, nil)
+			return nil, InvalidClientId
+		}
+	}
+
+	if connect.Flags&0b00000100 != 0 {
+		topic := connect.WillTopic.String()
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			c.writeConnack(packets.TNI, nil)
+			return nil, InvalidTopic
+		}
+		// sessions end with their connection for now, which always comes
+		// before the will delay is up
+		willProps.Wdi = 0
+		c.will = &Message{
+			Topic:   topic,
+			Payload: connect.WillPayload,
+			QoS:     (connect.Flags >> 3) & 0b11,
+			Props:   &willProps,
+		}
+	}
+
+	if l.Policy.MaxConns > 0 && l.Conns() > int64(l.Policy.MaxConns) {
+		c.writeConnack(packets.QE, nil)
+		return nil, ListenerFull
+	}
+	if rc := s.connLimiter.allow(conn.RemoteAddr()); rc != packets.S {
+		c.writeConnack(rc, nil)
+		return nil, ConnRejected
 	}
 
+	// take the identity from the client certificate if we're told to
+	cert := peerCert(conn)
+	var tlsOpts *TLSOptions
+	if l.certs != nil {
+		tlsOpts = &l.certs.opts
+	}
+	if tlsOpts != nil && tlsOpts.ClientIdFromCert != CertNone {
+		if cert == nil || tlsOpts.ClientIdFromCert.from(cert) == "" {
+			c.writeConnack(packets.CInV, nil)
+			return nil, NoCertIdentity
+		}
+		c.id = tlsOpts.ClientIdFromCert.from(cert)
+	}
+	if tlsOpts != nil && tlsOpts.UsernameFromCert != CertNone {
+		if cert == nil || tlsOpts.UsernameFromCert.from(cert) == "" {
+			c.writeConnack(packets.BUNoP, nil)
+			return nil, NoCertIdentity
+		}
+		c.username = tlsOpts.UsernameFromCert.from(cert)
+		hasUsername = true
+	}
+
+	// run any enhanced authentication before we accept the connection
+	creds := Credentials{
+		ClientId:    c.id,
+		Username:    c.username,
+		Password:    connect.Password,
+		HasUsername: hasUsername,
+		HasPassword: connect.Flags&0b01000000 != 0,
+		RemoteAddr:  conn.RemoteAddr(),
+		PeerCert:    cert,
+	}
+	var authData []byte
+	authenticated := cert != nil
+	if props.Am.Len() > 0 {
+		c.authMethod = props.Am.String()
+		rc, data, err := c.connectAuth(props.Ad)
+		if err != nil {
+			c.writeConnack(rc, nil)
+			return nil, err
+		}
+		authData = data
+		authenticated = true
+		// hooks see who the mechanism verified, not who the CONNECT
+		// claimed to be
+		creds.Username = c.username
+		creds.HasUsername = c.username != ""
+	} else if s.authenticator != nil {
+		err := s.authenticator.Authenticate(&creds)
+		if err != nil {
+			c.writeConnack(authFailedRc(err), nil)
+			return nil, err
+		}
+		authenticated = authenticated || hasUsername
+	}
+	if len(s.hooks) > 0 {
+		err := s.hookConnectAuthenticate(c, &creds)
+		if err != nil {
+			c.writeConnack(authFailedRc(err), nil)
+			return nil, err
+		}
+	}
+	if l.Policy.RequireAuth && !authenticated {
+		c.writeConnack(packets.NA, nil)
+		return nil, NotAuthorized
+	}
+
+	if c.id == "" {
+		// 3.1.1 only lets clients leave out their id if they don't want
+		// their session kept, 3.1 clients never get here
+		if c.version == packets.V311 && connect.Flags&0b00000010 == 0 {
+			c.writeConnack(packets.CInV, nil)
+			return nil, InvalidClientId
+		}
+		c.id = newClientId()
+	}
+	// in process subscriptions rely on client ids never having nulls in
+	// them, the decoder throws them out but ids from certificates don't go
+	// through it
+	if strings.ContainsRune(c.id, 0) {
+		c.writeConnack(packets.CInV, nil)
+		return nil, InvalidClientId
+	}
+	c.log = c.log.With("client_id", c.id)
+
+	// the concurrent limits are only checked once we know we'd otherwise
+	// accept the client, the server releases this when the client is done
+	if rc := s.connLimiter.acquire(conn.RemoteAddr()); rc != packets.S {
+		c.writeConnack(rc, nil)
+		return nil, ConnRejected
+	}
+	err = c.writeConnack(packets.S, func(props *packets.Properties) {
+		props.Mps = uint32(c.maxPacketSize)
+		if c.id != connect.Id.String() {
+			props.Aci.WriteString(c.id)
+		}
+		if c.authMethod != "" {
+			props.Am.WriteString(c.authMethod)
+			props.Ad = append(props.Ad, authData...)
+		}
+	})
+	if err != nil {
+		s.connLimiter.release(conn.RemoteAddr())
+		return nil, err
+	}
+
+	c.log.Info("connected", "username", c.username, "keepalive", c.keepalive)
+	return c, nil
+}
+
+// authFailedRc is the CONNACK reason code for an authentication error
+func authFailedRc(err error) packets.ReasonCode {
+	if errors.Is(err, BadCredentials) {
+		return packets.BUNoP
+	}
+	return packets.NA
+}
+
+// readPacket does a blocking read of a single whole packet from conn, this
+// is only used while setting up a connection, once the client is running
+// everything goes through the readPump
+func (s *Server) readPacket(
+	conn net.Conn,
+	maxPacketSize int,
+) (Packet, error) {
+	buf := s.bp.GetBuf()
 	fh := s.fp.GetFH()
-	off := packets.DecodeFixedHeader(&fh, buf)
-	if off == -1 {
-		// TODO:
+
+	// read the fixed header a byte at a time,
+	// so we never read past the end of the packet
+	n := 0
+	off := -1
+	for off == -1 {
+		if n == 5 {
+			s.bp.ReturnBuf(buf)
+			return Packet{}, MalFixedHead
+		}
+		_, err := io.ReadFull(conn, buf[n:n+1])
+		if err != nil {
+			s.bp.ReturnBuf(buf)
+			return Packet{}, err
+		}
+		n += 1
+		if n >= 2 {
+			off = packets.DecodeFixedHeader(&fh, buf[:n])
+		}
 	}
 
-	return
+	l := off + int(fh.RemLen)
+	if l > maxPacketSize {
+		s.bp.ReturnBuf(buf)
+		return Packet{}, PacketTooBig
+	}
+	if l > len(buf) {
+		buf = append(buf, make([]byte, l-len(buf))...)
+	}
+	_, err := io.ReadFull(conn, buf[off:l])
+	if err != nil {
+		s.bp.ReturnBuf(buf)
+		return Packet{}, err
+	}
+
+	s.metrics.packetIn(buf[:l])
+	return Packet{fh: &fh, buf: buf[:l]}, nil
 }
 
-func (c *Client) Run(ctx context.Context) {
-	c.server.wg.Add(1)
+// writeConnack writes a CONNACK straight to the conn, setProps can be nil
+// if there aren't any properties to send, and isn't called for 3.1.1
+// clients
+func (c *Client) writeConnack(
+	rc packets.ReasonCode,
+	setProps func(props *packets.Properties),
+) error {
+	props := packets.Properties{}
+	props.Zero()
+	if setProps != nil && c.version >= packets.V5 {
+		setProps(&props)
+	}
+	connack := packets.Connack{}
+	connack.Zero()
+	connack.ReasonCode = rc
+
+	buf := c.server.bp.GetBuf()
+	defer c.server.bp.ReturnBuf(buf)
+	scratch := c.server.bp.GetBuf()
+	defer c.server.bp.ReturnBuf(scratch)
 
+	// encode connack packet and write to connection
+	l := packets.EncodeConnack(&connack, c.props(&props), buf, scratch)
+	_, err := c.conn.Write(buf[:l])
+	if err == nil {
+		c.server.metrics.packetOut(buf[:l])
+	}
+	return err
+}
+
+// props is p, or nil if the client is on 3.1.1 or 3.1, for passing to the
+// packets functions
+func (c *Client) props(p *packets.Properties) *packets.Properties {
+	if c.version < packets.V5 {
+		return nil
+	}
+	return p
+}
+
+func newClientId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
+
+func (c *Client) Run(ctx context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
 	readChan := make(chan Packet, 128)
+	c.wg.Add(2)
 	go c.readPump(ctx, readChan)
 	go c.writePump(ctx)
 
+	defer func() {
+		// TODO: graceful shutdown
+		cancel()
+		c.conn.Close()
+		c.wg.Wait()
+
+		rc, fromClient := c.endReason()
+		for _, h := range c.server.hooks {
+			h.OnDisconnect(c, rc, fromClient)
+		}
+		if c.will != nil && !(fromClient && rc == packets.ND) {
+			c.sendWill()
+		}
+		c.server.removeClient(c)
+		c.queue.close()
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
-			// TODO: graceful shutdown
-			cancel()
-			c.wg.Wait()
-			c.server.wg.Done()
 			return
-		case p := <-readChan:
-			c.handlePacket(p)
+		case p, ok := <-readChan:
+			if !ok {
+				return
+			}
+			if !c.handlePacket(p) {
+				return
+			}
 		}
 	}
 }
@@ -69,194 +428,738 @@ func (c *Client) readPump(
 	ctx context.Context,
 	readChan chan<- Packet,
 ) {
-	c.wg.Add(1)
-	buf := make([]byte, c.server.maxPacketSize)
+	defer c.wg.Done()
+	defer close(readChan)
+
+	buf := make([]byte, c.maxPacketSize)
 	accum := 0
 
 pump:
 	for {
-		select {
-		case <-ctx.Done():
-			close(readChan)
-			c.wg.Done()
+		// read some data into a buffer
+		n, err := c.conn.Read(buf[accum:])
+		if err != nil {
 			return
-		default:
-			// read some data into a buffer
-			n, err := c.conn.Read(buf[accum:])
-			if err != nil {
-				log.Fatalf(
-					"error reading from conn: %v\n",
-					err,
-				)
+		}
+		accum += n
+
+		// parse up all the packets from the buffer
+		for {
+			if accum < 2 {
+				// not enough data to read a fixed header
+				continue pump
 			}
-			accum += n
 
-			// parse up all the packets from the buffer
-			for {
-				if accum < 2 {
-					// not enough data to read a fixed header
-					continue pump
-				}
+			fh := c.server.fp.GetFH()
 
-				fh := c.server.fp.GetFH()
-
-				offset := packets.DecodeFixedHeader(
-					&fh,
-					buf,
-				)
-				if offset == -1 {
-					if accum > 5 {
-						// we have enough data for a full fixed header,
-						// so this is a true error
-						log.Fatalf(
-							"error decoding fixed header\n",
-						)
-					}
-
-					// we might not have read enough
-					// for the full fixed header
-					c.server.fp.ReturnFH(fh)
-					continue pump
+			offset := packets.DecodeFixedHeader(
+				&fh,
+				buf[:accum],
+			)
+			if offset == -1 {
+				c.server.fp.ReturnFH(fh)
+				if accum > 5 {
+					// we have enough data for a full fixed header,
+					// so this is a true error
+					c.log.Warn("error decoding fixed header")
+					return
 				}
 
-				if offset+int(fh.RemLen) > accum {
-					// PERF: this means we're doing extra fh decoding
-					continue pump
-				}
+				// we might not have read enough
+				// for the full fixed header
+				continue pump
+			}
+
+			l := offset + int(fh.RemLen)
+			if l > len(buf) {
+				c.log.Warn(PacketTooBig.Error(), "size", l)
+				c.server.fp.ReturnFH(fh)
+				c.sendDisconnect(packets.PTL)
+				return
+			}
+			if l > accum {
+				// PERF: this means we're doing extra fh decoding
+				c.server.fp.ReturnFH(fh)
+				continue pump
+			}
 
+			c.server.metrics.packetIn(buf[:l])
+			switch c.limitPublish(ctx, &fh, l) {
+			case pubStop:
+				c.server.fp.ReturnFH(fh)
+				c.awaitClose(buf)
+				return
+			case pubDrop:
+				c.server.fp.ReturnFH(fh)
+			case pubDeliver:
 				b := c.server.bp.GetBuf()
-				nn := copy(b, buf[:offset+int(fh.RemLen)])
-				if nn < offset+int(fh.RemLen) {
-					b = append(
-						b,
-						buf[nn:offset+int(fh.RemLen)]...,
-					)
+				nn := copy(b, buf[:l])
+				if nn < l {
+					b = append(b, buf[nn:l]...)
 				}
 
-				readChan <- Packet{
-					fh:  &fh,
-					buf: b[:offset+int(fh.RemLen)],
+				select {
+				case readChan <- Packet{fh: &fh, buf: b[:l]}:
+				case <-ctx.Done():
+					return
 				}
-
-				clear(buf[:offset+int(fh.RemLen)])
-				copy(buf, buf[offset+int(fh.RemLen):])
-				accum -= offset + int(fh.RemLen)
 			}
+
+			copy(buf, buf[l:accum])
+			accum -= l
+			clear(buf[accum:])
 		}
 	}
 }
+
+// awaitClose throws away anything else the client sends until the conn is
+// closed, which gives the writePump a second to flush a queued DISCONNECT
+// before the readPump returning shuts the client down
+func (c *Client) awaitClose(buf []byte) {
+	if c.end.Load() == 0 {
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (c *Client) writePump(
 	ctx context.Context,
 ) {
-	c.wg.Add(1)
+	defer c.wg.Done()
 
 	for {
-		select {
-		case <-ctx.Done():
-			// TODO:
-			c.wg.Done()
+		b, ok, overflow := c.queue.pop()
+		if overflow {
+			c.log.Warn("outbound queue overflowed")
+			c.sendDisconnect(packets.UE)
+			c.conn.Close()
+			return
+		}
+		if !ok {
+			if c.queue.ended() {
+				c.conn.Close()
+				return
+			}
+			select {
+			case <-ctx.Done():
+				// TODO: flush whatever is left in the queue
+				return
+			case <-c.queue.ready:
+				continue
+			}
+		}
+
+		_, err := c.conn.Write(b)
+		if err == nil {
+			c.server.metrics.packetOut(b)
+		}
+		c.server.bp.ReturnBuf(b)
+		if err != nil {
+			// closing the conn kicks the readPump out, which shuts
+			// everything else down
+			c.conn.Close()
 			return
-		case b := <-c.writeChan:
 		}
 	}
 }
 
-func (c *Client) handlePacket(p Packet) {
+// handlePacket returns false if the client should be shut down
+func (c *Client) handlePacket(p Packet) bool {
+	defer c.server.fp.ReturnFH(*p.fh)
+
 	switch p.fh.Pt {
 	case packets.PINGREQ:
 		clear(p.buf)
-		p.buf[0] = 0b11010000
-		p.buf[1] = 0
-		c.writeChan <- p.buf[:2]
+		n := packets.EncodePingresp(p.buf)
+		c.queue.push(p.buf[:n])
 	case packets.SUBSCRIBE:
-		log.Printf("got sub\n")
+		return c.handleSubscribe(p)
+	case packets.UNSUBSCRIBE:
+		return c.handleUnsubscribe(p)
+	case packets.PUBLISH:
+		return c.handlePublish(p)
+	case packets.AUTH:
+		return c.handleAuth(p)
+	case packets.DISCONNECT:
 		props := packets.Properties{}
 		props.Zero()
-		sub := packets.Subscribe{}
-		sub.Zero()
-
-		err := packets.DecodeSubscribe(
-			&sub,
-			&props,
-			p.buf[offset:],
+		d := packets.Disconnect{}
+		err := packets.DecodeDisconnect(
+			&d,
+			c.props(&props),
+			p.buf[len(p.buf)-int(p.fh.RemLen):],
 		)
 		if err != nil {
-			log.Fatalf(
-				"%s: error decoding subscribe packet: %v\n",
-				c.id,
-				err,
-			)
+			c.log.Warn("error decoding disconnect packet", "err", err)
+			c.server.bp.ReturnBuf(p.buf)
+			return false
 		}
+		rc := d.ReasonCode
+		c.server.metrics.disconnectsRecv[rc].Add(1)
+		c.setEnd(rc, true)
+		c.log.Info("disconnected", "reason_code", rc)
+		c.server.bp.ReturnBuf(p.buf)
+		return false
+	default:
+		c.log.Warn("invalid packet type", "type", p.fh.Pt.String())
+		c.server.bp.ReturnBuf(p.buf)
+		return false
+	}
+
+	return true
+}
+
+// handleSubscribe returns false if the client should be shut down
+func (c *Client) handleSubscribe(p Packet) bool {
+	props := packets.Properties{}
+	props.Zero()
+	sub := packets.Subscribe{}
+	sub.Zero()
+
+	offset := len(p.buf) - int(p.fh.RemLen)
+
+	err := packets.DecodeSubscribe(
+		&sub,
+		c.props(&props),
+		p.buf[offset:],
+	)
+	if err != nil {
+		c.log.Warn("error decoding subscribe packet", "err", err)
+		c.server.bp.ReturnBuf(p.buf)
+		c.sendDisconnect(packets.PropsReasonCode(err))
+		return false
+	}
 
-		suback := packets.Suback{}
-		suback.Zero()
-		suback.PacketId = sub.PackedId
+	suback := packets.Suback{}
+	suback.Zero()
+	suback.PacketId = sub.PacketId
 
-		for _, filter := range sub.TopicFilters {
-			// TODO: filter cleaning
-			sub := strings.Split(filter.Filter.String(), "/")
-			c.server.topicTrie.AddSubscription(sub, c.id)
+	for _, filter := range sub.TopicFilters {
+		if !c.authorized(filter.Filter.String(), AccessRead) {
+			c.log.Info(
+				"not authorized to subscribe",
+				"filter", filter.Filter.String(),
+			)
 			suback.ReasonCodes = append(
-				suback.ReasonCodes, 0,
+				suback.ReasonCodes, byte(packets.NA),
 			)
+			continue
+		}
+		if len(c.server.hooks) > 0 &&
+			!c.server.hookSubscribe(c, filter.Filter.String()) {
+			c.log.Info(
+				"subscribe rejected by hook",
+				"filter", filter.Filter.String(),
+			)
+			suback.ReasonCodes = append(
+				suback.ReasonCodes, byte(packets.NA),
+			)
+			continue
 		}
 
-		props.Zero()
-		clear(p.buf)
-
-		scratch := c.server.bp.GetBuf()
-		i := packets.EncodeSuback(
-			&suback,
-			&props,
-			p.buf,
-			scratch,
+		// TODO: filter cleaning
+		sub := strings.Split(filter.Filter.String(), "/")
+		c.server.topicTrie.AddSubscription(sub, c.id)
+		c.log.Debug("subscribed", "filter", filter.Filter.String())
+		suback.ReasonCodes = append(
+			suback.ReasonCodes, 0,
 		)
+	}
+
+	props.Zero()
+	buf, scratch := c.ackBufs(p, len(suback.ReasonCodes))
+	i := packets.EncodeSuback(
+		&suback,
+		c.props(&props),
+		buf,
+		scratch,
+	)
+	c.server.bp.ReturnBuf(scratch)
+
+	c.queue.push(buf[:i])
+	return true
+}
+
+// ackBufs gives a cleared buf and scratch to encode a SUBACK or UNSUBACK
+// with n reason codes into, reusing the request's buf if it's big enough.
+// there's a reason code per filter, and empty filters are only a few bytes
+// each, so the ack can be bigger than the pooled bufs
+func (c *Client) ackBufs(p Packet, n int) ([]byte, []byte) {
+	// fixed header, packet id, and empty properties
+	size := n + 8
+
+	buf := p.buf[:cap(p.buf)]
+	if len(buf) < size {
+		c.server.bp.ReturnBuf(p.buf)
+		buf = make([]byte, size)
+	}
+	clear(buf)
+
+	scratch := c.server.bp.GetBuf()
+	if len(scratch) < size {
 		c.server.bp.ReturnBuf(scratch)
+		scratch = make([]byte, size)
+	}
+	return buf, scratch
+}
 
-		c.writeChan <- p.buf[:i]
-	case packets.PUBLISH:
-		c.handlePublish(p)
-	case packets.DISCONNECT:
-		log.Printf("%s: disconnected\n", c.id)
+// handleUnsubscribe returns false if the client should be shut down
+func (c *Client) handleUnsubscribe(p Packet) bool {
+	props := packets.Properties{}
+	props.Zero()
+	unsub := packets.Unsubscribe{}
+	unsub.Zero()
 
-		// remove subs
-		c.server.topicTrie.RemoveSubs(c.id)
+	offset := len(p.buf) - int(p.fh.RemLen)
 
-		// remove from clients
-		c.server.clientsLock.Lock()
-		delete(c.server.clients, c.id)
-		c.server.clientsLock.Unlock()
+	err := packets.DecodeUnsubscribe(
+		&unsub,
+		c.props(&props),
+		p.buf[offset:],
+	)
+	if err != nil {
+		c.log.Warn("error decoding unsubscribe packet", "err", err)
+		c.server.bp.ReturnBuf(p.buf)
+		c.sendDisconnect(packets.PropsReasonCode(err))
+		return false
+	}
 
-		// stop writePump
-		close(c.writeChan)
+	unsuback := packets.Unsuback{}
+	unsuback.Zero()
+	unsuback.PacketId = unsub.PacketId
 
-		// yeet on outa here
-		return
-	default:
-		log.Fatalf(
-			"invalid packet type from %s: %s\n",
+	for _, filter := range unsub.TopicFilters {
+		rc := packets.S
+		if !c.server.topicTrie.RemoveSubscription(
+			strings.Split(filter, "/"),
 			c.id,
-			p.fh.Pt.String(),
-		)
+		) {
+			rc = packets.NSE
+		}
+		c.log.Debug("unsubscribed", "filter", filter, "reason_code", rc)
+		unsuback.ReasonCodes = append(unsuback.ReasonCodes, byte(rc))
+
+		for _, h := range c.server.hooks {
+			h.OnUnsubscribe(c, filter)
+		}
 	}
+
+	props.Zero()
+	buf, scratch := c.ackBufs(p, len(unsuback.ReasonCodes))
+	i := packets.EncodeUnsuback(
+		&unsuback,
+		c.props(&props),
+		buf,
+		scratch,
+	)
+	c.server.bp.ReturnBuf(scratch)
+
+	c.queue.push(buf[:i])
+	return true
 }
 
-func (c *Client) handlePublish(p Packet) {
-	pub := packets.Publish{}
-	props := packets.Properties{}
-	pub.Zero()
+// handlePublish returns false if the client should be shut down
+func (c *Client) handlePublish(p Packet) bool {
+	defer c.server.bp.ReturnBuf(p.buf)
+
+	// the props live on the client so that handing them to the hooks doesn't
+	// make every PUBLISH allocate them
+	props := &c.pubProps
 	props.Zero()
 
 	offset := len(p.buf) - int(p.fh.RemLen)
 
-	err := packets.DecodePublish(
-		p.fh,
+	// the PUBLISH is read in place, so routing it doesn't copy its topic or
+	// payload out of p.buf
+	pub := packets.PublishView{}
+	err := packets.DecodePublishView(
 		&pub,
-		&props,
+		p.fh,
 		p.buf[offset:],
+		c.version >= packets.V5,
 	)
+	if err == nil {
+		err = pub.ValidateProps()
+	}
 	if err != nil {
-		// TODO:
+		c.log.Warn("error decoding publish packet", "err", err)
+		c.sendDisconnect(packets.PropsReasonCode(err))
+		return false
+	}
+	// subscription identifiers are only for the server to send, and we
+	// never give clients a topic alias maximum, so they can't use aliases.
+	// past here nothing the publisher sent only means something on its own
+	// connection, so its properties can be forwarded as they are
+	if pub.HasSubscriptionId() {
+		c.log.Warn("publish with a subscription identifier")
+		c.sendDisconnect(packets.PE)
+		return false
+	}
+	if pub.HasTopicAlias() {
+		c.log.Warn("publish with a topic alias")
+		c.sendDisconnect(packets.TAI)
+		return false
+	}
+	// topic names can't be empty or have wildcards in them, which would
+	// otherwise get matched against the ACL and subscriptions as if they
+	// were plain levels
+	if len(pub.Topic()) == 0 || bytes.ContainsAny(pub.Topic(), "+#") {
+		c.log.Warn("publish to an invalid topic", "topic", string(pub.Topic()))
+		c.sendDisconnect(packets.TNI)
+		return false
+	}
+
+	// the properties are only copied out of p.buf when something needs
+	// them. the payload format check and the hooks need them now, anything
+	// else decodes them once it gets to them
+	var rawProps []byte
+	if c.server.validatePfi || len(c.server.hooks) > 0 {
+		pub.DecodeProps(props)
+	} else {
+		rawProps = pub.Props()
+	}
+
+	if c.server.validatePfi &&
+		props.Pfi == 1 &&
+		!utf8.Valid(pub.Payload()) {
+		c.log.Info("payload is not valid utf8")
+		c.sendDisconnect(packets.PFI)
+		return false
+	}
+
+	// TODO: qos 2
+	qos := pub.Qos()
+	packetId := pub.PacketId()
+
+	// the topic only gets made into a string if something needs it as one
+	topic := ""
+	if c.server.authorizer != nil || len(c.server.hooks) > 0 {
+		topic = string(pub.Topic())
 	}
 
+	if !c.authorized(topic, AccessWrite) {
+		c.log.Info("not authorized to publish", "topic", topic)
+		if qos == 1 {
+			c.queue.push(c.encodePuback(packetId, packets.NA))
+		}
+		return true
+	}
+
+	// the message only gets built for the hooks if there are any
+	var msg *Message
+	if len(c.server.hooks) > 0 {
+		msg = &Message{
+			Topic:   topic,
+			Payload: pub.Payload(),
+			QoS:     qos,
+			Props:   props,
+		}
+		err := c.server.hookPublish(c, msg)
+		if err == nil &&
+			(msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#")) {
+			err = InvalidTopic
+		}
+		if err != nil {
+			c.log.Info(
+				"publish rejected by hook",
+				"topic", topic,
+				"err", err,
+			)
+			if qos == 1 {
+				c.queue.push(c.encodePuback(packetId, packets.ISE))
+			}
+			return true
+		}
+		topic = msg.Topic
+	}
+
+	// TODO: topic cleaning
+	var matches []string
+	if msg != nil {
+		matches = c.server.topicTrie.FindMatches(strings.Split(topic, "/"))
+	} else {
+		matches = c.server.topicTrie.FindMatchesBytes(pub.Topic())
+	}
+	delivered := 0
+
+	if len(matches) > 0 {
+		out := c.server.outboundPublish(c, p, &pub, topic, props, rawProps, msg)
+		delivered = c.server.fanOut(matches, &out, msg)
+	}
+	c.server.metrics.fanout.observe(uint64(delivered))
+	if c.log.Enabled(context.Background(), slog.LevelDebug) {
+		if topic == "" {
+			topic = string(pub.Topic())
+		}
+		c.log.Debug(
+			"publish",
+			"topic", topic,
+			"qos", qos,
+			"size", len(p.buf),
+			"delivered", delivered,
+		)
+	}
+
+	if qos == 1 {
+		rc := packets.S
+		if delivered == 0 {
+			rc = packets.NMS
+		}
+		c.queue.push(c.encodePuback(packetId, rc))
+	}
+
+	return true
+}
+
+// authorized checks the server's Authorizer, if there is one
+func (c *Client) authorized(topic string, a Access) bool {
+	if c.server.authorizer == nil {
+		return true
+	}
+	return c.server.authorizer.Authorize(c.id, c.username, topic, a)
+}
+
+// encodePuback encodes a PUBACK into a buf from the pool
+func (c *Client) encodePuback(
+	packetId uint16,
+	rc packets.ReasonCode,
+) []byte {
+	puback := packets.Puback{ReasonCode: rc, PacketId: packetId}
+	props := packets.Properties{}
+	props.Zero()
+
+	buf := c.server.bp.GetBuf()
+	scratch := c.server.bp.GetBuf()
+	n := packets.EncodePuback(&puback, c.props(&props), buf, scratch)
+	c.server.bp.ReturnBuf(scratch)
+
+	return buf[:n]
+}
+
+// outPublish is a PUBLISH on its way out to subscribers, it gets encoded at
+// most once for each protocol version the subscribers are on
+type outPublish struct {
+	flags byte
+	// topic is only made from topicBytes once something needs it, most
+	// messages never do
+	topic      string
+	topicBytes []byte
+	payload    []byte
+	// if rawProps isn't nil the properties haven't been decoded into props
+	// yet, see properties
+	props    *packets.Properties
+	rawProps []byte
+
+	v5   []byte
+	v311 []byte
+}
+
+// encoded is the PUBLISH encoded for a client on version, 3.1.1 and 3.1
+// clients get it without properties and 5 clients get it with them, even
+// if it came from an older client
+func (o *outPublish) encoded(version byte) []byte {
+	enc := &o.v5
+	if version < packets.V5 {
+		enc = &o.v311
+	}
+
+	if *enc == nil {
+		var props *packets.Properties
+		if version >= packets.V5 {
+			props = o.properties()
+		}
+		topic := o.topicString()
+		size := 16 + len(topic) + len(o.payload)
+		if props != nil {
+			size += propsSize(props)
+		}
+		buf := make([]byte, size)
+		scratch := make([]byte, size)
+		fh := packets.FixedHeader{Pt: packets.PUBLISH, Flags: o.flags}
+		pub := packets.Publish{Payload: o.payload}
+		pub.Topic.WriteString(topic)
+		n := packets.EncodePublish(&fh, &pub, props, buf, scratch)
+		*enc = buf[:n]
+	}
+	return *enc
+}
+
+// topicString is the topic as a string, only converting it the first time
+func (o *outPublish) topicString() string {
+	if o.topic == "" {
+		o.topic = string(o.topicBytes)
+	}
+	return o.topic
+}
+
+// properties are the props, decoding them the first time if they were left
+// in the PUBLISH they came in
+func (o *outPublish) properties() *packets.Properties {
+	if o.rawProps != nil {
+		// they were checked when the PUBLISH came in, so this can't fail
+		packets.DecodeProps(o.props, packets.PUBLISH, o.rawProps)
+		o.rawProps = nil
+	}
+	return o.props
+}
+
+// setEncoded is for when there's already an encoding for version around,
+// like the bytes an unchanged PUBLISH came in as
+func (o *outPublish) setEncoded(version byte, b []byte) {
+	if version < packets.V5 {
+		o.v311 = b
+	} else {
+		o.v5 = b
+	}
+}
+
+// fanOut queues a copy of out for each of the matching clients that's
+// allowed to read its topic, returning how many it went to. msg is only for
+// the OnDeliver hooks, and can be nil if there aren't any
+func (s *Server) fanOut(
+	matches []string,
+	out *outPublish,
+	msg *Message,
+) int {
+	delivered := 0
+	// the hooks and in process subscribers get called after the lock is let
+	// go, so they can call back into the server
+	var subs []*Client
+	var internal []*internalSub
+
+	s.clientsLock.RLock()
+	for _, match := range matches {
+		sub, ok := s.clients[match]
+		if !ok {
+			is, ok := s.internalSubs[match]
+			if ok && s.internalAuthorized(is, out) {
+				internal = append(internal, is)
+				delivered += 1
+			}
+			continue
+		}
+		if s.authorizer != nil && !sub.authorized(out.topicString(), AccessRead) {
+			continue
+		}
+		enc := out.encoded(sub.version)
+		b := s.bp.GetBuf()
+		if len(b) < len(enc) {
+			b = make([]byte, len(enc))
+		}
+		n := copy(b, enc)
+		sub.queue.push(b[:n])
+		delivered += 1
+		if msg != nil {
+			subs = append(subs, sub)
+		}
+	}
+	s.clientsLock.RUnlock()
+
+	if len(internal) > 0 {
+		s.deliverInternal(internal, out)
+	}
+	for _, sub := range subs {
+		for _, h := range s.hooks {
+			h.OnDeliver(sub, msg)
+		}
+	}
+
+	return delivered
+}
+
+// sendDisconnect writes a DISCONNECT straight to the conn, skipping the
+// queue, since the client is about to be shut down. 3.1.1 and 3.1 servers
+// don't send DISCONNECTs, so for those clients it only records why they're
+// going
+func (c *Client) sendDisconnect(rc packets.ReasonCode) {
+	if c.version < packets.V5 {
+		c.setEnd(rc, false)
+		return
+	}
+
+	buf := c.encodeDisconnect(rc)
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := c.conn.Write(buf)
+	if err == nil {
+		c.server.metrics.packetOut(buf)
+	}
+	c.server.metrics.disconnectsSent[rc].Add(1)
+	c.server.bp.ReturnBuf(buf)
+	c.setEnd(rc, false)
+}
+
+// queueDisconnect is sendDisconnect for when the client isn't being shut
+// down from its own goroutines, the DISCONNECT goes out after everything
+// that's already queued, and the writePump closes the conn once it has
+func (c *Client) queueDisconnect(rc packets.ReasonCode) {
+	c.setEnd(rc, false)
+	if c.version < packets.V5 {
+		c.queue.end(nil)
+		return
+	}
+	c.server.metrics.disconnectsSent[rc].Add(1)
+	c.queue.end(c.encodeDisconnect(rc))
+}
+
+// encodeDisconnect encodes a DISCONNECT into a buf from the pool
+func (c *Client) encodeDisconnect(rc packets.ReasonCode) []byte {
+	d := packets.Disconnect{ReasonCode: rc}
+	props := packets.Properties{}
+	props.Zero()
+
+	buf := c.server.bp.GetBuf()
+	scratch := c.server.bp.GetBuf()
+	n := packets.EncodeDisconnect(&d, &props, buf, scratch)
+	c.server.bp.ReturnBuf(scratch)
+
+	return buf[:n]
+}
+
+// setEnd records the DISCONNECT that ended the connection, only the first
+// one counts, since anything after it is the fallout
+func (c *Client) setEnd(rc packets.ReasonCode, fromClient bool) {
+	end := uint32(1)<<9 | uint32(rc)
+	if fromClient {
+		end |= 1 << 8
+	}
+	c.end.CompareAndSwap(0, end)
+}
+
+// endReason is what setEnd recorded, or UE if the connection ended without
+// a DISCONNECT
+func (c *Client) endReason() (rc packets.ReasonCode, fromClient bool) {
+	end := c.end.Load()
+	if end == 0 {
+		return packets.UE, false
+	}
+	return packets.ReasonCode(end), end&(1<<8) != 0
+}
+
+// sendWill publishes the client's will, if it's still allowed to publish to
+// the will topic
+func (c *Client) sendWill() {
+	if !c.authorized(c.will.Topic, AccessWrite) {
+		c.log.Info("not authorized to publish will", "topic", c.will.Topic)
+		return
+	}
+	delivered, err := c.server.publish(
+		c.will.Topic,
+		c.will.Payload,
+		c.will.Props,
+	)
+	if err != nil {
+		c.log.Warn("error publishing will", "err", err)
+		return
+	}
+	c.log.Debug("sent will", "topic", c.will.Topic, "delivered", delivered)
+
+	for _, h := range c.server.hooks {
+		h.OnWillSent(c, c.will)
+	}
 }
@@ -0,0 +1,629 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// testPacket reads encoded back into a Packet, the way the readPump hands
+// them to handlePacket
+func testPacket(encoded []byte) Packet {
+	fh := packets.FixedHeader{}
+	fh.Zero()
+	packets.DecodeFixedHeader(&fh, encoded)
+	return Packet{fh: &fh, buf: encoded}
+}
+
+// testVersions are the protocol levels with their own acks
+var testVersions = []struct {
+	name    string
+	version byte
+}{
+	{"v5", packets.V5},
+	{"v311", packets.V311},
+}
+
+func TestSubackManyFilters(t *testing.T) {
+	// empty filters are 3 bytes each, so the SUBACK is almost half the size
+	// of the SUBSCRIBE, and bigger than a pooled buf
+	const n = 1300
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			c := benchClient(&s, "c")
+			c.version = v.version
+
+			sub := packets.Subscribe{PacketId: 1}
+			sub.TopicFilters = make([]packets.TopicFilter, n)
+			props := packets.Properties{}
+			props.Zero()
+			buf := make([]byte, s.maxPacketSize)
+			scratch := make([]byte, s.maxPacketSize)
+			l := packets.EncodeSubscribe(&sub, c.props(&props), buf, scratch)
+
+			if !c.handleSubscribe(testPacket(buf[:l])) {
+				t.Fatalf("subscribe failed")
+			}
+
+			out, ok, _ := c.queue.pop()
+			if !ok {
+				t.Fatalf("no suback")
+			}
+			suback := packets.Suback{}
+			fh := packets.FixedHeader{}
+			off := packets.DecodeFixedHeader(&fh, out)
+			props.Zero()
+			err := packets.DecodeSuback(&suback, c.props(&props), out[off:])
+			if err != nil {
+				t.Fatalf("decode suback: %v", err)
+			}
+			if suback.PacketId != 1 || len(suback.ReasonCodes) != n {
+				t.Fatalf(
+					"suback for %d with %d reason codes",
+					suback.PacketId, len(suback.ReasonCodes),
+				)
+			}
+		})
+	}
+}
+
+func TestUnsubackManyFilters(t *testing.T) {
+	// empty filters are 2 bytes each, and each gets a reason code
+	const n = 2000
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	c := benchClient(&s, "c")
+	c.version = packets.V5
+
+	unsub := packets.Unsubscribe{PacketId: 1}
+	unsub.TopicFilters = make([]string, n)
+	props := packets.Properties{}
+	props.Zero()
+	buf := make([]byte, s.maxPacketSize)
+	scratch := make([]byte, s.maxPacketSize)
+	l := packets.EncodeUnsubscribe(&unsub, &props, buf, scratch)
+
+	if !c.handleUnsubscribe(testPacket(buf[:l])) {
+		t.Fatalf("unsubscribe failed")
+	}
+
+	out, ok, _ := c.queue.pop()
+	if !ok {
+		t.Fatalf("no unsuback")
+	}
+	unsuback := packets.Unsuback{}
+	fh := packets.FixedHeader{}
+	off := packets.DecodeFixedHeader(&fh, out)
+	props.Zero()
+	err := packets.DecodeUnsuback(&unsuback, &props, out[off:])
+	if err != nil {
+		t.Fatalf("decode unsuback: %v", err)
+	}
+	if unsuback.PacketId != 1 || len(unsuback.ReasonCodes) != n {
+		t.Fatalf(
+			"unsuback for %d with %d reason codes",
+			unsuback.PacketId, len(unsuback.ReasonCodes),
+		)
+	}
+}
+
+func TestPublishPropsForwarded(t *testing.T) {
+	// qos 1 gets re-encoded, so the properties have to be decoded from
+	// where they were left in the PUBLISH
+	for _, qos := range []byte{0, 1} {
+		t.Run(string('0'+qos), func(t *testing.T) {
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			pub := benchClient(&s, "pub")
+			pub.version = packets.V5
+			sub := benchClient(&s, "sub")
+			sub.version = packets.V5
+			s.topicTrie.AddSubscription([]string{"a"}, sub.id)
+
+			fh := packets.FixedHeader{Pt: packets.PUBLISH, Flags: qos << 1}
+			p := packets.Publish{PacketId: 1, Payload: []byte("hi")}
+			p.Topic.WriteString("a")
+			props := packets.Properties{}
+			props.Zero()
+			props.Ct.WriteString("text/plain")
+			props.AddUserProp("k", "v")
+			buf := s.bp.GetBuf()
+			scratch := make([]byte, KB)
+			n := packets.EncodePublish(&fh, &p, &props, buf, scratch)
+			if !pub.handlePublish(testPacket(buf[:n])) {
+				t.Fatalf("publish failed")
+			}
+
+			out, ok, _ := sub.queue.pop()
+			if !ok {
+				t.Fatalf("nothing delivered")
+			}
+			off := packets.DecodeFixedHeader(&fh, out)
+			got := packets.Publish{}
+			got.Zero()
+			props.Zero()
+			err := packets.DecodePublish(&fh, &got, &props, out[off:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if props.Ct.String() != "text/plain" || len(props.Up) != 1 ||
+				props.Up[0].Name.String() != "k" ||
+				props.Up[0].Val.String() != "v" {
+				t.Fatalf("properties weren't forwarded")
+			}
+		})
+	}
+}
+
+func TestPublishPayloadFormat(t *testing.T) {
+	invalid := []byte{0xff, 0xfe}
+	for _, tc := range []struct {
+		name     string
+		validate bool
+		pfi      byte
+		payload  []byte
+		rc       packets.ReasonCode // 0 if it's delivered
+	}{
+		{"invalid utf8", true, 1, invalid, packets.PFI},
+		{"valid utf8", true, 1, []byte("héllo"), 0},
+		{"unspecified bytes", true, 0, invalid, 0},
+		{"not validating", false, 1, invalid, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			s.ValidatePayloadFormat(tc.validate)
+			pl := testServer(t, &s)
+			sub := testConnect(t, pl, "sub")
+			testSubscribe(t, sub, "a")
+			conn := testConnect(t, pl, "pub")
+
+			fh := packets.FixedHeader{Pt: packets.PUBLISH}
+			p := packets.Publish{Payload: tc.payload}
+			p.Topic.WriteString("a")
+			props := packets.Properties{}
+			props.Zero()
+			props.Pfi = tc.pfi
+			props.Ct.WriteString("application/json; charset=utf-8")
+			testWrite(t, conn, func(buf, scratch []byte) int {
+				return packets.EncodePublish(&fh, &p, &props, buf, scratch)
+			})
+
+			if tc.rc != 0 {
+				fh, body := testRead(t, conn)
+				if fh.Pt != packets.DISCONNECT || body[0] != byte(tc.rc) {
+					t.Fatalf("got packet type %d, %v", fh.Pt, body)
+				}
+				sub.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if _, err := sub.Read(make([]byte, 1)); err == nil {
+					t.Fatalf("subscriber got the publish")
+				}
+				return
+			}
+
+			// the payload format and content type get to the subscriber
+			// just as they were sent
+			fh, body := testRead(t, sub)
+			if fh.Pt != packets.PUBLISH {
+				t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PUBLISH)
+			}
+			got := packets.Publish{}
+			got.Zero()
+			props.Zero()
+			err := packets.DecodePublish(&fh, &got, &props, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Payload, tc.payload) {
+				t.Fatalf("payload = %v, want %v", got.Payload, tc.payload)
+			}
+			if props.Pfi != tc.pfi {
+				t.Fatalf("payload format = %d, want %d", props.Pfi, tc.pfi)
+			}
+			if ct := props.Ct.String(); ct != "application/json; charset=utf-8" {
+				t.Fatalf("content type = %q", ct)
+			}
+		})
+	}
+}
+
+func TestPublishClientOnlyProps(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(p *packets.Properties)
+		rc   packets.ReasonCode
+	}{
+		{"subscription id", func(p *packets.Properties) { p.Si = 5 }, packets.PE},
+		{"topic alias", func(p *packets.Properties) { p.Ta = 1 }, packets.TAI},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			pl := testServer(t, &s)
+			sub := testConnect(t, pl, "sub")
+			testSubscribe(t, sub, "a")
+			conn := testConnect(t, pl, "pub")
+
+			fh := packets.FixedHeader{Pt: packets.PUBLISH}
+			p := packets.Publish{Payload: []byte("hi")}
+			p.Topic.WriteString("a")
+			props := packets.Properties{}
+			props.Zero()
+			tc.set(&props)
+			testWrite(t, conn, func(buf, scratch []byte) int {
+				return packets.EncodePublish(&fh, &p, &props, buf, scratch)
+			})
+
+			fh, body := testRead(t, conn)
+			if fh.Pt != packets.DISCONNECT || body[0] != byte(tc.rc) {
+				t.Fatalf("got packet type %d, %v", fh.Pt, body)
+			}
+			// and it never reaches the subscriber
+			sub.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, err := sub.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("subscriber got the publish")
+			}
+		})
+	}
+}
+
+func TestPublishInvalidTopic(t *testing.T) {
+	for _, v := range testVersions {
+		for _, topic := range []string{"", "a/+", "a/#", "#"} {
+			t.Run(v.name+"/"+topic, func(t *testing.T) {
+				// no hooks and no authorizer, so nothing else looks at
+				// the topic before it's routed
+				s := NewServer()
+				pl := testServer(t, &s)
+				sub := testConnect(t, pl, "sub")
+				testSubscribe(t, sub, "#")
+
+				connect := packets.Connect{Version: v.version, Flags: 0b00000010}
+				connect.Id.WriteString("pub")
+				conn, rc := testConnectPacket(t, pl, &connect)
+				if rc != packets.S {
+					t.Fatalf("connect rejected with %d", rc)
+				}
+
+				fh := packets.FixedHeader{Pt: packets.PUBLISH}
+				p := packets.Publish{Payload: []byte("hi")}
+				p.Topic.WriteString(topic)
+				var props *packets.Properties
+				if v.version == packets.V5 {
+					props = &packets.Properties{}
+					props.Zero()
+				}
+				testWrite(t, conn, func(buf, scratch []byte) int {
+					return packets.EncodePublish(&fh, &p, props, buf, scratch)
+				})
+
+				// v5 gets told why, 3.1.1 just gets hung up on
+				if v.version == packets.V5 {
+					fh, body := testRead(t, conn)
+					if fh.Pt != packets.DISCONNECT || body[0] != byte(packets.TNI) {
+						t.Fatalf("got packet type %d, %v", fh.Pt, body)
+					}
+				}
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Fatalf("connection still open: %v", err)
+				}
+				sub.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if _, err := sub.Read(make([]byte, 1)); err == nil {
+					t.Fatalf("subscriber got the publish")
+				}
+			})
+		}
+	}
+}
+
+// sharedPropsHook gives every message the same Properties
+type sharedPropsHook struct {
+	HookBase
+	props *packets.Properties
+}
+
+func (h *sharedPropsHook) OnPublish(c *Client, msg *Message) error {
+	msg.Props = h.props
+	return nil
+}
+
+func TestPublishRulesCopyHookProps(t *testing.T) {
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	shared := &packets.Properties{}
+	shared.Zero()
+	shared.AddUserProp("k", "v")
+	shared.Si = 5
+	s.AddHook(&sharedPropsHook{props: shared})
+	s.AddUserPropRule(NodeProp("node", "n1"))
+	pub := benchClient(&s, "pub")
+	pub.version = packets.V5
+	sub := benchClient(&s, "sub")
+	sub.version = packets.V5
+	s.topicTrie.AddSubscription([]string{"a"}, sub.id)
+
+	for range 3 {
+		fh := packets.FixedHeader{Pt: packets.PUBLISH}
+		p := packets.Publish{Payload: []byte("hi")}
+		p.Topic.WriteString("a")
+		props := packets.Properties{}
+		props.Zero()
+		buf := s.bp.GetBuf()
+		n := packets.EncodePublish(&fh, &p, &props, buf, make([]byte, KB))
+		if !pub.handlePublish(testPacket(buf[:n])) {
+			t.Fatalf("publish failed")
+		}
+
+		out, ok, _ := sub.queue.pop()
+		if !ok {
+			t.Fatalf("nothing delivered")
+		}
+		off := packets.DecodeFixedHeader(&fh, out)
+		got := packets.Publish{}
+		got.Zero()
+		props.Zero()
+		err := packets.DecodePublish(&fh, &got, &props, out[off:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the rule's property is added once, after the hook's, and the
+		// subscription identifier the hook left in isn't forwarded
+		if len(props.Up) != 2 || props.Up[1].Name.String() != "node" ||
+			props.Si != 0 {
+			t.Fatalf("props = %+v", props)
+		}
+	}
+	if len(shared.Up) != 1 {
+		t.Fatalf("hook's props changed: %+v", shared.Up)
+	}
+}
+
+// versionProps is empty Properties for v5 and nil before that, like
+// Client.props, for passing to the packets functions
+func versionProps(version byte) *packets.Properties {
+	if version < packets.V5 {
+		return nil
+	}
+	props := &packets.Properties{}
+	props.Zero()
+	return props
+}
+
+// testConnectVersion connects a client with a clean session at version
+func testConnectVersion(
+	t *testing.T,
+	pl *PipeListener,
+	version byte,
+	id string,
+) net.Conn {
+	t.Helper()
+	connect := packets.Connect{Version: version, Flags: 0b00000010}
+	connect.Id.WriteString(id)
+	conn, rc := testConnectPacket(t, pl, &connect)
+	if rc != packets.S {
+		t.Fatalf("connect rejected with %d", rc)
+	}
+	return conn
+}
+
+// testSubscribeVersion subscribes conn to filters, returning the SUBACK's
+// reason codes, or return codes before v5
+func testSubscribeVersion(
+	t *testing.T,
+	conn net.Conn,
+	version byte,
+	filters ...string,
+) []byte {
+	t.Helper()
+	sub := packets.Subscribe{PacketId: 1}
+	sub.TopicFilters = make([]packets.TopicFilter, len(filters))
+	for i, filter := range filters {
+		sub.TopicFilters[i].Filter.WriteString(filter)
+	}
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeSubscribe(&sub, versionProps(version), buf, scratch)
+	})
+	fh, body := testRead(t, conn)
+	suback := packets.Suback{}
+	err := packets.DecodeSuback(&suback, versionProps(version), body)
+	if fh.Pt != packets.SUBACK || err != nil {
+		t.Fatalf("expected suback, got %d: %v", fh.Pt, err)
+	}
+	return suback.ReasonCodes
+}
+
+func TestConnectV311ReturnCodes(t *testing.T) {
+	fa, err := NewFileAuthenticator(
+		writePasswordFile(t, "alice:"+HashArgon2id("pw")+"\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.SetAuthenticator(fa)
+	pl := testServer(t, &s)
+
+	for _, tc := range []struct {
+		name     string
+		id       string
+		clean    bool
+		username string
+		password string
+		want     packets.ReasonCode // the 3.1.1 return code
+	}{
+		{"accepted", "c", true, "alice", "pw", 0},
+		{"bad password", "c", true, "alice", "nope", 4},
+		{"anonymous", "c", true, "", "", 5},
+		{"no id with a clean session", "", true, "alice", "pw", 0},
+		{"no id without a clean session", "", false, "alice", "pw", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			connect := packets.Connect{Version: packets.V311}
+			connect.Id.WriteString(tc.id)
+			if tc.clean {
+				connect.Flags |= 0b00000010
+			}
+			if tc.username != "" {
+				connect.Flags |= 0b11000000
+				connect.Username.WriteString(tc.username)
+				connect.Password = []byte(tc.password)
+			}
+			conn, rc := testConnectPacket(t, pl, &connect)
+			if rc != tc.want {
+				t.Fatalf("return code = %d, want %d", rc, tc.want)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestSubscribeDeniedVersions(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			acl, err := NewACL(writeACLFile(t, "readwrite * ok\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewServer()
+			s.SetAuthorizer(acl)
+			pl := testServer(t, &s)
+			conn := testConnectVersion(t, pl, v.version, "c")
+
+			// 3.1.1 only has the one failure code
+			want := []byte{0, byte(packets.NA)}
+			if v.version == packets.V311 {
+				want = []byte{0, 0x80}
+			}
+			got := testSubscribeVersion(t, conn, v.version, "ok", "secret")
+			if !bytes.Equal(got, want) {
+				t.Fatalf("suback = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestPublishAcrossVersions(t *testing.T) {
+	for _, pv := range testVersions {
+		for _, sv := range testVersions {
+			t.Run(pv.name+" to "+sv.name, func(t *testing.T) {
+				s := NewServer()
+				pl := testServer(t, &s)
+				sub := testConnectVersion(t, pl, sv.version, "sub")
+				testSubscribeVersion(t, sub, sv.version, "a")
+				pub := testConnectVersion(t, pl, pv.version, "pub")
+
+				fh := packets.FixedHeader{Pt: packets.PUBLISH}
+				p := packets.Publish{Payload: []byte("hi")}
+				p.Topic.WriteString("a")
+				props := versionProps(pv.version)
+				if props != nil {
+					props.Ct.WriteString("text/plain")
+					props.AddUserProp("k", "v")
+				}
+				testWrite(t, pub, func(buf, scratch []byte) int {
+					return packets.EncodePublish(&fh, &p, props, buf, scratch)
+				})
+
+				// properties are left off for 3.1.1, and only ever come
+				// from a v5 publisher
+				fh, body := testRead(t, sub)
+				got := packets.Publish{}
+				got.Zero()
+				gotProps := versionProps(sv.version)
+				err := packets.DecodePublish(&fh, &got, gotProps, body)
+				if fh.Pt != packets.PUBLISH || err != nil {
+					t.Fatalf("expected publish, got %d: %v", fh.Pt, err)
+				}
+				if got.Topic.String() != "a" || string(got.Payload) != "hi" {
+					t.Fatalf("got %q %q", got.Topic.String(), got.Payload)
+				}
+				if gotProps != nil {
+					wantCt, wantUp := "", 0
+					if props != nil {
+						wantCt, wantUp = "text/plain", 1
+					}
+					if ct := gotProps.Ct.String(); ct != wantCt {
+						t.Fatalf("content type = %q, want %q", ct, wantCt)
+					}
+					if len(gotProps.Up) != wantUp {
+						t.Fatalf("user properties = %v", gotProps.Up)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestConnectV31(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		allow bool
+		id    string
+		want  packets.ReasonCode // the 3.1 return code
+	}{
+		{"not allowed", false, "legacy", 1},
+		{"allowed", true, "legacy", 0},
+		{"23 character id", true, strings.Repeat("x", 23), 0},
+		{"24 character id", true, strings.Repeat("x", 24), 2},
+		{"no id", true, "", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			s.AllowMQTT31(tc.allow)
+			pl := testServer(t, &s)
+
+			connect := packets.Connect{Version: packets.V31, Flags: 0b00000010}
+			connect.Id.WriteString(tc.id)
+			_, rc := testConnectPacket(t, pl, &connect)
+			if rc != tc.want {
+				t.Fatalf("return code = %d, want %d", rc, tc.want)
+			}
+		})
+	}
+}
+
+func TestPublishV31(t *testing.T) {
+	s := NewServer()
+	s.AllowMQTT31(true)
+	pl := testServer(t, &s)
+
+	// 3.1 clients share the broker with everyone else
+	legacy := testConnectVersion(t, pl, packets.V31, "legacy")
+	if got := testSubscribeVersion(t, legacy, packets.V31, "a"); !bytes.Equal(got, []byte{0}) {
+		t.Fatalf("suback = %v, want [0]", got)
+	}
+	modern := testConnectVersion(t, pl, packets.V5, "modern")
+	testSubscribeVersion(t, modern, packets.V5, "b")
+
+	publish := func(conn net.Conn, version byte, topic string) {
+		fh := packets.FixedHeader{Pt: packets.PUBLISH}
+		p := packets.Publish{Payload: []byte("hi")}
+		p.Topic.WriteString(topic)
+		testWrite(t, conn, func(buf, scratch []byte) int {
+			return packets.EncodePublish(&fh, &p, versionProps(version), buf, scratch)
+		})
+	}
+	expect := func(conn net.Conn, version byte, topic string) {
+		fh, body := testRead(t, conn)
+		got := packets.Publish{}
+		got.Zero()
+		err := packets.DecodePublish(&fh, &got, versionProps(version), body)
+		if fh.Pt != packets.PUBLISH || err != nil {
+			t.Fatalf("expected publish, got %d: %v", fh.Pt, err)
+		}
+		if got.Topic.String() != topic || string(got.Payload) != "hi" {
+			t.Fatalf("got %q %q", got.Topic.String(), got.Payload)
+		}
+	}
+
+	publish(modern, packets.V5, "a")
+	expect(legacy, packets.V31, "a")
+	publish(legacy, packets.V31, "b")
+	expect(modern, packets.V5, "b")
+}
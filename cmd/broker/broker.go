@@ -1,15 +1,108 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/andrew-r-thomas/mqtt"
 )
 
-const addr = ":1883"
-
 func main() {
-	s := mqtt.NewServer()
-	err := s.Start(addr)
-	fmt.Printf("broker stopped: %v\n", err)
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	configPath := fs.String(
+		"config",
+		os.Getenv("MQTT_CONFIG"),
+		"config file, .yaml, .toml or .json",
+	)
+	overrides := mqtt.ConfigOverrides{}
+	overrides.RegisterFlags(fs)
+	fs.Parse(os.Args[1:])
+	overrides.LoadEnv("MQTT_")
+
+	cfg := mqtt.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = mqtt.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	err := overrides.Apply(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad setting: %v\n", err)
+		os.Exit(2)
+	}
+
+	s, err := mqtt.NewServerFromConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad config:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	shutdown := make(chan struct{})
+	go handleSignals(s, *configPath, &overrides, shutdown)
+
+	err = s.ListenAndServe()
+	if err != mqtt.ServerClosed {
+		fmt.Fprintf(os.Stderr, "broker stopped: %v\n", err)
+		os.Exit(1)
+	}
+	<-shutdown
+}
+
+// handleSignals reloads the config on SIGHUP, and shuts the server down on
+// SIGTERM or SIGINT, closing done once it has
+func handleSignals(
+	s *mqtt.Server,
+	configPath string,
+	overrides *mqtt.ConfigOverrides,
+	done chan<- struct{},
+) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		cfg := mqtt.DefaultConfig()
+		if configPath != "" {
+			var err error
+			cfg, err = mqtt.LoadConfig(configPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reloading config: %v\n", err)
+				continue
+			}
+		}
+		err := overrides.Apply(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bad setting: %v\n", err)
+			continue
+		}
+		needRestart, err := s.Reload(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reloading config:\n%v\n", err)
+			continue
+		}
+		for _, setting := range needRestart {
+			fmt.Fprintf(os.Stderr, "%s changed, restart to apply it\n", setting)
+		}
+	}
+	signal.Stop(sigs)
+
+	// a second signal while shutting down kills the broker straight away
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error shutting down: %v\n", err)
+	}
+	close(done)
 }
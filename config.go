@@ -0,0 +1,686 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig is everything NewServerFromConfig needs to set up a server.
+// it can be loaded from a YAML, TOML or JSON file with LoadConfig, the keys
+// are the same in all three
+type ServerConfig struct {
+	Listeners []ListenerConfig `json:"listeners"`
+
+	MaxPacketSize int `json:"max_packet_size"`
+	// how long a new connection has to send its CONNECT, zero means forever
+	ConnectTimeout Duration `json:"connect_timeout"`
+
+	BufPoolSize         int `json:"buf_pool_size"`
+	BufSize             int `json:"buf_size"`
+	FixedHeaderPoolSize int `json:"fixed_header_pool_size"`
+
+	Log    LogConfig    `json:"log"`
+	Auth   AuthConfig   `json:"auth"`
+	Limits LimitsConfig `json:"limits"`
+	Queue  QueueConfig  `json:"queue"`
+
+	ValidatePayloadFormat bool               `json:"validate_payload_format"`
+	UserProperties        UserPropertyConfig `json:"user_properties"`
+	// accept legacy MQTT 3.1 (MQIsdp) clients
+	AllowMQTT31 bool `json:"allow_mqtt31"`
+
+	// addresses for the metrics and admin http servers, "" turns them off
+	MetricsAddr string `json:"metrics_addr"`
+	AdminAddr   string `json:"admin_addr"`
+}
+
+type ListenerConfig struct {
+	// defaults to the type
+	Name string `json:"name"`
+	// tcp, tls, websocket or unix
+	Type string `json:"type"`
+	// the path of the socket for unix listeners
+	Addr string `json:"addr"`
+	// the http path to upgrade for websocket listeners, defaults to /mqtt
+	Path string `json:"path"`
+
+	MaxConns      int  `json:"max_conns"`
+	RequireAuth   bool `json:"require_auth"`
+	MaxPacketSize int  `json:"max_packet_size"`
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	TLS TLSConfig `json:"tls"`
+}
+
+type TLSConfig struct {
+	CertFile          string `json:"cert_file"`
+	KeyFile           string `json:"key_file"`
+	ClientCAFile      string `json:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert"`
+	// "", "common_name" or "subject"
+	UsernameFromCert string   `json:"username_from_cert"`
+	ClientIdFromCert string   `json:"client_id_from_cert"`
+	PollInterval     Duration `json:"poll_interval"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `json:"level"`
+	// text or json
+	Format string `json:"format"`
+}
+
+type AuthConfig struct {
+	// see FileAuthenticator and NewACL for the file formats
+	PasswordFile   string `json:"password_file"`
+	AllowAnonymous bool   `json:"allow_anonymous"`
+	ACLFile        string `json:"acl_file"`
+}
+
+type LimitsConfig struct {
+	ConnPerIPRate    float64 `json:"conn_per_ip_rate"`
+	ConnPerIPBurst   int     `json:"conn_per_ip_burst"`
+	ConnGlobalRate   float64 `json:"conn_global_rate"`
+	ConnGlobalBurst  int     `json:"conn_global_burst"`
+	MaxConns         int     `json:"max_conns"`
+	MaxConnsPerIP    int     `json:"max_conns_per_ip"`
+	PublishMsgRate   float64 `json:"publish_msg_rate"`
+	PublishMsgBurst  int     `json:"publish_msg_burst"`
+	PublishByteRate  float64 `json:"publish_byte_rate"`
+	PublishByteBurst int     `json:"publish_byte_burst"`
+	// throttle, drop_qos0 or disconnect
+	PublishOverflow string `json:"publish_overflow"`
+}
+
+type QueueConfig struct {
+	MaxMsgs  int `json:"max_msgs"`
+	MaxBytes int `json:"max_bytes"`
+	// drop_newest, drop_oldest, disconnect or spill
+	Overflow      string `json:"overflow"`
+	SpillDir      string `json:"spill_dir"`
+	MaxSpillBytes int64  `json:"max_spill_bytes"`
+}
+
+// names for the user properties the server adds to every PUBLISH it
+// forwards, "" leaves them off. see NodeProp, IngressTimeProp and
+// UsernameProp
+type UserPropertyConfig struct {
+	Node        string `json:"node"`
+	NodeValue   string `json:"node_value"`
+	IngressTime string `json:"ingress_time"`
+	Username    string `json:"username"`
+}
+
+// Duration is a time.Duration written like "10s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// DefaultConfig matches what NewServer sets up, plus a plain tcp listener
+// on :1883
+func DefaultConfig() *ServerConfig {
+	return &ServerConfig{
+		Listeners: []ListenerConfig{
+			{Name: "tcp", Type: "tcp", Addr: ":1883"},
+		},
+		MaxPacketSize:       4 * KB,
+		BufPoolSize:         100,
+		BufSize:             DefaultBufSize,
+		FixedHeaderPoolSize: 100,
+		Log:                 LogConfig{Level: "info", Format: "text"},
+		Limits:              LimitsConfig{PublishOverflow: "throttle"},
+		Queue:               QueueConfig{Overflow: "drop_newest"},
+	}
+}
+
+// LoadConfig reads a config file on top of DefaultConfig, the format comes
+// from the file extension, which has to be .yaml, .yml, .toml or .json
+func LoadConfig(path string) (*ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// yaml and toml get turned into json, so the json tags are the only
+	// ones the config structs need
+	var raw any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+		if err == nil {
+			data, err = json.Marshal(raw)
+		}
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+		if err == nil {
+			data, err = json.Marshal(raw)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// decoding into the default listeners would merge them with the ones
+	// in the file, so they're only put back if the file doesn't have any
+	cfg := DefaultConfig()
+	defaults := cfg.Listeners
+	cfg.Listeners = nil
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Listeners == nil {
+		cfg.Listeners = defaults
+	}
+	return cfg, nil
+}
+
+// Validate checks the whole config, returning every problem it finds
+func (cfg *ServerConfig) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(cfg.Listeners) == 0 {
+		bad("no listeners")
+	}
+	names := make(map[string]bool, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		name := lc.name()
+		if names[name] {
+			bad("listeners[%d]: duplicate name %q", i, name)
+		}
+		names[name] = true
+
+		switch lc.Type {
+		case "tcp", "unix", "websocket":
+		case "tls":
+			if lc.TLS.CertFile == "" || lc.TLS.KeyFile == "" {
+				bad("listener %s: tls needs cert_file and key_file", name)
+			}
+			if lc.TLS.RequireClientCert && lc.TLS.ClientCAFile == "" {
+				bad("listener %s: require_client_cert needs client_ca_file", name)
+			}
+			for _, ci := range []string{
+				lc.TLS.UsernameFromCert,
+				lc.TLS.ClientIdFromCert,
+			} {
+				if _, err := parseCertIdentity(ci); err != nil {
+					bad("listener %s: %v", name, err)
+				}
+			}
+		default:
+			bad("listener %s: unknown type %q", name, lc.Type)
+		}
+		if lc.Addr == "" {
+			bad("listener %s: no addr", name)
+		}
+		if lc.Path != "" && !strings.HasPrefix(lc.Path, "/") {
+			bad("listener %s: path has to start with /", name)
+		}
+		if lc.MaxConns < 0 {
+			bad("listener %s: max_conns can't be negative", name)
+		}
+		if lc.MaxPacketSize != 0 && !validPacketSize(lc.MaxPacketSize) {
+			bad("listener %s: max_packet_size out of range", name)
+		}
+	}
+
+	if !validPacketSize(cfg.MaxPacketSize) {
+		bad("max_packet_size out of range")
+	}
+	if cfg.ConnectTimeout < 0 {
+		bad("connect_timeout can't be negative")
+	}
+	if cfg.BufPoolSize < 0 || cfg.FixedHeaderPoolSize < 0 {
+		bad("pool sizes can't be negative")
+	}
+	if cfg.BufSize <= 0 {
+		bad("buf_size has to be positive")
+	}
+
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		bad("log: %v", err)
+	}
+	if _, err := parseLogFormat(cfg.Log.Format); err != nil {
+		bad("log: %v", err)
+	}
+
+	l := cfg.Limits
+	if l.ConnPerIPRate < 0 || l.ConnGlobalRate < 0 ||
+		l.PublishMsgRate < 0 || l.PublishByteRate < 0 ||
+		l.ConnPerIPBurst < 0 || l.ConnGlobalBurst < 0 ||
+		l.PublishMsgBurst < 0 || l.PublishByteBurst < 0 ||
+		l.MaxConns < 0 || l.MaxConnsPerIP < 0 {
+		bad("limits can't be negative")
+	}
+	if _, err := parsePublishOverflow(l.PublishOverflow); err != nil {
+		bad("limits: %v", err)
+	}
+
+	if cfg.Queue.MaxMsgs < 0 || cfg.Queue.MaxBytes < 0 ||
+		cfg.Queue.MaxSpillBytes < 0 {
+		bad("queue limits can't be negative")
+	}
+	if _, err := parseQueueOverflow(cfg.Queue.Overflow); err != nil {
+		bad("queue: %v", err)
+	}
+
+	if (cfg.UserProperties.Node == "") != (cfg.UserProperties.NodeValue == "") {
+		bad("user_properties: node and node_value go together")
+	}
+
+	return errors.Join(errs...)
+}
+
+// the largest remaining length is 268435455, plus up to 5 bytes of fixed
+// header, and anything much smaller than this can't fit a CONNECT
+func validPacketSize(n int) bool {
+	return n >= 64 && n <= 268435460
+}
+
+func (lc *ListenerConfig) name() string {
+	if lc.Name != "" {
+		return lc.Name
+	}
+	return lc.Type
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return 0, fmt.Errorf("unknown level %q", s)
+	}
+	return level, nil
+}
+
+func parseLogFormat(s string) (LogFormat, error) {
+	switch s {
+	case "text", "":
+		return LogText, nil
+	case "json":
+		return LogJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q", s)
+	}
+}
+
+func parseCertIdentity(s string) (CertIdentity, error) {
+	switch s {
+	case "":
+		return CertNone, nil
+	case "common_name":
+		return CertCommonName, nil
+	case "subject":
+		return CertSubject, nil
+	default:
+		return 0, fmt.Errorf("unknown certificate identity %q", s)
+	}
+}
+
+func parsePublishOverflow(s string) (PublishOverflow, error) {
+	switch s {
+	case "throttle", "":
+		return OverflowThrottle, nil
+	case "drop_qos0":
+		return OverflowDropQoS0, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	default:
+		return 0, fmt.Errorf("unknown publish overflow %q", s)
+	}
+}
+
+func parseQueueOverflow(s string) (QueueOverflow, error) {
+	switch s {
+	case "drop_newest", "":
+		return QueueDropNewest, nil
+	case "drop_oldest":
+		return QueueDropOldest, nil
+	case "disconnect":
+		return QueueDisconnect, nil
+	case "spill":
+		return QueueSpill, nil
+	default:
+		return 0, fmt.Errorf("unknown queue overflow %q", s)
+	}
+}
+
+// NewServerFromConfig validates cfg and sets up a server from it, loading
+// any password and ACL files. nothing is listened on until ListenAndServe
+func NewServerFromConfig(cfg *ServerConfig) (*Server, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewServer()
+	s.config = cfg
+	s.bp = NewBufPool(cfg.BufPoolSize, cfg.BufSize)
+	s.fp = NewFHPool(cfg.FixedHeaderPoolSize)
+	s.maxPacketSize = cfg.MaxPacketSize
+	s.connDeadline = time.Duration(cfg.ConnectTimeout)
+	s.validatePfi = cfg.ValidatePayloadFormat
+	s.allowV31 = cfg.AllowMQTT31
+
+	level, _ := parseLogLevel(cfg.Log.Level)
+	format, _ := parseLogFormat(cfg.Log.Format)
+	s.SetLogLevel(level)
+	s.SetLogOutput(os.Stderr, format)
+
+	if cfg.Auth.PasswordFile != "" {
+		fa, err := NewFileAuthenticator(cfg.Auth.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		fa.AllowAnonymous = cfg.Auth.AllowAnonymous
+		s.SetAuthenticator(fa)
+	}
+	if cfg.Auth.ACLFile != "" {
+		acl, err := NewACL(cfg.Auth.ACLFile)
+		if err != nil {
+			return nil, err
+		}
+		s.SetAuthorizer(acl)
+	}
+
+	s.applyLimits(cfg)
+
+	qo, _ := parseQueueOverflow(cfg.Queue.Overflow)
+	s.SetQueuePolicy(QueuePolicy{
+		MaxMsgs:       cfg.Queue.MaxMsgs,
+		MaxBytes:      cfg.Queue.MaxBytes,
+		Overflow:      qo,
+		SpillDir:      cfg.Queue.SpillDir,
+		MaxSpillBytes: cfg.Queue.MaxSpillBytes,
+	})
+
+	up := cfg.UserProperties
+	if up.Node != "" {
+		s.AddUserPropRule(NodeProp(up.Node, up.NodeValue))
+	}
+	if up.IngressTime != "" {
+		s.AddUserPropRule(IngressTimeProp(up.IngressTime))
+	}
+	if up.Username != "" {
+		s.AddUserPropRule(UsernameProp(up.Username))
+	}
+
+	return &s, nil
+}
+
+func (s *Server) applyLimits(cfg *ServerConfig) {
+	l := cfg.Limits
+	s.SetConnLimits(ConnLimits{
+		PerIPRate:     l.ConnPerIPRate,
+		PerIPBurst:    l.ConnPerIPBurst,
+		GlobalRate:    l.ConnGlobalRate,
+		GlobalBurst:   l.ConnGlobalBurst,
+		MaxConns:      l.MaxConns,
+		MaxConnsPerIP: l.MaxConnsPerIP,
+	})
+	if l.PublishMsgRate > 0 || l.PublishByteRate > 0 {
+		po, _ := parsePublishOverflow(l.PublishOverflow)
+		s.SetPublishLimits(PublishLimits{
+			MsgRate:   l.PublishMsgRate,
+			MsgBurst:  l.PublishMsgBurst,
+			ByteRate:  l.PublishByteRate,
+			ByteBurst: l.PublishByteBurst,
+			Overflow:  po,
+		})
+	} else {
+		s.publishLimits.Store(nil)
+	}
+}
+
+// ListenAndServe opens every listener in the server's config, and the
+// metrics and admin servers if they're configured, then serves them all
+// like Serve does
+func (s *Server) ListenAndServe() error {
+	if s.config == nil {
+		return errors.New("server wasn't made with NewServerFromConfig")
+	}
+
+	listeners := make([]*Listener, 0, len(s.config.Listeners))
+	for _, lc := range s.config.Listeners {
+		l, err := lc.listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listener %s: %w", lc.name(), err)
+		}
+		s.logger.Info("listening", "listener", l.Name, "addr", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+
+	for _, h := range []struct {
+		addr    string
+		name    string
+		handler http.Handler
+	}{
+		{s.config.MetricsAddr, "metrics", s.metricsMux()},
+		{s.config.AdminAddr, "admin", s.AdminHandler()},
+	} {
+		if h.addr == "" {
+			continue
+		}
+		hs := &http.Server{Addr: h.addr, Handler: h.handler}
+		s.listenersLock.Lock()
+		s.httpServers = append(s.httpServers, hs)
+		s.listenersLock.Unlock()
+		go func() {
+			err := hs.ListenAndServe()
+			if err != http.ErrServerClosed {
+				s.logger.Error(h.name+" server stopped", "err", err)
+			}
+		}()
+	}
+
+	return s.Serve(listeners...)
+}
+
+func (lc *ListenerConfig) listen() (*Listener, error) {
+	policy := ListenerPolicy{
+		MaxConns:      lc.MaxConns,
+		RequireAuth:   lc.RequireAuth,
+		MaxPacketSize: lc.MaxPacketSize,
+		ProxyProtocol: lc.ProxyProtocol,
+	}
+
+	switch lc.Type {
+	case "tcp":
+		return ListenTCP(lc.name(), lc.Addr, policy)
+	case "unix":
+		return ListenUnix(lc.name(), lc.Addr, policy)
+	case "websocket":
+		path := lc.Path
+		if path == "" {
+			path = "/mqtt"
+		}
+		return ListenWebSocket(lc.name(), lc.Addr, path, policy)
+	case "tls":
+		username, _ := parseCertIdentity(lc.TLS.UsernameFromCert)
+		clientId, _ := parseCertIdentity(lc.TLS.ClientIdFromCert)
+		return ListenTLS(lc.name(), lc.Addr, TLSOptions{
+			CertFile:          lc.TLS.CertFile,
+			KeyFile:           lc.TLS.KeyFile,
+			ClientCAFile:      lc.TLS.ClientCAFile,
+			RequireClientCert: lc.TLS.RequireClientCert,
+			UsernameFromCert:  username,
+			ClientIdFromCert:  clientId,
+			PollInterval:      time.Duration(lc.TLS.PollInterval),
+		}, policy)
+	default:
+		return nil, fmt.Errorf("unknown type %q", lc.Type)
+	}
+}
+
+// ConfigOverrides are settings from the environment and flags, to go on top
+// of a config file. environment variables are the setting's name in upper
+// case with a prefix, like MQTT_LOG_LEVEL for log-level, and flags win over
+// the environment
+type ConfigOverrides struct {
+	env   []configOverride
+	flags []configOverride
+}
+
+type configOverride struct {
+	setting *configSetting
+	val     string
+}
+
+type configSetting struct {
+	name  string
+	usage string
+	set   func(cfg *ServerConfig, val string) error
+}
+
+var configSettings = []*configSetting{
+	{
+		"listen",
+		"address for a single tcp listener, replacing the configured ones",
+		func(cfg *ServerConfig, val string) error {
+			cfg.Listeners = []ListenerConfig{
+				{Name: "tcp", Type: "tcp", Addr: val},
+			}
+			return nil
+		},
+	},
+	{
+		"log-level",
+		"debug, info, warn or error",
+		func(cfg *ServerConfig, val string) error {
+			cfg.Log.Level = val
+			return nil
+		},
+	},
+	{
+		"log-format",
+		"text or json",
+		func(cfg *ServerConfig, val string) error {
+			cfg.Log.Format = val
+			return nil
+		},
+	},
+	{
+		"max-packet-size",
+		"largest packet clients can send, in bytes",
+		func(cfg *ServerConfig, val string) (err error) {
+			cfg.MaxPacketSize, err = strconv.Atoi(val)
+			return err
+		},
+	},
+	{
+		"connect-timeout",
+		"how long new connections have to send a CONNECT, like 10s",
+		func(cfg *ServerConfig, val string) error {
+			return cfg.ConnectTimeout.UnmarshalText([]byte(val))
+		},
+	},
+	{
+		"password-file",
+		"password file to authenticate clients against",
+		func(cfg *ServerConfig, val string) error {
+			cfg.Auth.PasswordFile = val
+			return nil
+		},
+	},
+	{
+		"allow-anonymous",
+		"let clients without a username connect",
+		func(cfg *ServerConfig, val string) (err error) {
+			cfg.Auth.AllowAnonymous, err = strconv.ParseBool(val)
+			return err
+		},
+	},
+	{
+		"acl-file",
+		"ACL rule file to authorize topics against",
+		func(cfg *ServerConfig, val string) error {
+			cfg.Auth.ACLFile = val
+			return nil
+		},
+	},
+	{
+		"metrics-addr",
+		"address to serve metrics on",
+		func(cfg *ServerConfig, val string) error {
+			cfg.MetricsAddr = val
+			return nil
+		},
+	},
+	{
+		"admin-addr",
+		"address to serve the admin API on",
+		func(cfg *ServerConfig, val string) error {
+			cfg.AdminAddr = val
+			return nil
+		},
+	},
+}
+
+// RegisterFlags adds a flag for each setting to fs
+func (co *ConfigOverrides) RegisterFlags(fs *flag.FlagSet) {
+	for _, setting := range configSettings {
+		fs.Func(setting.name, setting.usage, func(val string) error {
+			co.flags = append(co.flags, configOverride{setting, val})
+			return nil
+		})
+	}
+}
+
+// LoadEnv picks up the settings set in the environment, like
+// prefix+"LOG_LEVEL"
+func (co *ConfigOverrides) LoadEnv(prefix string) {
+	co.env = co.env[:0]
+	for _, setting := range configSettings {
+		key := prefix + strings.ToUpper(strings.ReplaceAll(setting.name, "-", "_"))
+		if val, ok := os.LookupEnv(key); ok {
+			co.env = append(co.env, configOverride{setting, val})
+		}
+	}
+}
+
+func (co *ConfigOverrides) Apply(cfg *ServerConfig) error {
+	var errs []error
+	for _, o := range slices.Concat(co.env, co.flags) {
+		err := o.setting.set(cfg, o.val)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.setting.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,364 @@
+package mqtt
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := DefaultConfig()
+	want.Listeners = []ListenerConfig{
+		{Type: "tcp", Addr: ":1883", MaxConns: 100},
+		{
+			Name:        "secure",
+			Type:        "tls",
+			Addr:        ":8883",
+			RequireAuth: true,
+			TLS: TLSConfig{
+				CertFile:         "cert.pem",
+				KeyFile:          "key.pem",
+				UsernameFromCert: "common_name",
+				PollInterval:     Duration(30 * time.Second),
+			},
+		},
+	}
+	want.MaxPacketSize = 65536
+	want.ConnectTimeout = Duration(10 * time.Second)
+	want.Log.Level = "debug"
+	want.Auth.ACLFile = "acl"
+	want.Limits.PublishMsgRate = 2.5
+	want.Queue.Overflow = "spill"
+	want.Queue.MaxSpillBytes = 1 << 20
+
+	for _, tc := range []struct {
+		name     string
+		contents string
+	}{
+		{"config.yaml", `
+listeners:
+  - type: tcp
+    addr: ":1883"
+    max_conns: 100
+  - name: secure
+    type: tls
+    addr: ":8883"
+    require_auth: true
+    tls:
+      cert_file: cert.pem
+      key_file: key.pem
+      username_from_cert: common_name
+      poll_interval: 30s
+max_packet_size: 65536
+connect_timeout: 10s
+log:
+  level: debug
+auth:
+  acl_file: acl
+limits:
+  publish_msg_rate: 2.5
+queue:
+  overflow: spill
+  max_spill_bytes: 1048576
+`},
+		{"config.toml", `
+max_packet_size = 65536
+connect_timeout = "10s"
+
+[[listeners]]
+type = "tcp"
+addr = ":1883"
+max_conns = 100
+
+[[listeners]]
+name = "secure"
+type = "tls"
+addr = ":8883"
+require_auth = true
+[listeners.tls]
+cert_file = "cert.pem"
+key_file = "key.pem"
+username_from_cert = "common_name"
+poll_interval = "30s"
+
+[log]
+level = "debug"
+
+[auth]
+acl_file = "acl"
+
+[limits]
+publish_msg_rate = 2.5
+
+[queue]
+overflow = "spill"
+max_spill_bytes = 1048576
+`},
+		{"config.json", `{
+	"listeners": [
+		{"type": "tcp", "addr": ":1883", "max_conns": 100},
+		{
+			"name": "secure",
+			"type": "tls",
+			"addr": ":8883",
+			"require_auth": true,
+			"tls": {
+				"cert_file": "cert.pem",
+				"key_file": "key.pem",
+				"username_from_cert": "common_name",
+				"poll_interval": "30s"
+			}
+		}
+	],
+	"max_packet_size": 65536,
+	"connect_timeout": "10s",
+	"log": {"level": "debug"},
+	"auth": {"acl_file": "acl"},
+	"limits": {"publish_msg_rate": 2.5},
+	"queue": {"overflow": "spill", "max_spill_bytes": 1048576}
+}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfigFile(t, tc.name, tc.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("cfg = %+v, want %+v", cfg, want)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate = %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaultListeners(t *testing.T) {
+	cfg, err := LoadConfig(writeConfigFile(t, "config.yml", "log:\n  level: warn\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Log.Level = "warn"
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("cfg = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		contents string
+		want     string
+	}{
+		{"unknown format", "config.ini", "", "unknown config file format"},
+		{"unknown key", "config.json", `{"max_packets": 1}`, "unknown field"},
+		{
+			"unknown nested key", "config.yaml",
+			"log:\n  colour: true\n", "unknown field",
+		},
+		{"wrong type", "config.toml", `max_packet_size = "big"`, "max_packet_size"},
+		{"bad duration", "config.json", `{"connect_timeout": "soon"}`, "soon"},
+		{"bad yaml", "config.yaml", "listeners: [\n", "config.yaml"},
+		{"bad toml", "config.toml", "[log\n", "config.toml"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfigFile(t, tc.file, tc.contents))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("missing file err = %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(cfg *ServerConfig)
+		want []string
+	}{
+		{"default", func(cfg *ServerConfig) {}, nil},
+		{
+			"no listeners",
+			func(cfg *ServerConfig) { cfg.Listeners = nil },
+			[]string{"no listeners"},
+		},
+		{
+			"duplicate names",
+			func(cfg *ServerConfig) {
+				cfg.Listeners = append(cfg.Listeners,
+					ListenerConfig{Type: "tcp", Addr: ":1884"},
+				)
+			},
+			[]string{`duplicate name "tcp"`},
+		},
+		{
+			"bad listener",
+			func(cfg *ServerConfig) {
+				cfg.Listeners = []ListenerConfig{{
+					Name:          "l",
+					Type:          "websocket",
+					Path:          "mqtt",
+					MaxConns:      -1,
+					MaxPacketSize: 10,
+				}}
+			},
+			[]string{
+				"listener l: no addr",
+				"path has to start with /",
+				"max_conns can't be negative",
+				"listener l: max_packet_size out of range",
+			},
+		},
+		{
+			"unknown listener type",
+			func(cfg *ServerConfig) { cfg.Listeners[0].Type = "quic" },
+			[]string{`unknown type "quic"`},
+		},
+		{
+			"tls",
+			func(cfg *ServerConfig) {
+				cfg.Listeners[0].Type = "tls"
+				cfg.Listeners[0].TLS = TLSConfig{
+					RequireClientCert: true,
+					ClientIdFromCert:  "serial",
+				}
+			},
+			[]string{
+				"tls needs cert_file and key_file",
+				"require_client_cert needs client_ca_file",
+				`unknown certificate identity "serial"`,
+			},
+		},
+		{
+			"server",
+			func(cfg *ServerConfig) {
+				cfg.MaxPacketSize = 268435461
+				cfg.ConnectTimeout = -1
+				cfg.BufPoolSize = -1
+				cfg.BufSize = 0
+			},
+			[]string{
+				"max_packet_size out of range",
+				"connect_timeout can't be negative",
+				"pool sizes can't be negative",
+				"buf_size has to be positive",
+			},
+		},
+		{
+			"log",
+			func(cfg *ServerConfig) { cfg.Log = LogConfig{"loud", "xml"} },
+			[]string{`unknown level "loud"`, `unknown format "xml"`},
+		},
+		{
+			"limits",
+			func(cfg *ServerConfig) {
+				cfg.Limits.MaxConnsPerIP = -1
+				cfg.Limits.PublishOverflow = "block"
+			},
+			[]string{
+				"limits can't be negative",
+				`unknown publish overflow "block"`,
+			},
+		},
+		{
+			"queue",
+			func(cfg *ServerConfig) {
+				cfg.Queue.MaxSpillBytes = -1
+				cfg.Queue.Overflow = "spil"
+			},
+			[]string{
+				"queue limits can't be negative",
+				`unknown queue overflow "spil"`,
+			},
+		},
+		{
+			"user properties",
+			func(cfg *ServerConfig) { cfg.UserProperties.Node = "node" },
+			[]string{"node and node_value go together"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.edit(cfg)
+			err := cfg.Validate()
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("Validate = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate = nil, want %q", tc.want)
+			}
+			// every problem is reported, not just the first
+			for _, w := range tc.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Fatalf("Validate = %v, want it to mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	t.Setenv("TEST_MQTT_LOG_LEVEL", "debug")
+	t.Setenv("TEST_MQTT_LOG_FORMAT", "json")
+	t.Setenv("TEST_MQTT_ALLOW_ANONYMOUS", "true")
+
+	var co ConfigOverrides
+	co.LoadEnv("TEST_MQTT_")
+	fs := flag.NewFlagSet("broker", flag.ContinueOnError)
+	co.RegisterFlags(fs)
+	err := fs.Parse([]string{
+		"-log-level", "warn",
+		"-listen", ":1884",
+		"-connect-timeout", "5s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	if err := co.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Listeners[0].Addr = ":1884"
+	want.Log = LogConfig{Level: "warn", Format: "json"}
+	want.Auth.AllowAnonymous = true
+	want.ConnectTimeout = Duration(5 * time.Second)
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("cfg = %+v, want %+v", cfg, want)
+	}
+
+	t.Setenv("TEST_MQTT_MAX_PACKET_SIZE", "lots")
+	t.Setenv("TEST_MQTT_ALLOW_ANONYMOUS", "sometimes")
+	co.LoadEnv("TEST_MQTT_")
+	err = co.Apply(DefaultConfig())
+	if err == nil ||
+		!strings.Contains(err.Error(), "max-packet-size") ||
+		!strings.Contains(err.Error(), "allow-anonymous") {
+		t.Fatalf("Apply = %v, want both bad settings", err)
+	}
+}
@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// ConnLimits is the server wide admission control for new connections,
+// so a reconnect storm after an outage gets turned away with a CONNACK
+// instead of taking the broker down. zero values mean no limit
+type ConnLimits struct {
+	// new connections per second from a single IP, and how many can come in
+	// a burst. clients over the limit get CRE
+	PerIPRate  float64
+	PerIPBurst int
+	// new connections per second across all listeners, clients over the
+	// limit get CRE
+	GlobalRate  float64
+	GlobalBurst int
+
+	// connections open at once across all listeners, clients over the limit
+	// get SB
+	MaxConns int
+	// connections open at once from a single IP, clients over the limit get
+	// QE
+	MaxConnsPerIP int
+}
+
+var ConnRejected = errors.New("connection rejected by admission control")
+
+// SetConnLimits replaces the server's connection limits, unlike most setters
+// this is safe to call while the server is running. rate limits start over
+// with full buckets
+func (s *Server) SetConnLimits(limits ConnLimits) {
+	s.connLimiter.set(limits)
+}
+
+// connLimiter keeps the token buckets and open connection counts for
+// ConnLimits. IPs without any open connections get forgotten once their
+// bucket has filled back up
+type connLimiter struct {
+	lock      sync.Mutex
+	limits    ConnLimits
+	global    tokenBucket
+	ips       map[string]*ipLimits
+	conns     int
+	lastSweep time.Time
+}
+
+type ipLimits struct {
+	bucket tokenBucket
+	conns  int
+}
+
+const connLimiterSweep = time.Minute
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{ips: make(map[string]*ipLimits, 64)}
+}
+
+func (cl *connLimiter) set(limits ConnLimits) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.limits = limits
+	cl.global = newTokenBucket(limits.GlobalRate, limits.GlobalBurst)
+	for _, il := range cl.ips {
+		il.bucket = newTokenBucket(limits.PerIPRate, limits.PerIPBurst)
+	}
+}
+
+// allow takes a token for a new connection from addr, this happens as soon
+// as the CONNECT is read so clients that go on to fail authentication still
+// count towards the rate
+func (cl *connLimiter) allow(addr net.Addr) packets.ReasonCode {
+	ip := addrIP(addr)
+	now := time.Now()
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.sweep(now)
+
+	// check the IP first, so one noisy client doesn't use up the global
+	// tokens on connections that are getting rejected anyway
+	if ip != "" && cl.limits.PerIPRate > 0 {
+		if !cl.ip(ip).bucket.take(now) {
+			return packets.CRE
+		}
+	}
+	if cl.limits.GlobalRate > 0 && !cl.global.take(now) {
+		return packets.CRE
+	}
+	return packets.S
+}
+
+// acquire counts a connection against the concurrent limits, right before it
+// gets accepted. every successful acquire has to be paired with a release
+func (cl *connLimiter) acquire(addr net.Addr) packets.ReasonCode {
+	ip := addrIP(addr)
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if cl.limits.MaxConns > 0 && cl.conns >= cl.limits.MaxConns {
+		return packets.SB
+	}
+	if ip != "" {
+		il := cl.ip(ip)
+		if cl.limits.MaxConnsPerIP > 0 && il.conns >= cl.limits.MaxConnsPerIP {
+			return packets.QE
+		}
+		il.conns += 1
+	}
+	cl.conns += 1
+	return packets.S
+}
+
+func (cl *connLimiter) release(addr net.Addr) {
+	ip := addrIP(addr)
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.conns -= 1
+	if il, ok := cl.ips[ip]; ok && ip != "" {
+		il.conns -= 1
+	}
+}
+
+func (cl *connLimiter) ip(ip string) *ipLimits {
+	il, ok := cl.ips[ip]
+	if !ok {
+		il = &ipLimits{
+			bucket: newTokenBucket(cl.limits.PerIPRate, cl.limits.PerIPBurst),
+		}
+		cl.ips[ip] = il
+	}
+	return il
+}
+
+// sweep drops the IPs that are back to where a new one would start
+func (cl *connLimiter) sweep(now time.Time) {
+	if now.Sub(cl.lastSweep) < connLimiterSweep {
+		return
+	}
+	cl.lastSweep = now
+	for ip, il := range cl.ips {
+		if il.conns == 0 && il.bucket.full(now) {
+			delete(cl.ips, ip)
+		}
+	}
+}
+
+// addrIP is the IP part of addr, or "" for addresses that don't have one,
+// like unix sockets and pipes, which are left out of the per IP limits
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	default:
+		return ""
+	}
+}
+
+// tokenBucket refills at rate tokens per second, up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	// a bucket that can't hold a whole token would never let anything in
+	b := max(float64(burst), 1)
+	return tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		tb.tokens = min(tb.tokens, tb.burst)
+	}
+	tb.last = now
+}
+
+func (tb *tokenBucket) take(now time.Time) bool {
+	return tb.takeN(now, 1)
+}
+
+func (tb *tokenBucket) takeN(now time.Time, n float64) bool {
+	tb.refill(now)
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// until is how long it'll be before there are n tokens in the bucket
+func (tb *tokenBucket) until(now time.Time, n float64) time.Duration {
+	tb.refill(now)
+	if tb.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
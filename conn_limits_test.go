@@ -0,0 +1,169 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	// 10 a second, bursts of 3
+	tb := newTokenBucket(10, 3)
+	for _, tc := range []struct {
+		name string
+		ms   int
+		want bool
+	}{
+		{"burst 1", 0, true},
+		{"burst 2", 0, true},
+		{"burst 3", 0, true},
+		{"empty", 0, false},
+		{"partly refilled", 50, false},
+		{"refilled one", 100, true},
+		{"empty again", 100, false},
+		// a long wait only fills it back up to the burst
+		{"after idle 1", 10_000, true},
+		{"after idle 2", 10_000, true},
+		{"after idle 3", 10_000, true},
+		{"after idle 4", 10_000, false},
+	} {
+		if got := tb.take(at(tc.ms)); got != tc.want {
+			t.Fatalf("%s: take = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if d := tb.until(at(10_000), 1); d != 100*time.Millisecond {
+		t.Fatalf("until = %v, want %v", d, 100*time.Millisecond)
+	}
+	if d := tb.until(at(10_000), 2.5); d != 250*time.Millisecond {
+		t.Fatalf("until = %v, want %v", d, 250*time.Millisecond)
+	}
+	if tb.full(at(10_200)) {
+		t.Fatalf("full before the burst refilled")
+	}
+	if !tb.full(at(10_300)) {
+		t.Fatalf("not full after the burst refilled")
+	}
+
+	// a zero burst still holds a whole token
+	tb = newTokenBucket(1, 0)
+	if !tb.take(start) || tb.take(start) {
+		t.Fatalf("zero burst doesn't hold exactly one token")
+	}
+}
+
+func tcpAddr(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestConnLimiterAllow(t *testing.T) {
+	unixAddr := &net.UnixAddr{Name: "mqtt.sock", Net: "unix"}
+	for _, tc := range []struct {
+		name   string
+		limits ConnLimits
+		addrs  []net.Addr
+		want   []packets.ReasonCode
+	}{
+		{
+			name:   "no limits",
+			limits: ConnLimits{},
+			addrs: []net.Addr{
+				tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.1", 2),
+				tcpAddr("10.0.0.1", 3),
+			},
+			want: []packets.ReasonCode{packets.S, packets.S, packets.S},
+		},
+		{
+			name:   "per ip",
+			limits: ConnLimits{PerIPRate: 1, PerIPBurst: 2},
+			addrs: []net.Addr{
+				tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.1", 2),
+				tcpAddr("10.0.0.1", 3), tcpAddr("10.0.0.2", 1),
+			},
+			want: []packets.ReasonCode{
+				packets.S, packets.S, packets.CRE, packets.S,
+			},
+		},
+		{
+			name:   "global",
+			limits: ConnLimits{GlobalRate: 1, GlobalBurst: 2},
+			addrs: []net.Addr{
+				tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.2", 1),
+				tcpAddr("10.0.0.3", 1),
+			},
+			want: []packets.ReasonCode{packets.S, packets.S, packets.CRE},
+		},
+		{
+			// rejected by their own IP's limit before touching the global
+			// bucket, so the other IP still gets in
+			name: "per ip before global",
+			limits: ConnLimits{
+				PerIPRate: 1, PerIPBurst: 1,
+				GlobalRate: 1, GlobalBurst: 2,
+			},
+			addrs: []net.Addr{
+				tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.1", 2),
+				tcpAddr("10.0.0.1", 3), tcpAddr("10.0.0.2", 1),
+			},
+			want: []packets.ReasonCode{
+				packets.S, packets.CRE, packets.CRE, packets.S,
+			},
+		},
+		{
+			name:   "unix sockets skip per ip",
+			limits: ConnLimits{PerIPRate: 1, PerIPBurst: 1},
+			addrs:  []net.Addr{unixAddr, unixAddr},
+			want:   []packets.ReasonCode{packets.S, packets.S},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := newConnLimiter()
+			cl.set(tc.limits)
+			for i, addr := range tc.addrs {
+				if rc := cl.allow(addr); rc != tc.want[i] {
+					t.Fatalf("allow %d = %v, want %v", i, rc, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConnLimiterAcquire(t *testing.T) {
+	cl := newConnLimiter()
+	cl.set(ConnLimits{MaxConns: 3, MaxConnsPerIP: 2})
+
+	a1, a2 := tcpAddr("10.0.0.1", 1), tcpAddr("10.0.0.1", 2)
+	b1, b2 := tcpAddr("10.0.0.2", 1), tcpAddr("10.0.0.2", 2)
+	for _, tc := range []struct {
+		name    string
+		addr    net.Addr
+		release bool
+		want    packets.ReasonCode
+	}{
+		{"first", a1, false, packets.S},
+		{"second", a2, false, packets.S},
+		{"over per ip", a2, false, packets.QE},
+		{"other ip", b1, false, packets.S},
+		{"over max", b2, false, packets.SB},
+		{"release", a1, true, packets.S},
+		{"per ip freed", a1, false, packets.S},
+		{"max again", b2, false, packets.SB},
+		{"release other ip", b1, true, packets.S},
+		{"max freed", b2, false, packets.S},
+	} {
+		if tc.release {
+			cl.release(tc.addr)
+			continue
+		}
+		if rc := cl.acquire(tc.addr); rc != tc.want {
+			t.Fatalf("%s: acquire = %v, want %v", tc.name, rc, tc.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// the in process api lets a program that embeds the server publish and
+// subscribe without going over the network. in process subscriptions live
+// in the same TopicTrie as everyone else's, under ids that network clients
+// can't use, so messages flow both ways between them and connected clients.
+// the server doesn't keep retained messages for anyone yet, so there's no
+// retain option on Publish, and Subscribe doesn't get any retained messages
+// when it starts
+
+// PublishOptions are everything about a message published with
+// Server.Publish other than its topic and payload
+type PublishOptions struct {
+	// who the message is published as, the Authorizer is asked whether they
+	// can publish to the topic just like it would be for a client
+	ClientId string
+	Username string
+
+	// can be nil. only the properties that go on a PUBLISH are used, and
+	// they're copied, so Props isn't changed and can be reused
+	Props *packets.Properties
+
+	// TODO: qos and retain, once messages are delivered at their QoS and
+	// there's a retained store
+}
+
+// SubscribeOptions are everything about an in process subscription other
+// than its filter and handler
+type SubscribeOptions struct {
+	// who the subscription is for, the Authorizer is asked whether they can
+	// read the filter, and every topic delivered to it, just like it would
+	// be for a client
+	ClientId string
+	Username string
+}
+
+// a MessageHandler gets the messages for an in process subscription
+type MessageHandler func(msg *Message)
+
+type internalSub struct {
+	filter   string
+	clientId string
+	username string
+	handler  MessageHandler
+}
+
+var (
+	InvalidFilter   = errors.New("invalid topic filter")
+	InvalidClientId = errors.New("invalid client id")
+)
+
+// internalIdPrefix starts every in process subscription's id, network
+// clients can't have a null character in their ids
+const internalIdPrefix = "\x00internal/"
+
+// Publish sends a message to everyone subscribed to topic, network clients
+// and in process subscribers alike, returning how many it went to. it goes
+// through the Authorizer and the OnPublish hooks before it's matched against
+// subscriptions, the hooks get a Client that only has the id and username
+// from opts. this is safe to call from anywhere, including a MessageHandler
+func (s *Server) Publish(
+	topic string,
+	payload []byte,
+	opts PublishOptions,
+) (int, error) {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return 0, InvalidTopic
+	}
+	if s.authorizer != nil &&
+		!s.authorizer.Authorize(opts.ClientId, opts.Username, topic, AccessWrite) {
+		return 0, NotAuthorized
+	}
+
+	// only what can go on a PUBLISH is kept, and opts.Props is left alone
+	props := publishProps(opts.Props)
+	if len(s.hooks) > 0 {
+		msg := &Message{Topic: topic, Payload: payload, Props: props}
+		err := s.hookPublish(
+			s.inProcessClient("in-process", opts.ClientId, opts.Username),
+			msg,
+		)
+		if err != nil {
+			return 0, err
+		}
+		topic, payload, props = msg.Topic, msg.Payload, publishProps(msg.Props)
+	}
+
+	return s.publish(topic, payload, props)
+}
+
+// publishProps is a copy of the properties in props that can be forwarded
+// on a PUBLISH, props can be nil
+func publishProps(props *packets.Properties) *packets.Properties {
+	out := &packets.Properties{}
+	out.Zero()
+	if props != nil {
+		out.CopyPublish(props)
+	}
+	return out
+}
+
+// Subscribe calls handler with every message published to a topic that
+// matches filter, from network clients or Publish. handlers are called on
+// the publisher's goroutine, one after another, so they should be quick.
+// msg is shared between them, so it mustn't be changed, and it's only valid
+// until the handler returns. the subscription goes through the Authorizer,
+// but not the OnSubscribe hooks. call unsubscribe to stop getting messages
+func (s *Server) Subscribe(
+	filter string,
+	opts SubscribeOptions,
+	handler MessageHandler,
+) (unsubscribe func(), err error) {
+	levels := strings.Split(filter, "/")
+	if filter == "" || !validFilter(levels) {
+		return nil, InvalidFilter
+	}
+	if s.authorizer != nil &&
+		!s.authorizer.Authorize(opts.ClientId, opts.Username, filter, AccessRead) {
+		return nil, NotAuthorized
+	}
+
+	id := fmt.Sprintf("%s%d", internalIdPrefix, s.internalSeq.Add(1))
+	s.clientsLock.Lock()
+	s.internalSubs[id] = &internalSub{
+		filter:   filter,
+		clientId: opts.ClientId,
+		username: opts.Username,
+		handler:  handler,
+	}
+	s.clientsLock.Unlock()
+	s.topicTrie.AddSubscription(levels, id)
+
+	return func() {
+		s.clientsLock.Lock()
+		delete(s.internalSubs, id)
+		s.clientsLock.Unlock()
+		s.topicTrie.RemoveSubs(id)
+	}, nil
+}
+
+// internalAuthorized is whether an in process subscriber can read out's
+// topic, like Client.authorized
+func (s *Server) internalAuthorized(is *internalSub, out *outPublish) bool {
+	if s.authorizer == nil {
+		return true
+	}
+	return s.authorizer.Authorize(
+		is.clientId,
+		is.username,
+		out.topicString(),
+		AccessRead,
+	)
+}
+
+// inProcessClient stands in for whoever is behind an in process call, or an
+// admin API one, so hooks always get a Client. it isn't connected, and isn't
+// one of the server's clients
+func (s *Server) inProcessClient(
+	listener string,
+	id string,
+	username string,
+) *Client {
+	return &Client{
+		server:   s,
+		listener: &Listener{Name: listener},
+		id:       id,
+		username: username,
+		log:      s.logger,
+	}
+}
+
+// deliverInternal hands a PUBLISH to in process subscribers, as it would be
+// sent to a client
+func (s *Server) deliverInternal(subs []*internalSub, out *outPublish) {
+	msg := Message{
+		Topic:   out.topicString(),
+		Payload: out.payload,
+		QoS:     (out.flags >> 1) & 0b11,
+		Props:   out.properties(),
+	}
+	for _, sub := range subs {
+		sub.handler(&msg)
+	}
+}
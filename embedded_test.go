@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+func aclServer(t *testing.T, rules string) *Server {
+	t.Helper()
+	acl, err := NewACL(writeACLFile(t, rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	s.SetAuthorizer(acl)
+	return &s
+}
+
+func TestInProcessSubscribeAuthorized(t *testing.T) {
+	s := aclServer(t, ""+
+		"write     *     #\n"+
+		"deny      alice sensors/secret/#\n"+
+		"read      alice sensors/#\n",
+	)
+
+	_, err := s.Subscribe("sensors/#", SubscribeOptions{Username: "bob"},
+		func(*Message) { t.Fatalf("bob got a message") },
+	)
+	if !errors.Is(err, NotAuthorized) {
+		t.Fatalf("bob subscribed: %v", err)
+	}
+
+	var got []string
+	_, err = s.Subscribe("sensors/#", SubscribeOptions{Username: "alice"},
+		func(msg *Message) { got = append(got, msg.Topic) },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every topic is checked on delivery too, not just the filter
+	for _, topic := range []string{"sensors/a/temp", "sensors/secret/temp", "sensors/b"} {
+		_, err := s.Publish(topic, nil, PublishOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != "sensors/a/temp" || got[1] != "sensors/b" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// publishHook records who OnPublish said messages were from
+type publishHook struct {
+	HookBase
+	from []string
+}
+
+func (h *publishHook) OnPublish(c *Client, msg *Message) error {
+	h.from = append(h.from, c.Id()+"/"+c.Username()+"/"+c.Info().Listener)
+	return nil
+}
+
+func TestInProcessPublishHookClient(t *testing.T) {
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	h := &publishHook{}
+	s.AddHook(h)
+
+	_, err := s.Publish("a", nil, PublishOptions{ClientId: "svc", Username: "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.from) != 1 || h.from[0] != "svc/u/in-process" {
+		t.Fatalf("hook got %v", h.from)
+	}
+}
+
+func TestInProcessSubscriptionsHidden(t *testing.T) {
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	unsubscribe, err := s.Subscribe("a/#", SubscribeOptions{}, func(*Message) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	if subs := s.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("in process subscriptions listed: %v", subs)
+	}
+	if s.DeleteSession(internalIdPrefix + "1") {
+		t.Fatalf("deleted an in process subscription")
+	}
+	if n, _ := s.Publish("a/b", nil, PublishOptions{}); n != 1 {
+		t.Fatalf("published to %d", n)
+	}
+}
+
+func TestInProcessPublishProps(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	conn := testConnect(t, pl, "sub")
+	testSubscribe(t, conn, "a")
+
+	// everything that isn't for a PUBLISH gets left out
+	props := &packets.Properties{}
+	props.Zero()
+	props.Ct.WriteString("text/plain")
+	props.AddUserProp("k", "v")
+	props.Si = 5
+	props.Ta = 1
+	props.Sei = 60
+	props.Wsa = 0
+	props.Mq = 1
+	props.Rs.WriteString("reason")
+	_, err := s.Publish("a", []byte("hi"), PublishOptions{Props: props})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, body := testRead(t, conn)
+	pub := packets.Publish{}
+	pub.Zero()
+	got := packets.Properties{}
+	got.Zero()
+	err = packets.DecodePublish(&fh, &pub, &got, body)
+	if fh.Pt != packets.PUBLISH || err != nil {
+		t.Fatalf("got packet type %d: %v", fh.Pt, err)
+	}
+	if got.Ct.String() != "text/plain" || len(got.Up) != 1 ||
+		got.Si != 0 || got.Ta != 0 {
+		t.Fatalf("props = %+v", got)
+	}
+
+	// and the caller's Properties aren't touched
+	if len(props.Up) != 1 || props.Si != 5 || props.Sei != 60 {
+		t.Fatalf("opts.Props changed: %+v", props)
+	}
+}
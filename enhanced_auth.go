@@ -0,0 +1,238 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// an AuthMechanism is one enhanced authentication method, it's picked by the
+// authentication method property the client sends in its CONNECT
+type AuthMechanism interface {
+	// Method is the authentication method name, like "SCRAM-SHA-256"
+	Method() string
+	// Start sets up the state for a new exchange, it's called once for the
+	// initial authentication and again for every re-authentication
+	Start() AuthExchange
+}
+
+// an AuthExchange is the server side of a single, possibly multi step,
+// authentication exchange
+type AuthExchange interface {
+	// Step is called with the authentication data from each CONNECT or AUTH
+	// the client sends. resp is sent back to the client as authentication
+	// data, in an AUTH with CA if done is false, or in the CONNACK or final
+	// AUTH if done is true. a non nil err fails the authentication
+	Step(data []byte) (resp []byte, done bool, err error)
+	// Username is the identity the exchange authenticated,
+	// it's only called once the exchange is done
+	Username() string
+}
+
+var (
+	BadAuthMethod = errors.New("unsupported authentication method")
+	AuthFailed    = errors.New("authentication failed")
+	AuthOutOfSeq  = errors.New("auth packet out of sequence")
+)
+
+// AddAuthMechanism makes an enhanced authentication method available to
+// clients, a mechanism added with the same method as an existing one
+// replaces it. this is not safe to call once the server has started
+func (s *Server) AddAuthMechanism(mech AuthMechanism) {
+	if s.authMechs == nil {
+		s.authMechs = make(map[string]AuthMechanism, 2)
+	}
+	s.authMechs[mech.Method()] = mech
+}
+
+// connectAuth runs the CONNECT -> AUTH -> CONNACK exchange, reading straight
+// from the conn since the client isn't running yet. data is the
+// authentication data from the CONNECT. the returned reason code is the one
+// to send in the CONNACK if err is non nil
+func (c *Client) connectAuth(data []byte) (packets.ReasonCode, []byte, error) {
+	mech, ok := c.server.authMechs[c.authMethod]
+	if !ok {
+		return packets.BAM, nil, BadAuthMethod
+	}
+	ex := mech.Start()
+
+	resp, done, err := ex.Step(data)
+	for err == nil && !done {
+		// challenge the client and wait for its answer
+		b := c.encodeAuth(packets.CA, resp)
+		_, werr := c.conn.Write(b)
+		if werr == nil {
+			c.server.metrics.packetOut(b)
+		}
+		c.server.bp.ReturnBuf(b)
+		if werr != nil {
+			return packets.UE, nil, werr
+		}
+
+		p, rerr := c.server.readPacket(c.conn, c.maxPacketSize)
+		if rerr != nil {
+			return packets.UE, nil, rerr
+		}
+		props := packets.Properties{}
+		props.Zero()
+		rc, derr := c.decodeAuth(p, &props)
+		c.server.bp.ReturnBuf(p.buf)
+		c.server.fp.ReturnFH(*p.fh)
+		if derr != nil {
+			return packets.PE, nil, derr
+		}
+		if rc != packets.CA {
+			return packets.PE, nil, AuthOutOfSeq
+		}
+
+		resp, done, err = ex.Step(props.Ad)
+	}
+	if err != nil {
+		return packets.NA, nil, err
+	}
+
+	if u := ex.Username(); u != "" {
+		c.username = u
+	}
+	return packets.S, resp, nil
+}
+
+// handleAuth handles AUTH packets once the client is running, which is
+// re-authentication. returns false if the client should be shut down
+func (c *Client) handleAuth(p Packet) bool {
+	defer c.server.bp.ReturnBuf(p.buf)
+
+	props := packets.Properties{}
+	props.Zero()
+	rc, err := c.decodeAuth(p, &props)
+	if err != nil {
+		c.log.Warn("bad auth packet", "err", err)
+		c.sendDisconnect(packets.PE)
+		return false
+	}
+
+	switch {
+	case rc == packets.RA && c.authEx == nil:
+		c.authEx = c.server.authMechs[c.authMethod].Start()
+	case rc == packets.CA && c.authEx != nil:
+	default:
+		c.log.Warn(AuthOutOfSeq.Error())
+		c.sendDisconnect(packets.PE)
+		return false
+	}
+
+	resp, done, err := c.authEx.Step(props.Ad)
+	if err != nil {
+		c.log.Info("re-authentication failed", "err", err)
+		c.sendDisconnect(packets.NA)
+		return false
+	}
+	if !done {
+		c.queue.push(c.encodeAuth(packets.CA, resp))
+		return true
+	}
+
+	// the username is read without a lock by everything else the client is
+	// doing, and the identity shouldn't change over a connection anyway
+	if u := c.authEx.Username(); u != "" && u != c.username {
+		c.log.Info("re-authenticated as a different user", "username", u)
+		c.sendDisconnect(packets.NA)
+		return false
+	}
+	c.authEx = nil
+	c.queue.push(c.encodeAuth(packets.S, resp))
+	return true
+}
+
+// decodeAuth decodes an AUTH packet and checks that it's for the same
+// authentication method the client connected with
+func (c *Client) decodeAuth(
+	p Packet,
+	props *packets.Properties,
+) (packets.ReasonCode, error) {
+	if p.fh.Pt != packets.AUTH || c.authMethod == "" {
+		return 0, AuthOutOfSeq
+	}
+
+	auth := packets.Auth{}
+	auth.Zero()
+	err := packets.DecodeAuth(
+		&auth,
+		props,
+		p.buf[len(p.buf)-int(p.fh.RemLen):],
+	)
+	if err != nil {
+		return 0, err
+	}
+	if props.Am.String() != c.authMethod {
+		return 0, BadAuthMethod
+	}
+
+	return auth.ReasonCode, nil
+}
+
+// encodeAuth encodes an AUTH packet into a buf from the pool
+func (c *Client) encodeAuth(rc packets.ReasonCode, data []byte) []byte {
+	auth := packets.Auth{ReasonCode: rc}
+	props := packets.Properties{}
+	props.Zero()
+	props.Am.WriteString(c.authMethod)
+	props.Ad = append(props.Ad, data...)
+
+	buf := c.server.bp.GetBuf()
+	scratch := c.server.bp.GetBuf()
+	n := packets.EncodeAuth(&auth, &props, buf, scratch)
+	c.server.bp.ReturnBuf(scratch)
+
+	return buf[:n]
+}
+
+// ChallengeAuth is a simple challenge/response mechanism, mostly for testing
+// enhanced authentication without any outside infrastructure.
+// the client sends its username as the authentication data in the CONNECT,
+// the server answers with a random challenge, and the client responds with
+// HMAC-SHA256(secret, challenge)
+type ChallengeAuth struct {
+	Lookup func(username string) (secret []byte, ok bool)
+}
+
+const ChallengeAuthMethod = "CHALLENGE-HMAC-SHA256"
+
+func (ca *ChallengeAuth) Method() string { return ChallengeAuthMethod }
+
+func (ca *ChallengeAuth) Start() AuthExchange {
+	return &challengeExchange{lookup: ca.Lookup}
+}
+
+type challengeExchange struct {
+	lookup    func(username string) ([]byte, bool)
+	username  string
+	secret    []byte
+	challenge []byte
+}
+
+func (ce *challengeExchange) Step(data []byte) ([]byte, bool, error) {
+	if ce.challenge == nil {
+		secret, ok := ce.lookup(string(data))
+		if !ok {
+			return nil, false, AuthFailed
+		}
+		ce.username = string(data)
+		ce.secret = secret
+		ce.challenge = make([]byte, 32)
+		rand.Read(ce.challenge)
+		return ce.challenge, false, nil
+	}
+
+	mac := hmac.New(sha256.New, ce.secret)
+	mac.Write(ce.challenge)
+	if !hmac.Equal(mac.Sum(nil), data) {
+		return nil, false, AuthFailed
+	}
+	return nil, true, nil
+}
+
+func (ce *challengeExchange) Username() string { return ce.username }
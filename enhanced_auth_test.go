@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"testing"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+var challengeSecrets = map[string][]byte{
+	"alice": []byte("alice secret"),
+	"bob":   []byte("bob secret"),
+}
+
+func challengeServer(t *testing.T) *PipeListener {
+	s := NewServer()
+	s.AddAuthMechanism(&ChallengeAuth{
+		Lookup: func(username string) ([]byte, bool) {
+			secret, ok := challengeSecrets[username]
+			return secret, ok
+		},
+	})
+	return testServer(t, &s)
+}
+
+// writeAuth sends an AUTH for the challenge method
+func writeAuth(t *testing.T, conn net.Conn, rc packets.ReasonCode, data []byte) {
+	t.Helper()
+	auth := packets.Auth{ReasonCode: rc}
+	props := packets.Properties{}
+	props.Zero()
+	props.Am.WriteString(ChallengeAuthMethod)
+	props.Ad = data
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeAuth(&auth, &props, buf, scratch)
+	})
+}
+
+// answerChallenge reads the server's challenge and answers it as username
+func answerChallenge(t *testing.T, conn net.Conn, username string) {
+	t.Helper()
+	fh, body := testRead(t, conn)
+	auth := packets.Auth{}
+	auth.Zero()
+	props := packets.Properties{}
+	props.Zero()
+	err := packets.DecodeAuth(&auth, &props, body)
+	if fh.Pt != packets.AUTH || err != nil || auth.ReasonCode != packets.CA {
+		t.Fatalf("expected a challenge, got %d: %v", fh.Pt, err)
+	}
+	mac := hmac.New(sha256.New, challengeSecrets[username])
+	mac.Write(props.Ad)
+	writeAuth(t, conn, packets.CA, mac.Sum(nil))
+}
+
+func challengeConnect(t *testing.T, pl *PipeListener, username string) net.Conn {
+	t.Helper()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	connect.Id.WriteString("c")
+	props := packets.Properties{}
+	props.Zero()
+	props.Am.WriteString(ChallengeAuthMethod)
+	props.Ad = []byte(username)
+	willProps := packets.Properties{}
+	willProps.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeConnect(&connect, &props, &willProps, buf, scratch)
+	})
+	answerChallenge(t, conn, username)
+
+	fh, body := testRead(t, conn)
+	connack := packets.Connack{}
+	props.Zero()
+	err = packets.DecodeConnack(&connack, &props, body)
+	if fh.Pt != packets.CONNACK || err != nil || connack.ReasonCode != packets.S {
+		t.Fatalf("connect failed: %d, %v", connack.ReasonCode, err)
+	}
+	return conn
+}
+
+func TestReauthUsername(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		username string
+		pt       packets.PacketType
+		rc       packets.ReasonCode
+	}{
+		{"same user", "alice", packets.AUTH, packets.S},
+		{"different user", "bob", packets.DISCONNECT, packets.NA},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pl := challengeServer(t)
+			conn := challengeConnect(t, pl, "alice")
+
+			writeAuth(t, conn, packets.RA, []byte(tc.username))
+			answerChallenge(t, conn, tc.username)
+
+			fh, body := testRead(t, conn)
+			if fh.Pt != tc.pt {
+				t.Fatalf("got packet type %d, want %d", fh.Pt, tc.pt)
+			}
+			props := packets.Properties{}
+			props.Zero()
+			var rc packets.ReasonCode
+			if fh.Pt == packets.AUTH {
+				auth := packets.Auth{}
+				auth.Zero()
+				packets.DecodeAuth(&auth, &props, body)
+				rc = auth.ReasonCode
+			} else {
+				d := packets.Disconnect{}
+				packets.DecodeDisconnect(&d, &props, body)
+				rc = d.ReasonCode
+			}
+			if rc != tc.rc {
+				t.Fatalf("reason code = %d, want %d", rc, tc.rc)
+			}
+		})
+	}
+}
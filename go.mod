@@ -2,6 +2,14 @@ module github.com/andrew-r-thomas/mqtt
 
 go 1.23.2
 
-require github.com/eclipse/paho.golang v0.22.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/eclipse/paho.golang v0.22.0
+	golang.org/x/crypto v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require github.com/stretchr/testify v1.9.0 // indirect
+require (
+	github.com/stretchr/testify v1.9.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+)
@@ -0,0 +1,130 @@
+package mqtt
+
+import "github.com/andrew-r-thomas/mqtt/packets"
+
+// a Hook gets called at points in the life of a client, so things can be
+// added to the broker without forking it. hooks are called in the order
+// they were added, each one after the last, and a hook that rejects
+// something stops the rest from being called. every callback runs on the
+// client's own goroutine, so a slow hook slows down that client. messages
+// handed to the callbacks are only valid until they return, so copy
+// anything that needs to be kept. embed HookBase to only implement the
+// callbacks you need
+type Hook interface {
+	// OnConnectAuthenticate is called after the server's own authentication
+	// has accepted a CONNECT, and before the CONNACK. returning an error
+	// rejects the connection, an error that wraps BadCredentials sends a
+	// CONNACK with BUNoP and any other error sends NA
+	OnConnectAuthenticate(c *Client, creds *Credentials) error
+
+	// OnConnect is called once the client has been accepted and added to
+	// the server, before any of its packets are handled
+	OnConnect(c *Client)
+
+	// OnSubscribe is called for each filter in a SUBSCRIBE that the
+	// Authorizer allowed, returning false rejects the filter with NA
+	OnSubscribe(c *Client, filter string) bool
+
+	// OnUnsubscribe is called for each filter in an UNSUBSCRIBE, after the
+	// subscription has been removed
+	OnUnsubscribe(c *Client, filter string)
+
+	// OnPublish is called for each PUBLISH a client sends that it's allowed
+	// to, before it's matched against subscriptions. msg can be changed, and
+	// the next hook and the subscribers see the changes, but the new topic
+	// isn't checked against the Authorizer again. returning an error drops
+	// the message, and QoS 1 publishers get a PUBACK with ISE. messages from
+	// Server.Publish come from a Client that isn't connected, with only the
+	// id and username it was published as, on the "in-process" listener.
+	// ones from the admin API are the same, on the "admin" listener with no
+	// id or username
+	OnPublish(c *Client, msg *Message) error
+
+	// OnDeliver is called for each client a message is queued for, msg must
+	// not be changed
+	OnDeliver(c *Client, msg *Message)
+
+	// OnDisconnect is called when a client that was connected goes away.
+	// rc is the reason code of the DISCONNECT that ended the connection,
+	// and fromClient is whether the client sent it. if the connection just
+	// dropped, rc is UE and fromClient is false
+	OnDisconnect(c *Client, rc packets.ReasonCode, fromClient bool)
+
+	// OnSessionExpired is called once the server has thrown away a client's
+	// session, which for now is as soon as its connection ends, or as soon
+	// as a new connection with the same id takes over
+	OnSessionExpired(clientId string)
+
+	// OnWillSent is called after a client's will message has been published
+	OnWillSent(c *Client, msg *Message)
+}
+
+// Message is an application message passing through the broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	// the QoS the message was published at
+	// TODO: changing this does nothing until messages are delivered at
+	// their QoS instead of 0
+	QoS   byte
+	Props *packets.Properties
+}
+
+// HookBase implements every Hook callback as a noop that accepts everything
+type HookBase struct{}
+
+func (HookBase) OnConnectAuthenticate(*Client, *Credentials) error { return nil }
+func (HookBase) OnConnect(*Client)                                 {}
+func (HookBase) OnSubscribe(*Client, string) bool                  { return true }
+func (HookBase) OnUnsubscribe(*Client, string)                     {}
+func (HookBase) OnPublish(*Client, *Message) error                 { return nil }
+func (HookBase) OnDeliver(*Client, *Message)                       {}
+func (HookBase) OnDisconnect(*Client, packets.ReasonCode, bool)    {}
+func (HookBase) OnSessionExpired(string)                           {}
+func (HookBase) OnWillSent(*Client, *Message)                      {}
+
+// AddHook adds a hook to the end of the server's chain. the callers of every
+// hook check whether there are any first, so with none installed they cost
+// nothing. this is not safe to call once the server has started
+func (s *Server) AddHook(h Hook) {
+	s.hooks = append(s.hooks, h)
+}
+
+func (s *Server) hookConnectAuthenticate(c *Client, creds *Credentials) error {
+	for _, h := range s.hooks {
+		err := h.OnConnectAuthenticate(c, creds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) hookSubscribe(c *Client, filter string) bool {
+	for _, h := range s.hooks {
+		if !h.OnSubscribe(c, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) hookPublish(c *Client, msg *Message) error {
+	for _, h := range s.hooks {
+		err := h.OnPublish(c, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Id is the client's id, either the one it connected with or the one the
+// server assigned it
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) Username() string {
+	return c.username
+}
@@ -0,0 +1,445 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// benchClient adds a connected client to s without a real connection, its
+// queue has to be drained by hand
+func benchClient(s *Server, id string) *Client {
+	conn, _ := net.Pipe()
+	c := &Client{
+		server:   s,
+		listener: &Listener{Name: "bench"},
+		conn:     conn,
+		id:       id,
+		log:      s.logger,
+	}
+	c.queue = newOutQueue(c, s.queuePolicy)
+	s.clients[id] = c
+	return c
+}
+
+func benchPublish(b *testing.B, s *Server) {
+	pub := benchClient(s, "pub")
+	subs := make([]*Client, 4)
+	for i := range subs {
+		subs[i] = benchClient(s, "sub"+string(rune('0'+i)))
+		s.topicTrie.AddSubscription(
+			strings.Split("bench/+/temp", "/"),
+			subs[i].id,
+		)
+	}
+
+	fh := packets.FixedHeader{Pt: packets.PUBLISH}
+	p := packets.Publish{Payload: make([]byte, 64)}
+	p.Topic.WriteString("bench/room1/temp")
+	props := packets.Properties{}
+	props.Zero()
+	encoded := make([]byte, KB)
+	scratch := make([]byte, KB)
+	n := packets.EncodePublish(&fh, &p, &props, encoded, scratch)
+	encoded = encoded[:n]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		buf := s.bp.GetBuf()
+		copy(buf, encoded)
+		fh := s.fp.GetFH()
+		packets.DecodeFixedHeader(&fh, buf)
+		pub.handlePublish(Packet{fh: &fh, buf: buf[:n]})
+		s.fp.ReturnFH(fh)
+
+		for _, sub := range subs {
+			out, ok, _ := sub.queue.pop()
+			if ok {
+				s.bp.ReturnBuf(out)
+			}
+		}
+	}
+}
+
+func BenchmarkPublishNoHooks(b *testing.B) {
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	benchPublish(b, &s)
+}
+
+// benchHook changes every message, so the broker has to re-encode them
+type benchHook struct {
+	HookBase
+	delivered int
+}
+
+func (h *benchHook) OnPublish(c *Client, msg *Message) error {
+	msg.Props.AddUserProp("hooked", "true")
+	return nil
+}
+
+func (h *benchHook) OnDeliver(c *Client, msg *Message) {
+	h.delivered += 1
+}
+
+func BenchmarkPublishHooks(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("noop/%d", n), func(b *testing.B) {
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			for range n {
+				s.AddHook(HookBase{})
+			}
+			benchPublish(b, &s)
+		})
+		b.Run(fmt.Sprintf("modify/%d", n), func(b *testing.B) {
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			for range n {
+				s.AddHook(&benchHook{})
+			}
+			benchPublish(b, &s)
+		})
+	}
+}
+
+// hookLog records hook calls across hooks, in the order they happened
+type hookLog struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (l *hookLog) add(call string) {
+	l.lock.Lock()
+	l.calls = append(l.calls, call)
+	l.lock.Unlock()
+}
+
+func (l *hookLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return slices.Clone(l.calls)
+}
+
+// orderHook logs every call it gets under its name, and can be told to
+// reject things
+type orderHook struct {
+	name    string
+	log     *hookLog
+	auth    error
+	publish func(msg *Message) error
+	expired chan string
+}
+
+func (h *orderHook) OnConnectAuthenticate(c *Client, creds *Credentials) error {
+	h.log.add(h.name + ":auth")
+	return h.auth
+}
+
+func (h *orderHook) OnConnect(c *Client) {
+	h.log.add(h.name + ":connect")
+}
+
+func (h *orderHook) OnSubscribe(c *Client, filter string) bool {
+	h.log.add(h.name + ":subscribe")
+	return true
+}
+
+func (h *orderHook) OnUnsubscribe(c *Client, filter string) {
+	h.log.add(h.name + ":unsubscribe")
+}
+
+func (h *orderHook) OnPublish(c *Client, msg *Message) error {
+	h.log.add(h.name + ":publish " + msg.Topic)
+	if h.publish != nil {
+		return h.publish(msg)
+	}
+	return nil
+}
+
+func (h *orderHook) OnDeliver(c *Client, msg *Message) {
+	h.log.add(h.name + ":deliver " + msg.Topic)
+}
+
+func (h *orderHook) OnDisconnect(c *Client, rc packets.ReasonCode, fromClient bool) {
+	h.log.add(h.name + ":disconnect")
+}
+
+func (h *orderHook) OnSessionExpired(clientId string) {
+	h.log.add(h.name + ":expired")
+	if h.expired != nil {
+		h.expired <- clientId
+	}
+}
+
+func (h *orderHook) OnWillSent(c *Client, msg *Message) {
+	h.log.add(h.name + ":will")
+}
+
+func TestHookOrder(t *testing.T) {
+	log := &hookLog{}
+	expired := make(chan string, 1)
+	s := NewServer()
+	s.AddHook(&orderHook{name: "a", log: log})
+	s.AddHook(&orderHook{name: "b", log: log, expired: expired})
+	pl := testServer(t, &s)
+
+	conn := testConnect(t, pl, "c")
+	testSubscribe(t, conn, "t")
+
+	// the client gets its own message back
+	fh := packets.FixedHeader{Pt: packets.PUBLISH}
+	pub := packets.Publish{Payload: []byte("hi")}
+	pub.Topic.WriteString("t")
+	props := packets.Properties{}
+	props.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodePublish(&fh, &pub, &props, buf, scratch)
+	})
+	if fh, _ := testRead(t, conn); fh.Pt != packets.PUBLISH {
+		t.Fatalf("got packet type %d", fh.Pt)
+	}
+	conn.Close()
+	testRecv(t, expired, "c")
+
+	want := []string{
+		"a:auth", "b:auth",
+		"a:connect", "b:connect",
+		"a:subscribe", "b:subscribe",
+		"a:publish t", "b:publish t",
+		"a:deliver t", "b:deliver t",
+		"a:disconnect", "b:disconnect",
+		"a:expired", "b:expired",
+	}
+	if got := log.get(); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestHookConnectAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		rc   packets.ReasonCode
+	}{
+		{"accepted", nil, packets.S},
+		{"bad credentials", BadCredentials, packets.BUNoP},
+		{"wrapped bad credentials", fmt.Errorf("%w: expired", BadCredentials), packets.BUNoP},
+		{"anything else", errors.New("banned"), packets.NA},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &hookLog{}
+			s := NewServer()
+			s.AddHook(&orderHook{name: "a", log: log, auth: tc.err})
+			s.AddHook(&orderHook{name: "b", log: log})
+			pl := testServer(t, &s)
+
+			_, rc := testConnectRc(t, pl, "c")
+			if rc != tc.rc {
+				t.Fatalf("reason code = %d, want %d", rc, tc.rc)
+			}
+			// a rejection stops the rest of the hooks being called
+			got := log.get()
+			if tc.err != nil && !slices.Equal(got, []string{"a:auth"}) {
+				t.Fatalf("calls = %v", got)
+			}
+		})
+	}
+}
+
+// credsHook keeps the credentials OnConnectAuthenticate was called with
+type credsHook struct {
+	HookBase
+	creds chan Credentials
+}
+
+func (h *credsHook) OnConnectAuthenticate(c *Client, creds *Credentials) error {
+	h.creds <- *creds
+	return nil
+}
+
+func TestHookConnectAuthenticateScram(t *testing.T) {
+	salt := []byte("salt")
+	s := NewServer()
+	s.AddAuthMechanism(&ScramSha256{
+		Lookup: func(username string) (ScramCredential, bool) {
+			return NewScramCredential("pencil", salt, 4096), username == "bob"
+		},
+	})
+	hook := &credsHook{creds: make(chan Credentials, 1)}
+	s.AddHook(hook)
+	pl := testServer(t, &s)
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// the CONNECT claims to be admin, but SCRAM authenticates bob
+	clientFirstBare := "n=bob,r=clientnonce"
+	connect := packets.Connect{Version: packets.V5, Flags: 0b10000010}
+	connect.Id.WriteString("c")
+	connect.Username.WriteString("admin")
+	props := packets.Properties{}
+	props.Zero()
+	props.Am.WriteString(ScramSha256Method)
+	props.Ad = []byte("n,," + clientFirstBare)
+	willProps := packets.Properties{}
+	willProps.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeConnect(&connect, &props, &willProps, buf, scratch)
+	})
+
+	fh, body := testRead(t, conn)
+	auth := packets.Auth{}
+	auth.Zero()
+	props.Zero()
+	err = packets.DecodeAuth(&auth, &props, body)
+	if fh.Pt != packets.AUTH || err != nil || auth.ReasonCode != packets.CA {
+		t.Fatalf("expected server first, got %d: %v", fh.Pt, err)
+	}
+	serverFirst := string(props.Ad)
+	nonce := scramAttrs(serverFirst)["r"]
+
+	// the client side of RFC 5802
+	final := "c=biws,r=" + nonce
+	salted := scramHi([]byte("pencil"), salt, 4096)
+	clientKey := scramHmac(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	sig := scramHmac(
+		storedKey[:],
+		[]byte(clientFirstBare+","+serverFirst+","+final),
+	)
+	for i := range clientKey {
+		clientKey[i] ^= sig[i]
+	}
+	final += ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+
+	auth = packets.Auth{ReasonCode: packets.CA}
+	props.Zero()
+	props.Am.WriteString(ScramSha256Method)
+	props.Ad = []byte(final)
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeAuth(&auth, &props, buf, scratch)
+	})
+
+	fh, body = testRead(t, conn)
+	connack := packets.Connack{}
+	props.Zero()
+	err = packets.DecodeConnack(&connack, &props, body)
+	if fh.Pt != packets.CONNACK || err != nil || connack.ReasonCode != packets.S {
+		t.Fatalf("connect failed: %d, %v", connack.ReasonCode, err)
+	}
+
+	creds := <-hook.creds
+	if creds.Username != "bob" || !creds.HasUsername {
+		t.Fatalf("hook saw username %q, want %q", creds.Username, "bob")
+	}
+}
+
+func TestHookPublish(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		publish func(msg *Message) error
+		// what the second hook sees, and where the message ends up
+		calls   []string
+		to      string
+		payload string
+		rc      packets.ReasonCode
+	}{
+		{
+			name:    "unchanged",
+			publish: func(msg *Message) error { return nil },
+			calls:   []string{"a:publish a", "b:publish a", "a:deliver a", "b:deliver a"},
+			to:      "a",
+			payload: "hi",
+			rc:      packets.S,
+		},
+		{
+			name: "modified",
+			publish: func(msg *Message) error {
+				msg.Topic = "b"
+				msg.Payload = []byte("changed")
+				return nil
+			},
+			calls:   []string{"a:publish a", "b:publish b", "a:deliver b", "b:deliver b"},
+			to:      "b",
+			payload: "changed",
+			rc:      packets.S,
+		},
+		{
+			name:    "rejected",
+			publish: func(msg *Message) error { return errors.New("no") },
+			calls:   []string{"a:publish a"},
+			rc:      packets.ISE,
+		},
+		{
+			name: "invalid topic",
+			publish: func(msg *Message) error {
+				msg.Topic = "a/#"
+				return nil
+			},
+			calls: []string{"a:publish a", "b:publish a/#"},
+			rc:    packets.ISE,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := &hookLog{}
+			s := NewServer()
+			s.SetLogOutput(io.Discard, LogText)
+			s.AddHook(&orderHook{name: "a", log: log, publish: tc.publish})
+			s.AddHook(&orderHook{name: "b", log: log})
+			pub := benchClient(&s, "pub")
+			pub.version = packets.V5
+			subs := map[string]*Client{}
+			for _, topic := range []string{"a", "b"} {
+				subs[topic] = benchClient(&s, "sub-"+topic)
+				s.topicTrie.AddSubscription([]string{topic}, subs[topic].id)
+			}
+
+			fh := packets.FixedHeader{Pt: packets.PUBLISH, Flags: 0b0010}
+			p := packets.Publish{PacketId: 1, Payload: []byte("hi")}
+			p.Topic.WriteString("a")
+			props := packets.Properties{}
+			props.Zero()
+			buf := s.bp.GetBuf()
+			n := packets.EncodePublish(&fh, &p, &props, buf, make([]byte, KB))
+			pub.handlePublish(testPacket(buf[:n]))
+
+			if got := log.get(); !slices.Equal(got, tc.calls) {
+				t.Fatalf("calls = %v, want %v", got, tc.calls)
+			}
+			for topic, sub := range subs {
+				b, ok, _ := sub.queue.pop()
+				if ok != (topic == tc.to) {
+					t.Fatalf("delivered to %s: %v", topic, ok)
+				}
+				if ok && !strings.HasSuffix(string(b), tc.payload) {
+					t.Fatalf("delivered %q, want %q", b, tc.payload)
+				}
+			}
+
+			b, ok, _ := pub.queue.pop()
+			if !ok {
+				t.Fatalf("no puback")
+			}
+			off := packets.DecodeFixedHeader(&fh, b)
+			puback := packets.Puback{}
+			err := packets.DecodePuback(&puback, &props, b[off:])
+			if err != nil || puback.ReasonCode != tc.rc {
+				t.Fatalf("puback %d, %v, want %d", puback.ReasonCode, err, tc.rc)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// a Listener is one place the server accepts connections from, each with
+// its own policy. any net.Listener works, there are constructors for the
+// usual ones
+type Listener struct {
+	Name   string
+	Policy ListenerPolicy
+
+	ln    net.Listener
+	certs *certReloader // only for tls
+	conns atomic.Int64
+}
+
+type ListenerPolicy struct {
+	// the most connections this listener will have open at once,
+	// zero means no limit. clients over the limit get a CONNACK with QE
+	MaxConns int
+	// reject clients that don't authenticate somehow, either with enhanced
+	// authentication, a username checked by the server's Authenticator, or
+	// a verified client certificate
+	RequireAuth bool
+	// zero means the server's default
+	MaxPacketSize int
+	// expect a PROXY protocol (v1 or v2) header at the start of every
+	// connection, and use the address in it as the client's address.
+	// connections without one are dropped, so only turn this on for
+	// listeners that are only reachable through the proxy
+	ProxyProtocol bool
+}
+
+var ListenerFull = errors.New("listener is at its connection limit")
+
+func NewListener(
+	name string,
+	ln net.Listener,
+	policy ListenerPolicy,
+) *Listener {
+	return &Listener{Name: name, Policy: policy, ln: proxyWrap(ln, policy)}
+}
+
+// proxyWrap wraps ln to read PROXY headers if the policy asks for them. it
+// has to go under anything else reading from the connection, like TLS
+func proxyWrap(ln net.Listener, policy ListenerPolicy) net.Listener {
+	if !policy.ProxyProtocol {
+		return ln
+	}
+	return proxyListener{ln}
+}
+
+func ListenTCP(
+	name string,
+	addr string,
+	policy ListenerPolicy,
+) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(name, ln, policy), nil
+}
+
+// ListenUnix listens on a unix domain socket, removing whatever stale socket
+// file is left at path from a previous run
+func ListenUnix(
+	name string,
+	path string,
+	policy ListenerPolicy,
+) (*Listener, error) {
+	if info, err := os.Stat(path); err == nil &&
+		info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(name, ln, policy), nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// Conns is the number of connections currently open on this listener
+func (l *Listener) Conns() int64 {
+	return l.conns.Load()
+}
+
+// Serve accepts connections on all of the given listeners until one of them
+// fails, at which point they all get closed and the error is returned
+func (s *Server) Serve(listeners ...*Listener) error {
+	errs := make(chan error, len(listeners))
+
+	s.listenersLock.Lock()
+	for _, l := range listeners {
+		s.listeners = append(s.listeners, l)
+		if l.certs != nil {
+			go l.certs.watch(s.ctx, s.logger.With("listener", l.Name))
+		}
+		go func() { errs <- s.serve(l) }()
+	}
+	s.listenersLock.Unlock()
+
+	err := <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	if s.closing.Load() {
+		return ServerClosed
+	}
+	return err
+}
+
+func (s *Server) serve(l *Listener) error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		l.conns.Add(1)
+		go func() {
+			s.handleConn(conn, l)
+			l.conns.Add(-1)
+		}()
+	}
+}
+
+// PipeListener is an in memory net.Listener, connections are made with Dial
+// and are the two ends of a net.Pipe. it's meant for tests
+type PipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial returns the client end of a new connection,
+// it blocks until the server accepts it
+func (pl *PipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case pl.conns <- server:
+		return client, nil
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *PipeListener) Close() error {
+	pl.once.Do(func() { close(pl.done) })
+	return nil
+}
+
+func (pl *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,211 @@
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// testConns waits for l to have want connections open
+func testConns(t *testing.T, l *Listener, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for l.Conns() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("listener has %d conns, want %d", l.Conns(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenerMaxConns(t *testing.T) {
+	s := NewServer()
+	pl := NewPipeListener()
+	l := NewListener("test", pl, ListenerPolicy{MaxConns: 2})
+	other := NewPipeListener()
+	testServe(t, &s, l, NewListener("other", other, ListenerPolicy{}))
+
+	a := testConnect(t, pl, "a")
+	testConnect(t, pl, "b")
+	if _, rc := testConnectRc(t, pl, "c"); rc != packets.QE {
+		t.Fatalf("connack = %v, want %v", rc, packets.QE)
+	}
+
+	// the limit is only for this listener
+	testConnect(t, other, "d")
+
+	// and a client leaving makes room for another
+	a.Close()
+	testConns(t, l, 1)
+	testConnect(t, pl, "e")
+}
+
+func TestListenerRequireAuth(t *testing.T) {
+	path := writePasswordFile(t, "alice:"+HashArgon2id("pw")+"\n")
+	fa, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fa.AllowAnonymous = true
+
+	s := NewServer()
+	s.SetAuthenticator(fa)
+	strict := NewPipeListener()
+	lax := NewPipeListener()
+	testServe(t, &s,
+		NewListener("strict", strict, ListenerPolicy{RequireAuth: true}),
+		NewListener("lax", lax, ListenerPolicy{}),
+	)
+
+	connect := func(username, password string) *packets.Connect {
+		connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+		connect.Id.WriteString("c")
+		if username != "" {
+			connect.Flags |= 0b11000000
+			connect.Username.WriteString(username)
+			connect.Password = []byte(password)
+		}
+		return &connect
+	}
+
+	tests := []struct {
+		name     string
+		pl       *PipeListener
+		username string
+		password string
+		want     packets.ReasonCode
+	}{
+		{"anonymous", strict, "", "", packets.NA},
+		{"anonymous lax", lax, "", "", packets.S},
+		{"password", strict, "alice", "pw", packets.S},
+		{"wrong password", strict, "alice", "nope", packets.BUNoP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, rc := testConnectPacket(t, tt.pl, connect(tt.username, tt.password))
+			if rc != tt.want {
+				t.Fatalf("connack = %v, want %v", rc, tt.want)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestListenerMaxPacketSize(t *testing.T) {
+	s := NewServer()
+	pl := testServerPolicy(t, &s, ListenerPolicy{MaxPacketSize: 64})
+
+	// the server stops reading partway through packets that are too big,
+	// so they're written in the background so we can read what it says
+	publish := func(size int) []byte {
+		fh := packets.FixedHeader{Pt: packets.PUBLISH}
+		p := packets.Publish{Payload: make([]byte, size)}
+		p.Topic.WriteString("t")
+		props := packets.Properties{}
+		props.Zero()
+		buf := make([]byte, 256)
+		n := packets.EncodePublish(&fh, &p, &props, buf, make([]byte, 256))
+		return buf[:n]
+	}
+
+	conn := testConnect(t, pl, "c")
+	testSubscribe(t, conn, "t")
+	testWrite(t, conn, func(buf, _ []byte) int {
+		return copy(buf, publish(32))
+	})
+	if fh, _ := testRead(t, conn); fh.Pt != packets.PUBLISH {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PUBLISH)
+	}
+
+	go conn.Write(publish(64))
+	fh, body := testRead(t, conn)
+	if fh.Pt != packets.DISCONNECT || body[0] != byte(packets.PTL) {
+		t.Fatalf("got packet type %d, %v", fh.Pt, body)
+	}
+
+	// a CONNECT that's too big doesn't even get a CONNACK
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	big := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	big.Id.WriteString(strings.Repeat("x", 64))
+	props := packets.Properties{}
+	props.Zero()
+	buf := make([]byte, 256)
+	n := packets.EncodeConnect(&big, &props, &props, buf, make([]byte, 256))
+	go conn.Write(buf[:n])
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want the connection closed", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+
+	// leave a socket file behind like a server that crashed would
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+
+	l, err := ListenUnix("unix", path, ListenerPolicy{})
+	if err != nil {
+		t.Fatalf("ListenUnix over a stale socket: %v", err)
+	}
+	s := NewServer()
+	testServe(t, &s, l)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	connect.Id.WriteString("c")
+	if rc := testConnectConn(t, conn, &connect); rc != packets.S {
+		t.Fatalf("connack = %v, want %v", rc, packets.S)
+	}
+
+	// anything that isn't a socket is left alone
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix("unix", file, ListenerPolicy{}); err == nil {
+		t.Fatalf("ListenUnix over a regular file succeeded")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep me" {
+		t.Fatalf("regular file = %q, %v", data, err)
+	}
+}
+
+func TestPipeListenerClose(t *testing.T) {
+	pl := NewPipeListener()
+	if err := pl.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := pl.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if _, err := pl.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("dial after close = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := pl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close = %v, want %v", err, net.ErrClosed)
+	}
+}
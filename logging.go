@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// the server logs through log/slog. records about a connection carry the
+// client id, remote address and listener, and anything that happens per
+// packet is at debug level so it costs next to nothing when it's off
+
+type LogFormat byte
+
+const (
+	LogText LogFormat = iota
+	LogJSON
+)
+
+// SetLogOutput makes the server log to w in the given format, at whatever
+// the current log level is. by default it logs text to stderr at info. this
+// is not safe to call once the server has started
+func (s *Server) SetLogOutput(w io.Writer, format LogFormat) {
+	opts := &slog.HandlerOptions{Level: s.logLevel}
+	var h slog.Handler
+	switch format {
+	case LogJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		h = slog.NewTextHandler(w, opts)
+	}
+	s.logger = slog.New(h)
+}
+
+// SetLogger replaces the server's logger entirely, SetLogLevel has no effect
+// on it unless its handler uses LogLevel. this is not safe to call once the
+// server has started
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// SetLogLevel changes the level of the server's logger, this is safe to call
+// while the server is running
+func (s *Server) SetLogLevel(level slog.Level) {
+	s.logLevel.Set(level)
+}
+
+// LogLevel is the level the server's logger is set to, it can be used as
+// the slog.Leveler for a handler passed to SetLogger
+func (s *Server) LogLevel() *slog.LevelVar {
+	return s.logLevel
+}
+
+func newLogger(level *slog.LevelVar) *slog.Logger {
+	return slog.New(
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}),
+	)
+}
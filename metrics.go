@@ -0,0 +1,253 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// metrics are the server's counters, everything else that gets exposed is
+// read from where it already lives when it's scraped
+type metrics struct {
+	packetsIn  [16]atomic.Uint64 // by packet type
+	packetsOut [16]atomic.Uint64
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+
+	// by reason code, for DISCONNECTs we sent and ones clients sent us
+	disconnectsSent [256]atomic.Uint64
+	disconnectsRecv [256]atomic.Uint64
+
+	fanout *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		fanout: newHistogram(0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000),
+	}
+}
+
+func (m *metrics) packetIn(b []byte) {
+	m.packetsIn[b[0]>>4].Add(1)
+	m.bytesIn.Add(uint64(len(b)))
+}
+
+func (m *metrics) packetOut(b []byte) {
+	m.packetsOut[b[0]>>4].Add(1)
+	m.bytesOut.Add(uint64(len(b)))
+}
+
+// histogram has cumulative buckets, like prometheus wants them
+type histogram struct {
+	bounds []uint64
+	counts []atomic.Uint64 // one more than bounds, for +Inf
+	sum    atomic.Uint64
+}
+
+func newHistogram(bounds ...uint64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v uint64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i += 1
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+// MetricsHandler serves the server's metrics in the prometheus text
+// exposition format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(s.writeMetrics())
+	})
+}
+
+// StartMetrics serves MetricsHandler at /metrics on addr, it blocks like
+// Start does
+func (s *Server) StartMetrics(addr string) error {
+	return http.ListenAndServe(addr, s.metricsMux())
+}
+
+func (s *Server) metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	return mux
+}
+
+func (s *Server) writeMetrics() []byte {
+	mw := metricsWriter{}
+	m := s.metrics
+
+	mw.family("mqtt_connections", "gauge", "open connections by listener")
+	s.listenersLock.Lock()
+	for _, l := range s.listeners {
+		mw.sample("mqtt_connections", l.Conns(), "listener", l.Name)
+	}
+	s.listenersLock.Unlock()
+
+	s.clientsLock.RLock()
+	clients := len(s.clients)
+	queued, maxQueued := 0, 0
+	for _, c := range s.clients {
+		n := c.queue.len()
+		queued += n
+		maxQueued = max(maxQueued, n)
+	}
+	s.clientsLock.RUnlock()
+	mw.family("mqtt_clients", "gauge", "connected clients")
+	mw.sample("mqtt_clients", clients)
+	mw.family(
+		"mqtt_queued_packets",
+		"gauge",
+		"packets waiting in outbound queues, across all clients",
+	)
+	mw.sample("mqtt_queued_packets", queued)
+	mw.family(
+		"mqtt_queued_packets_max",
+		"gauge",
+		"the most packets waiting in any one client's outbound queue",
+	)
+	mw.sample("mqtt_queued_packets_max", maxQueued)
+
+	mw.family("mqtt_packets_received_total", "counter", "packets received by type")
+	for pt := packets.CONNECT; pt <= packets.AUTH; pt++ {
+		t := strings.ToLower(pt.String())
+		mw.sample("mqtt_packets_received_total", m.packetsIn[pt].Load(), "type", t)
+	}
+	mw.family("mqtt_packets_sent_total", "counter", "packets sent by type")
+	for pt := packets.CONNECT; pt <= packets.AUTH; pt++ {
+		t := strings.ToLower(pt.String())
+		mw.sample("mqtt_packets_sent_total", m.packetsOut[pt].Load(), "type", t)
+	}
+
+	mw.family("mqtt_bytes_received_total", "counter", "bytes of packets received")
+	mw.sample("mqtt_bytes_received_total", m.bytesIn.Load())
+	mw.family("mqtt_bytes_sent_total", "counter", "bytes of packets sent")
+	mw.sample("mqtt_bytes_sent_total", m.bytesOut.Load())
+
+	mw.family(
+		"mqtt_disconnects_total",
+		"counter",
+		"DISCONNECT packets by reason code, and who sent them",
+	)
+	for rc := range 256 {
+		if n := m.disconnectsSent[rc].Load(); n > 0 {
+			mw.sample(
+				"mqtt_disconnects_total",
+				n,
+				"reason_code", fmt.Sprint(rc),
+				"sent_by", "server",
+			)
+		}
+		if n := m.disconnectsRecv[rc].Load(); n > 0 {
+			mw.sample(
+				"mqtt_disconnects_total",
+				n,
+				"reason_code", fmt.Sprint(rc),
+				"sent_by", "client",
+			)
+		}
+	}
+
+	mw.histogram(
+		"mqtt_publish_fanout",
+		"subscribers each PUBLISH was delivered to",
+		m.fanout,
+	)
+
+	mw.family("mqtt_topic_trie_nodes", "gauge", "nodes in the subscription trie")
+	mw.sample("mqtt_topic_trie_nodes", s.topicTrie.NodeCount())
+
+	bs, fs := s.bp.Stats(), s.fp.Stats()
+	mw.family("mqtt_pool_hits_total", "counter", "pool gets that reused a value")
+	mw.sample("mqtt_pool_hits_total", bs.Hits, "pool", "buf")
+	mw.sample("mqtt_pool_hits_total", fs.Hits, "pool", "fixed_header")
+	mw.family("mqtt_pool_misses_total", "counter", "pool gets that allocated")
+	mw.sample("mqtt_pool_misses_total", bs.Misses, "pool", "buf")
+	mw.sample("mqtt_pool_misses_total", fs.Misses, "pool", "fixed_header")
+
+	ps := s.PublishLimitStats()
+	mw.family(
+		"mqtt_publish_limited_total",
+		"counter",
+		"inbound PUBLISH packets over the publish limits, by what happened",
+	)
+	mw.sample("mqtt_publish_limited_total", ps.Throttled, "action", "throttled")
+	mw.sample("mqtt_publish_limited_total", ps.Dropped, "action", "dropped")
+	mw.sample(
+		"mqtt_publish_limited_total",
+		ps.Disconnected,
+		"action", "disconnected",
+	)
+
+	qs := s.QueueStats()
+	mw.family(
+		"mqtt_queue_overflows_total",
+		"counter",
+		"outbound PUBLISH packets that didn't fit in a queue, by what happened",
+	)
+	mw.sample("mqtt_queue_overflows_total", qs.Dropped, "action", "dropped")
+	mw.sample("mqtt_queue_overflows_total", qs.Spilled, "action", "spilled")
+	mw.sample(
+		"mqtt_queue_overflows_total",
+		qs.Disconnected,
+		"action", "disconnected",
+	)
+
+	return mw.buf.Bytes()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricsWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single value, labels are name, value pairs
+func (mw *metricsWriter) sample(name string, val any, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			mw.buf.WriteString(labels[i])
+			mw.buf.WriteString(`="`)
+			labelEscaper.WriteString(&mw.buf, labels[i+1])
+			mw.buf.WriteByte('"')
+		}
+		mw.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&mw.buf, " %v\n", val)
+}
+
+func (mw *metricsWriter) histogram(name string, help string, h *histogram) {
+	mw.family(name, "histogram", help)
+	var cum uint64
+	for i, bound := range h.bounds {
+		cum += h.counts[i].Load()
+		mw.sample(name+"_bucket", cum, "le", fmt.Sprint(bound))
+	}
+	cum += h.counts[len(h.bounds)].Load()
+	mw.sample(name+"_bucket", cum, "le", "+Inf")
+	mw.sample(name+"_sum", h.sum.Load())
+	mw.sample(name+"_count", cum)
+}
@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// scrape gets the server's metrics the way prometheus would
+func scrape(t *testing.T, s *Server) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.metricsMux().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type = %q", ct)
+	}
+	return rec.Body.String()
+}
+
+// waitMetrics scrapes until every line in want shows up
+func waitMetrics(t *testing.T, s *Server, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		body := scrape(t, s)
+		missing := ""
+		for _, line := range want {
+			if !strings.Contains(body, "\n"+line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics missing %q:\n%s", missing, body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+
+	publish := func(conn net.Conn, topic string) {
+		fh := packets.FixedHeader{Pt: packets.PUBLISH}
+		p := packets.Publish{Payload: []byte("hi")}
+		p.Topic.WriteString(topic)
+		props := packets.Properties{}
+		props.Zero()
+		testWrite(t, conn, func(buf, scratch []byte) int {
+			return packets.EncodePublish(&fh, &p, &props, buf, scratch)
+		})
+	}
+
+	sub := testConnect(t, pl, "sub")
+	testSubscribe(t, sub, "t")
+	pub := testConnect(t, pl, "pub")
+	publish(pub, "t")
+	if fh, _ := testRead(t, sub); fh.Pt != packets.PUBLISH {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PUBLISH)
+	}
+
+	// pub leaves politely
+	props := packets.Properties{}
+	props.Zero()
+	testWrite(t, pub, func(buf, scratch []byte) int {
+		return packets.EncodeDisconnect(&packets.Disconnect{}, &props, buf, scratch)
+	})
+
+	// and bad gets thrown out
+	bad := testConnect(t, pl, "bad")
+	publish(bad, "a/+")
+	if fh, _ := testRead(t, bad); fh.Pt != packets.DISCONNECT {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.DISCONNECT)
+	}
+	bad.Close()
+
+	waitMetrics(t, &s,
+		`mqtt_connections{listener="test"} 1`,
+		`mqtt_clients 1`,
+		`mqtt_packets_received_total{type="connect"} 3`,
+		`mqtt_packets_received_total{type="publish"} 2`,
+		`mqtt_packets_received_total{type="subscribe"} 1`,
+		`mqtt_packets_received_total{type="disconnect"} 1`,
+		`mqtt_packets_sent_total{type="connack"} 3`,
+		`mqtt_packets_sent_total{type="suback"} 1`,
+		`mqtt_packets_sent_total{type="publish"} 1`,
+		`mqtt_packets_sent_total{type="disconnect"} 1`,
+		`mqtt_disconnects_total{reason_code="0",sent_by="client"} 1`,
+		`mqtt_disconnects_total{reason_code="144",sent_by="server"} 1`,
+		`mqtt_publish_fanout_bucket{le="0"} 0`,
+		`mqtt_publish_fanout_bucket{le="1"} 1`,
+		`mqtt_publish_fanout_bucket{le="+Inf"} 1`,
+		`mqtt_publish_fanout_sum 1`,
+		`mqtt_publish_fanout_count 1`,
+	)
+
+	// every family has its help and type
+	body := scrape(t, &s)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, " ")
+		name, _, _ = strings.Cut(name, "{")
+		base := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			base = strings.TrimSuffix(base, suffix)
+		}
+		if !strings.Contains(body, "# TYPE "+name+" ") &&
+			!strings.Contains(body, "# TYPE "+base+" histogram") {
+			t.Fatalf("no TYPE for %q", name)
+		}
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	h := newHistogram(1, 10, 100)
+	for _, v := range []uint64{0, 1, 2, 10, 50, 1000} {
+		h.observe(v)
+	}
+
+	mw := metricsWriter{}
+	mw.histogram("h", "test", h)
+	want := "# HELP h test\n" +
+		"# TYPE h histogram\n" +
+		"h_bucket{le=\"1\"} 2\n" +
+		"h_bucket{le=\"10\"} 4\n" +
+		"h_bucket{le=\"100\"} 5\n" +
+		"h_bucket{le=\"+Inf\"} 6\n" +
+		"h_sum 1063\n" +
+		"h_count 6\n"
+	if got := mw.buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	mw := metricsWriter{}
+	mw.sample("m", 1, "a", `x"y`, "b", `c:\d`, "c", "two\nlines")
+	want := `m{a="x\"y",b="c:\\d",c="two\nlines"} 1` + "\n"
+	if got := mw.buf.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	s := NewServer()
+	srv := httptest.NewServer(s.MetricsHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "\nmqtt_clients 0\n") {
+		t.Fatalf("metrics missing mqtt_clients:\n%s", body)
+	}
+}
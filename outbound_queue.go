@@ -0,0 +1,429 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// QueuePolicy bounds how much a client can have waiting to be written to it,
+// so fan out never has to wait on a slow subscriber. the packets a client
+// gets in response to its own requests (acks, PINGRESP and so on) are
+// always queued, the limits only apply to PUBLISH packets
+type QueuePolicy struct {
+	// zero MaxMsgs means DefaultQueueLen, zero MaxBytes means no limit
+	MaxMsgs  int
+	MaxBytes int
+
+	// what to do with a PUBLISH that doesn't fit
+	Overflow QueueOverflow
+
+	// where OverflowSpill writes its files, "" is the os temp dir.
+	// zero MaxSpillBytes means no limit, clients over the limit get
+	// disconnected
+	SpillDir      string
+	MaxSpillBytes int64
+}
+
+const DefaultQueueLen = 128
+
+var SpillFull = errors.New("spill file is at its size limit")
+
+type QueueOverflow byte
+
+const (
+	// drop the PUBLISH that doesn't fit if it's QoS 0, anything else
+	// disconnects the client
+	QueueDropNewest QueueOverflow = iota
+	// drop the oldest queued PUBLISH packets until the new one fits
+	QueueDropOldest
+	// disconnect the client with UE
+	QueueDisconnect
+	// write PUBLISH packets that don't fit to a file, and send them once the
+	// client catches up
+	QueueSpill
+)
+
+// QueueStats counts what the outbound queues have done with overflowing
+// PUBLISH packets, across all clients since the server started
+type QueueStats struct {
+	Dropped      uint64
+	Spilled      uint64
+	Disconnected uint64
+}
+
+// SetQueuePolicy sets the outbound queue policy for new clients, this is not
+// safe to call once the server has started
+func (s *Server) SetQueuePolicy(policy QueuePolicy) {
+	s.queuePolicy = policy
+}
+
+func (s *Server) QueueStats() QueueStats {
+	return QueueStats{
+		Dropped:      s.queueStats.dropped.Load(),
+		Spilled:      s.queueStats.spilled.Load(),
+		Disconnected: s.queueStats.disconnected.Load(),
+	}
+}
+
+type queueStats struct {
+	dropped      atomic.Uint64
+	spilled      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// outQueue is a client's outbound packets, anyone can push to it without
+// blocking and the writePump pops from it
+type outQueue struct {
+	c      *Client
+	policy QueuePolicy
+
+	lock     sync.Mutex
+	msgs     [][]byte
+	bytes    int
+	pubs     int // how many of msgs are PUBLISH packets
+	overflow bool
+	closed   bool
+
+	// once the queue is ending nothing else gets pushed, and last is sent
+	// after everything that's already queued
+	ending bool
+	last   []byte
+
+	// when spilling, everything new goes to the file until it's been read
+	// back out, so packets stay in order. the file is read and written
+	// without the lock, writers reserve their place at spillW first, and
+	// spillLen only counts packets once everything before them is written
+	spill        *os.File
+	spillW       int64
+	spillR       int64
+	spillLen     int
+	spillPending []*spillRec
+
+	// ready gets a value whenever something is pushed
+	ready chan struct{}
+}
+
+func newOutQueue(c *Client, policy QueuePolicy) *outQueue {
+	if policy.MaxMsgs == 0 {
+		policy.MaxMsgs = DefaultQueueLen
+	}
+	return &outQueue{
+		c:      c,
+		policy: policy,
+		msgs:   make([][]byte, 0, 16),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues b, which needs to be a whole encoded packet from the BufPool.
+// the queue owns b from here on
+func (q *outQueue) push(b []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed || q.overflow || q.ending {
+		q.c.server.bp.ReturnBuf(b)
+		return
+	}
+
+	isPub := packets.PacketType(b[0]>>4) == packets.PUBLISH
+	if !isPub {
+		q.append(b, false)
+		q.notify()
+		return
+	}
+
+	if q.spilling() || !q.fits(len(b)) {
+		switch q.policy.Overflow {
+		case QueueDropNewest:
+			if (b[0]>>1)&0b11 != 0 {
+				q.disconnect()
+			} else {
+				q.c.server.queueStats.dropped.Add(1)
+			}
+			q.c.server.bp.ReturnBuf(b)
+			return
+		case QueueDropOldest:
+			for !q.fits(len(b)) && q.dropOldest() {
+			}
+		case QueueDisconnect:
+			q.c.server.bp.ReturnBuf(b)
+			q.disconnect()
+			return
+		case QueueSpill:
+			rec, err := q.reserveSpill(len(b))
+			if err == nil {
+				f := q.spill
+				q.lock.Unlock()
+				err = writeSpill(f, rec.off, b)
+				q.lock.Lock()
+				err = q.spillWritten(rec, err)
+			}
+			q.c.server.bp.ReturnBuf(b)
+			if err != nil && !q.closed {
+				q.c.log.Error("error spilling to disk", "err", err)
+				q.disconnect()
+			}
+			q.notify()
+			return
+		}
+	}
+
+	q.append(b, true)
+	q.notify()
+}
+
+// pop returns the next packet to write, or false if there isn't one. the
+// caller owns the buffer. overflow is set once the queue has given up on the
+// client, in which case it should be disconnected with UE. only the
+// writePump pops, so there's only ever one read of the spill file going
+func (q *outQueue) pop() (b []byte, ok bool, overflow bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.overflow {
+		return nil, false, true
+	}
+	if len(q.msgs) > 0 {
+		b = q.msgs[0]
+		q.msgs[0] = nil
+		q.msgs = q.msgs[1:]
+		q.bytes -= len(b)
+		if packets.PacketType(b[0]>>4) == packets.PUBLISH {
+			q.pubs -= 1
+		}
+		return b, true, false
+	}
+	if q.spillLen > 0 {
+		f, off := q.spill, q.spillR
+		q.lock.Unlock()
+		b, n, err := q.readSpill(f, off)
+		q.lock.Lock()
+		if q.closed || q.overflow {
+			if err == nil {
+				q.c.server.bp.ReturnBuf(b)
+			}
+			return nil, false, q.overflow
+		}
+		if err != nil {
+			q.c.log.Error("error reading spill file", "err", err)
+			q.disconnect()
+			return nil, false, true
+		}
+		q.spillRead(n)
+		return b, true, false
+	}
+	if q.last != nil {
+		b, q.last = q.last, nil
+		return b, true, false
+	}
+	return nil, false, false
+}
+
+// end queues b, if it isn't nil, as the last packet the client gets. once
+// everything has been popped, ended is true. only the first call does
+// anything
+func (q *outQueue) end(b []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed || q.overflow || q.ending {
+		if b != nil {
+			q.c.server.bp.ReturnBuf(b)
+		}
+		return
+	}
+	q.ending = true
+	q.last = b
+	q.notify()
+}
+
+// ended is whether the queue has been ended, and everything in it popped
+func (q *outQueue) ended() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.ending && q.last == nil && len(q.msgs) == 0 && !q.spilling()
+}
+
+// len is how many packets are waiting, including spilled ones
+func (q *outQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.msgs) + q.spillLen + len(q.spillPending)
+}
+
+// close gives everything left back to the pool, anything pushed after this
+// is dropped
+func (q *outQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	for _, b := range q.msgs {
+		q.c.server.bp.ReturnBuf(b)
+	}
+	q.msgs = nil
+	if q.last != nil {
+		q.c.server.bp.ReturnBuf(q.last)
+		q.last = nil
+	}
+	if q.spill != nil {
+		q.spill.Close()
+		os.Remove(q.spill.Name())
+		q.spill = nil
+	}
+}
+
+func (q *outQueue) fits(n int) bool {
+	if q.pubs >= q.policy.MaxMsgs {
+		return false
+	}
+	return q.policy.MaxBytes == 0 || q.bytes+n <= q.policy.MaxBytes
+}
+
+func (q *outQueue) append(b []byte, isPub bool) {
+	q.msgs = append(q.msgs, b)
+	q.bytes += len(b)
+	if isPub {
+		q.pubs += 1
+	}
+}
+
+// dropOldest drops the oldest queued PUBLISH, returning false if there
+// aren't any
+func (q *outQueue) dropOldest() bool {
+	for i, b := range q.msgs {
+		if packets.PacketType(b[0]>>4) != packets.PUBLISH {
+			continue
+		}
+		q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+		q.bytes -= len(b)
+		q.pubs -= 1
+		q.c.server.bp.ReturnBuf(b)
+		q.c.server.queueStats.dropped.Add(1)
+		return true
+	}
+	return false
+}
+
+// disconnect marks the queue as overflowed for the writePump to pick up.
+// if the writePump is stuck on a write to a client that's stopped reading,
+// the write deadline gets it unstuck
+func (q *outQueue) disconnect() {
+	if q.overflow {
+		return
+	}
+	q.overflow = true
+	q.c.server.queueStats.disconnected.Add(1)
+	for _, b := range q.msgs {
+		q.c.server.bp.ReturnBuf(b)
+	}
+	q.msgs = q.msgs[:0]
+	q.c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	q.notify()
+}
+
+func (q *outQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// spill files are a sequence of packets, each with a 4 byte length prefix
+type spillRec struct {
+	off  int64
+	done bool
+}
+
+func (q *outQueue) spilling() bool {
+	return q.spillLen > 0 || len(q.spillPending) > 0
+}
+
+// reserveSpill makes room for an n byte packet at the end of the spill file,
+// for writeSpill to write to without the lock. the file is only created the
+// first time, after that it's reused
+func (q *outQueue) reserveSpill(n int) (*spillRec, error) {
+	if q.spill == nil {
+		f, err := os.CreateTemp(q.policy.SpillDir, "mqtt-spill-*")
+		if err != nil {
+			return nil, err
+		}
+		q.spill = f
+	}
+	size := int64(4 + n)
+	if q.policy.MaxSpillBytes > 0 &&
+		q.spillW+size > q.policy.MaxSpillBytes {
+		return nil, SpillFull
+	}
+
+	rec := &spillRec{off: q.spillW}
+	q.spillW += size
+	q.spillPending = append(q.spillPending, rec)
+	return rec, nil
+}
+
+func writeSpill(f *os.File, off int64, b []byte) error {
+	rec := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(rec, uint32(len(b)))
+	rec = append(rec, b...)
+	_, err := f.WriteAt(rec, off)
+	return err
+}
+
+// spillWritten marks rec as written, and makes it and anything after it
+// that's been written available to pop, as long as everything before them
+// has been written too
+func (q *outQueue) spillWritten(rec *spillRec, err error) error {
+	if err != nil {
+		return err
+	}
+	rec.done = true
+	for len(q.spillPending) > 0 && q.spillPending[0].done {
+		q.spillPending[0] = nil
+		q.spillPending = q.spillPending[1:]
+		q.spillLen += 1
+		q.c.server.queueStats.spilled.Add(1)
+	}
+	return nil
+}
+
+// readSpill reads the packet at off into a buf from the pool, returning it
+// and how much of the file it took up
+func (q *outQueue) readSpill(f *os.File, off int64) ([]byte, int64, error) {
+	var head [4]byte
+	_, err := f.ReadAt(head[:], off)
+	if err != nil {
+		return nil, 0, err
+	}
+	l := int(binary.BigEndian.Uint32(head[:]))
+
+	b := q.c.server.bp.GetBuf()
+	if len(b) < l {
+		b = append(b, make([]byte, l-len(b))...)
+	}
+	_, err = f.ReadAt(b[:l], off+4)
+	if err != nil {
+		q.c.server.bp.ReturnBuf(b)
+		return nil, 0, err
+	}
+	return b[:l], int64(4 + l), nil
+}
+
+func (q *outQueue) spillRead(n int64) {
+	q.spillR += n
+	q.spillLen -= 1
+
+	// once it's all been read back out, and nothing's being written, the
+	// file can start over from the beginning
+	if !q.spilling() {
+		q.spillR = 0
+		q.spillW = 0
+	}
+}
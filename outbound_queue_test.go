@@ -0,0 +1,275 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// testQueue gives a queue with policy, on a client that isn't connected
+func testQueue(t *testing.T, policy QueuePolicy) (*Server, *outQueue) {
+	t.Helper()
+	s := NewServer()
+	s.SetLogOutput(io.Discard, LogText)
+	c := benchClient(&s, "c")
+	c.queue = newOutQueue(c, policy)
+	t.Cleanup(c.queue.close)
+	return &s, c.queue
+}
+
+// testPub is a pooled buf that looks enough like a PUBLISH for the queue,
+// with from and n in it so it can be told apart
+func testPub(s *Server, qos byte, from byte, n uint32) []byte {
+	b := s.bp.GetBuf()
+	b[0] = byte(packets.PUBLISH)<<4 | qos<<1
+	b[1] = from
+	binary.BigEndian.PutUint32(b[2:6], n)
+	return b[:6]
+}
+
+// testAck is testPub for a packet the limits don't apply to
+func testAck(s *Server, n uint32) []byte {
+	b := s.bp.GetBuf()
+	b[0] = byte(packets.PUBACK) << 4
+	binary.BigEndian.PutUint32(b[2:6], n)
+	return b[:6]
+}
+
+// testDrain pops everything that's ready, returning the n of each packet
+func testDrain(s *Server, q *outQueue) (ns []uint32, overflow bool) {
+	for {
+		b, ok, overflow := q.pop()
+		if !ok {
+			return ns, overflow
+		}
+		ns = append(ns, binary.BigEndian.Uint32(b[2:6]))
+		s.bp.ReturnBuf(b)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	type qpush struct {
+		qos byte
+		n   uint32
+		ack bool
+	}
+	pubs := func(qos byte, ns ...uint32) []qpush {
+		ps := make([]qpush, len(ns))
+		for i, n := range ns {
+			ps[i] = qpush{qos: qos, n: n}
+		}
+		return ps
+	}
+	ack := func(n uint32) qpush { return qpush{n: n, ack: true} }
+
+	for _, tc := range []struct {
+		name     string
+		policy   QueuePolicy
+		pushes   []qpush
+		want     []uint32
+		overflow bool
+		stats    QueueStats
+	}{
+		{
+			name:   "drop newest qos 0",
+			policy: QueuePolicy{MaxMsgs: 2, Overflow: QueueDropNewest},
+			pushes: pubs(0, 0, 1, 2, 3),
+			want:   []uint32{0, 1},
+			stats:  QueueStats{Dropped: 2},
+		},
+		{
+			name:     "drop newest qos 1",
+			policy:   QueuePolicy{MaxMsgs: 2, Overflow: QueueDropNewest},
+			pushes:   append(pubs(0, 0, 1), pubs(1, 2)...),
+			overflow: true,
+			stats:    QueueStats{Disconnected: 1},
+		},
+		{
+			name:   "max bytes",
+			policy: QueuePolicy{MaxMsgs: 10, MaxBytes: 12},
+			pushes: pubs(0, 0, 1, 2),
+			want:   []uint32{0, 1},
+			stats:  QueueStats{Dropped: 1},
+		},
+		{
+			name:   "acks are always queued",
+			policy: QueuePolicy{MaxMsgs: 1, MaxBytes: 6},
+			pushes: []qpush{{n: 0}, ack(100), {n: 1}, ack(101)},
+			want:   []uint32{0, 100, 101},
+			stats:  QueueStats{Dropped: 1},
+		},
+		{
+			name:   "drop oldest",
+			policy: QueuePolicy{MaxMsgs: 2, Overflow: QueueDropOldest},
+			pushes: append(pubs(1, 0, 1, 2), pubs(2, 3)...),
+			want:   []uint32{2, 3},
+			stats:  QueueStats{Dropped: 2},
+		},
+		{
+			name:   "drop oldest keeps acks",
+			policy: QueuePolicy{MaxMsgs: 2, Overflow: QueueDropOldest},
+			pushes: []qpush{ack(100), {n: 0}, {n: 1}, ack(101), {n: 2}},
+			want:   []uint32{100, 1, 101, 2},
+			stats:  QueueStats{Dropped: 1},
+		},
+		{
+			name:     "disconnect",
+			policy:   QueuePolicy{MaxMsgs: 2, Overflow: QueueDisconnect},
+			pushes:   pubs(0, 0, 1, 2),
+			overflow: true,
+			stats:    QueueStats{Disconnected: 1},
+		},
+		{
+			name:   "spill",
+			policy: QueuePolicy{MaxMsgs: 2, Overflow: QueueSpill},
+			pushes: append(pubs(0, 0, 1, 2, 3), pubs(1, 4, 5)...),
+			want:   []uint32{0, 1, 2, 3, 4, 5},
+			stats:  QueueStats{Spilled: 4},
+		},
+		{
+			// acks skip ahead of the spill file
+			name:   "spill with acks",
+			policy: QueuePolicy{MaxMsgs: 1, Overflow: QueueSpill},
+			pushes: []qpush{{n: 0}, {n: 1}, ack(100), {n: 2}},
+			want:   []uint32{0, 100, 1, 2},
+			stats:  QueueStats{Spilled: 2},
+		},
+		{
+			// each spilled packet takes up 4+6 bytes of the file
+			name: "spill limit",
+			policy: QueuePolicy{
+				MaxMsgs:       1,
+				Overflow:      QueueSpill,
+				MaxSpillBytes: 20,
+			},
+			pushes:   pubs(0, 0, 1, 2, 3),
+			overflow: true,
+			stats:    QueueStats{Spilled: 2, Disconnected: 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.policy.Overflow == QueueSpill {
+				tc.policy.SpillDir = t.TempDir()
+			}
+			s, q := testQueue(t, tc.policy)
+			for _, p := range tc.pushes {
+				if p.ack {
+					q.push(testAck(s, p.n))
+				} else {
+					q.push(testPub(s, p.qos, 0, p.n))
+				}
+			}
+
+			got, overflow := testDrain(s, q)
+			if !reflect.DeepEqual(got, tc.want) || overflow != tc.overflow {
+				t.Fatalf(
+					"popped %v, %v, want %v, %v",
+					got, overflow, tc.want, tc.overflow,
+				)
+			}
+			if stats := s.QueueStats(); stats != tc.stats {
+				t.Fatalf("stats = %+v, want %+v", stats, tc.stats)
+			}
+		})
+	}
+}
+
+func TestQueueSpillRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, q := testQueue(t, QueuePolicy{
+		MaxMsgs:  2,
+		Overflow: QueueSpill,
+		SpillDir: dir,
+	})
+
+	for n := range uint32(4) {
+		q.push(testPub(s, 1, 0, n))
+	}
+
+	// once anything has been spilled, new packets go after it even when
+	// there's room in memory again
+	b, _, _ := q.pop()
+	s.bp.ReturnBuf(b)
+	q.push(testPub(s, 1, 0, 4))
+	if q.len() != 4 {
+		t.Fatalf("len = %d, want 4", q.len())
+	}
+	got, overflow := testDrain(s, q)
+	if want := []uint32{1, 2, 3, 4}; !reflect.DeepEqual(got, want) || overflow {
+		t.Fatalf("popped %v, %v, want %v", got, overflow, want)
+	}
+
+	// the file starts over once it's drained, and is reused
+	if q.spillW != 0 || q.spillR != 0 {
+		t.Fatalf("spill offsets %d, %d after draining", q.spillW, q.spillR)
+	}
+	for n := range uint32(3) {
+		q.push(testPub(s, 1, 0, 10+n))
+	}
+	got, _ = testDrain(s, q)
+	if want := []uint32{10, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("%d spill files, want 1", len(files))
+	}
+
+	// and removed when the queue is closed
+	q.close()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d spill files left after close", len(files))
+	}
+}
+
+func TestQueueSpillConcurrent(t *testing.T) {
+	const (
+		pushers = 4
+		each    = 200
+	)
+	s, q := testQueue(t, QueuePolicy{
+		MaxMsgs:  1,
+		Overflow: QueueSpill,
+		SpillDir: t.TempDir(),
+	})
+
+	wg := sync.WaitGroup{}
+	for p := range pushers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range each {
+				q.push(testPub(s, 0, byte(p), uint32(n)))
+			}
+		}()
+	}
+
+	// everything from each pusher comes out in the order it went in
+	next := make([]uint32, pushers)
+	for got := 0; got < pushers*each; {
+		b, ok, overflow := q.pop()
+		if overflow {
+			t.Fatalf("queue overflowed")
+		}
+		if !ok {
+			<-q.ready
+			continue
+		}
+		from, n := b[1], binary.BigEndian.Uint32(b[2:6])
+		if n != next[from] {
+			t.Fatalf("got %d from %d, want %d", n, from, next[from])
+		}
+		next[from] += 1
+		got += 1
+		s.bp.ReturnBuf(b)
+	}
+	wg.Wait()
+
+	if q.len() != 0 || s.QueueStats().Spilled == 0 {
+		t.Fatalf("%d left, %d spilled", q.len(), s.QueueStats().Spilled)
+	}
+}
@@ -0,0 +1,58 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Auth struct {
+	ReasonCode ReasonCode
+}
+
+var MalAuthPacket = errors.New("Malformed auth packet")
+
+func DecodeAuth(a *Auth, props *Properties, data []byte) error {
+	// no reason code or properties means success
+	if len(data) == 0 {
+		a.ReasonCode = S
+		return nil
+	}
+
+	a.ReasonCode = ReasonCode(data[0])
+	switch a.ReasonCode {
+	case S, CA, RA:
+	default:
+		return MalAuthPacket
+	}
+
+	if len(data) == 1 {
+		return nil
+	}
+	_, err := DecodeProps(props, AUTH, data[1:])
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalAuthPacket, err)
+	}
+
+	return nil
+}
+
+func EncodeAuth(
+	a *Auth,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(AUTH) << 4
+
+	scratch[0] = byte(a.ReasonCode)
+	sl := 1
+	sl += EncodeProps(props, scratch[sl:], buf[1:])
+	bl := encodeVarByteInt(buf[1:], sl)
+	copy(buf[bl+1:], scratch[:sl])
+
+	return bl + sl + 1
+}
+
+func (a *Auth) Zero() {
+	a.ReasonCode = 0
+}
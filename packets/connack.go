@@ -1,10 +1,35 @@
 package packets
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Connack struct {
-	sessionPresent bool
-	reasonCode     ReasonCode
+	SessionPresent bool
+	ReasonCode     ReasonCode
+}
+
+var MalConnackPacket = errors.New("Malformed connack packet")
+
+// with nil props, ReasonCode is the 3.1.1 return code as it was sent
+func DecodeConnack(c *Connack, props *Properties, data []byte) error {
+	if len(data) < 2 || data[0]&0b11111110 != 0 {
+		return MalConnackPacket
+	}
+	c.SessionPresent = data[0] == 1
+	c.ReasonCode = ReasonCode(data[1])
+
+	if props != nil {
+		_, err := DecodeProps(props, CONNACK, data[2:])
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalConnackPacket, err)
+		}
+	}
+	return nil
 }
 
+// with nil props, the reason code is sent as the closest 3.1.1 return code
 func EncodeConnack(
 	connack *Connack,
 	props *Properties,
@@ -15,21 +40,43 @@ func EncodeConnack(
 	buf[0] = 2 << 4
 
 	// encode variable header into scratch
-	if connack.sessionPresent {
+	if connack.SessionPresent {
 		scratch[0] = 1
 	} else {
 		scratch[0] = 0
 	}
-	scratch[1] = byte(connack.reasonCode)
 	sl := 2
-	sl += EncodeProps(props, scratch[sl:], buf[1:])
+	if props == nil {
+		scratch[1] = v311ConnackCode(connack.ReasonCode)
+	} else {
+		scratch[1] = byte(connack.ReasonCode)
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
 	bl := encodeVarByteInt(buf[1:], sl)
 	copy(buf[bl+1:], scratch[:sl])
 
 	return bl + sl + 1
 }
 
+// v311ConnackCode maps a reason code to one of the six 3.1.1 return codes
+func v311ConnackCode(rc ReasonCode) byte {
+	switch rc {
+	case S:
+		return 0
+	case UPV:
+		return 1 // unacceptable protocol version
+	case CInV:
+		return 2 // identifier rejected
+	case BUNoP:
+		return 4 // bad user name or password
+	case NA, B, BAM:
+		return 5 // not authorized
+	default:
+		return 3 // server unavailable
+	}
+}
+
 func (c *Connack) Zero() {
-	c.sessionPresent = false
-	c.reasonCode = 0
+	c.SessionPresent = false
+	c.ReasonCode = 0
 }
@@ -8,6 +8,7 @@ import (
 )
 
 type Connect struct {
+	Version     byte // protocol level, V31, V311 or V5
 	Id          strings.Builder
 	Username    strings.Builder
 	Password    []byte
@@ -34,14 +35,24 @@ func DecodeConnect(
 	if offset == -1 {
 		return MalConnPacket
 	}
-	if protocolName.String() != "MQTT" {
-		return fmt.Errorf("%v: %v", MalConnPacket, UnsupProtoc)
-	}
-
 	rest := data[offset:]
+	// protocol level, flags and keepalive
+	if len(rest) < 4 {
+		return MalConnPacket
+	}
+	connect.Version = rest[0]
 
-	if rest[0] != 5 {
-		return fmt.Errorf("%v: %v", MalConnPacket, UnsupProtocV)
+	switch protocolName.String() {
+	case "MQTT":
+		if connect.Version != V311 && connect.Version != V5 {
+			return fmt.Errorf("%w: %w", MalConnPacket, UnsupProtocV)
+		}
+	case "MQIsdp":
+		if connect.Version != V31 {
+			return fmt.Errorf("%w: %w", MalConnPacket, UnsupProtocV)
+		}
+	default:
+		return fmt.Errorf("%w: %w", MalConnPacket, UnsupProtoc)
 	}
 
 	connect.Flags = rest[1]
@@ -53,11 +64,14 @@ func DecodeConnect(
 	connect.Keepalive = binary.BigEndian.Uint16(rest[2:4])
 	rest = rest[4:]
 
-	offset = DecodeProps(props, rest)
-	if offset == -1 {
-		return MalConnPacket
+	// 3.1.1 has no properties, props and willProps are left alone
+	if connect.Version == V5 {
+		offset, err := DecodeProps(props, CONNECT, rest)
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalConnPacket, err)
+		}
+		rest = rest[offset:]
 	}
-	rest = rest[offset:]
 
 	// client id
 	offset = decodeUtf8(rest, &connect.Id)
@@ -68,11 +82,13 @@ func DecodeConnect(
 
 	// will props
 	if connect.Flags&0b00000100 != 0 {
-		offset = DecodeProps(willProps, rest)
-		if offset == -1 {
-			return MalConnPacket
+		if connect.Version == V5 {
+			offset, err := DecodeProps(willProps, willPropsType, rest)
+			if err != nil {
+				return fmt.Errorf("%w: will %w", MalConnPacket, err)
+			}
+			rest = rest[offset:]
 		}
-		rest = rest[offset:]
 
 		offset = decodeUtf8(rest, &connect.WillTopic)
 		if offset == -1 {
@@ -80,7 +96,10 @@ func DecodeConnect(
 		}
 		rest = rest[offset:]
 
-		offset = decodeBinary(rest, connect.WillPayload)
+		offset = decodeBinary(rest, &connect.WillPayload)
+		if offset == -1 {
+			return MalConnPacket
+		}
 		rest = rest[offset:]
 	}
 
@@ -95,12 +114,70 @@ func DecodeConnect(
 
 	// password
 	if connect.Flags&0b01000000 != 0 {
-		decodeBinary(rest, connect.Password)
+		offset = decodeBinary(rest, &connect.Password)
+		if offset == -1 {
+			return MalConnPacket
+		}
 	}
 	return nil
 }
 
+// EncodeConnect encodes connect for its Version, which is taken as V5 if
+// it's 0. Flags decides which of the optional fields get encoded, like it
+// does when decoding. props and willProps are only used for V5, and both
+// buf and scratch need to be big enough for the whole packet
+func EncodeConnect(
+	connect *Connect,
+	props *Properties,
+	willProps *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(CONNECT) << 4
+
+	version := connect.Version
+	if version == 0 {
+		version = V5
+	}
+	name := "MQTT"
+	if version == V31 {
+		name = "MQIsdp"
+	}
+
+	// encode variable header into scratch
+	sl := encodeUtf8(scratch, name)
+	scratch[sl] = version
+	scratch[sl+1] = connect.Flags
+	binary.BigEndian.PutUint16(scratch[sl+2:sl+4], connect.Keepalive)
+	sl += 4
+	if version == V5 {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
+
+	// and then the payload
+	sl += encodeUtf8(scratch[sl:], connect.Id.String())
+	if connect.Flags&0b00000100 != 0 {
+		if version == V5 {
+			sl += EncodeProps(willProps, scratch[sl:], buf[1:])
+		}
+		sl += encodeUtf8(scratch[sl:], connect.WillTopic.String())
+		sl += encodeBinary(scratch[sl:], connect.WillPayload)
+	}
+	if connect.Flags&0b10000000 != 0 {
+		sl += encodeUtf8(scratch[sl:], connect.Username.String())
+	}
+	if connect.Flags&0b01000000 != 0 {
+		sl += encodeBinary(scratch[sl:], connect.Password)
+	}
+
+	bl := encodeVarByteInt(buf[1:], sl)
+	copy(buf[bl+1:], scratch[:sl])
+
+	return bl + sl + 1
+}
+
 func (c *Connect) Zero() {
+	c.Version = 0
 	c.Username.Reset()
 	clear(c.Password)
 	c.Password = c.Password[:0]
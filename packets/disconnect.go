@@ -0,0 +1,60 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Disconnect struct {
+	ReasonCode ReasonCode
+}
+
+var MalDisconnPacket = errors.New("Malformed disconnect packet")
+
+// with nil props, there's nothing to decode, 3.1.1 DISCONNECTs are empty
+func DecodeDisconnect(d *Disconnect, props *Properties, data []byte) error {
+	// no reason code means normal disconnection
+	if len(data) == 0 {
+		d.ReasonCode = ND
+		return nil
+	}
+	if props == nil {
+		return MalDisconnPacket
+	}
+
+	d.ReasonCode = ReasonCode(data[0])
+	if len(data) == 1 {
+		return nil
+	}
+	_, err := DecodeProps(props, DISCONNECT, data[1:])
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalDisconnPacket, err)
+	}
+
+	return nil
+}
+
+// with nil props, the DISCONNECT is sent empty like 3.1.1's
+func EncodeDisconnect(
+	d *Disconnect,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(DISCONNECT) << 4
+
+	sl := 0
+	if props != nil {
+		scratch[0] = byte(d.ReasonCode)
+		sl += 1
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
+	bl := encodeVarByteInt(buf[1:], sl)
+	copy(buf[bl+1:], scratch[:sl])
+
+	return bl + sl + 1
+}
+
+func (d *Disconnect) Zero() {
+	d.ReasonCode = 0
+}
@@ -7,6 +7,9 @@ type FixedHeader struct {
 }
 
 func DecodeFixedHeader(fh *FixedHeader, data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
 	fh.Pt = PacketType(data[0] >> 4)
 	fh.Flags = data[0] & 0b00001111
 
@@ -59,6 +62,8 @@ func (pt PacketType) String() string {
 		return "Publish"
 	case PUBACK:
 		return "Puback"
+	case PUBREC:
+		return "Pubrec"
 	case PUBREL:
 		return "Pubrel"
 	case PUBCOMP:
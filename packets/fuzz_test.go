@@ -0,0 +1,266 @@
+package packets
+
+import "testing"
+
+// the decoders get handed whatever a client sends, so none of them can
+// panic. anything they accept has to encode again, and decode again from
+// that, without problems. the seed corpus is in testdata/fuzz
+
+// fuzzBufs gives buf and scratch big enough to reencode something decoded
+// from data
+func fuzzBufs(data []byte) ([]byte, []byte) {
+	return make([]byte, 2*len(data)+64), make([]byte, 2*len(data)+64)
+}
+
+// fuzzProps gives the props to decode with, nil for 3.1.1
+func fuzzProps(v5 bool) *Properties {
+	if !v5 {
+		return nil
+	}
+	return newProps()
+}
+
+func FuzzDecodeFixedHeader(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, data)
+		if off == -1 {
+			return
+		}
+		if off > len(data) || off > 5 {
+			t.Fatalf("offset %d for %d bytes", off, len(data))
+		}
+
+		buf := make([]byte, 5)
+		n := encodeVarByteInt(buf, int(fh.RemLen))
+		got, off := decodeVarByteInt(buf[:n])
+		if off != n || got != fh.RemLen {
+			t.Fatalf("remaining length %d came back as %d", fh.RemLen, got)
+		}
+	})
+}
+
+func FuzzDecodeProps(f *testing.F) {
+	f.Fuzz(func(t *testing.T, pt byte, data []byte) {
+		// any packet type, or will properties
+		packetType := PacketType(pt % byte(willPropsType+1))
+		props := newProps()
+		off, err := DecodeProps(props, packetType, data)
+		voff, verr := ValidateProps(packetType, data)
+		if (err == nil) != (verr == nil) || voff != off {
+			t.Fatalf("decode: %d, %v, validate: %d, %v", off, err, voff, verr)
+		}
+		if err != nil {
+			return
+		}
+		if off > len(data) {
+			t.Fatalf("offset %d for %d bytes", off, len(data))
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeProps(props, buf, scratch)
+		off, err = DecodeProps(newProps(), packetType, buf[:n])
+		if err != nil || off != n {
+			t.Fatalf("reencoded props don't decode: %v, %v", buf[:n], err)
+		}
+	})
+}
+
+func FuzzDecodeConnect(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		connect := Connect{}
+		connect.Zero()
+		props, willProps := newProps(), newProps()
+		if DecodeConnect(&connect, data, props, willProps) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeConnect(&connect, props, willProps, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		again := Connect{}
+		again.Zero()
+		err := DecodeConnect(&again, buf[off:n], newProps(), newProps())
+		if err != nil {
+			t.Fatalf("reencoded connect doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeConnack(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		connack := Connack{}
+		props := fuzzProps(v5)
+		if DecodeConnack(&connack, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeConnack(&connack, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeConnack(&Connack{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded connack doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodePublish(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, flags byte, data []byte) {
+		fh := FixedHeader{Pt: PUBLISH, Flags: flags & 0b1111}
+		publish := Publish{}
+		publish.Zero()
+		props := fuzzProps(v5)
+		if DecodePublish(&fh, &publish, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodePublish(&fh, &publish, props, buf, scratch)
+		off := DecodeFixedHeader(&fh, buf[:n])
+		again := Publish{}
+		again.Zero()
+		err := DecodePublish(&fh, &again, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded publish doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodePuback(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		puback := Puback{}
+		props := fuzzProps(v5)
+		if DecodePuback(&puback, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodePuback(&puback, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodePuback(&Puback{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded puback doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeSubscribe(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		sub := Subscribe{}
+		sub.Zero()
+		props := fuzzProps(v5)
+		if DecodeSubscribe(&sub, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeSubscribe(&sub, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		again := Subscribe{}
+		again.Zero()
+		err := DecodeSubscribe(&again, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded subscribe doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeSuback(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		suback := Suback{}
+		props := fuzzProps(v5)
+		if DecodeSuback(&suback, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeSuback(&suback, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeSuback(&Suback{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded suback doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeUnsubscribe(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		unsub := Unsubscribe{}
+		props := fuzzProps(v5)
+		if DecodeUnsubscribe(&unsub, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeUnsubscribe(&unsub, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeUnsubscribe(&Unsubscribe{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded unsubscribe doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeUnsuback(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		unsuback := Unsuback{}
+		props := fuzzProps(v5)
+		if DecodeUnsuback(&unsuback, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeUnsuback(&unsuback, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeUnsuback(&Unsuback{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded unsuback doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeDisconnect(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, data []byte) {
+		disconnect := Disconnect{}
+		props := fuzzProps(v5)
+		if DecodeDisconnect(&disconnect, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeDisconnect(&disconnect, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeDisconnect(&Disconnect{}, fuzzProps(v5), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded disconnect doesn't decode: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeAuth(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		auth := Auth{}
+		props := newProps()
+		if DecodeAuth(&auth, props, data) != nil {
+			return
+		}
+
+		buf, scratch := fuzzBufs(data)
+		n := EncodeAuth(&auth, props, buf, scratch)
+		fh := FixedHeader{}
+		off := DecodeFixedHeader(&fh, buf[:n])
+		err := DecodeAuth(&Auth{}, newProps(), buf[off:n])
+		if err != nil {
+			t.Fatalf("reencoded auth doesn't decode: %v", err)
+		}
+	})
+}
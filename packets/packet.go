@@ -5,13 +5,16 @@
  - figure out what we want to do about reseting strings
    (kinda thinking we should just use a byte slice
     or maybe there's some helpful stuff in the standard lib)
- - we're gonna do everything with copy, but we need to add bounds checks and stuff
+   views (view.go) read PUBLISH in place, the other packets could get them
+   too if they turn out to matter
+ - we're gonna do everything with copy
 
 */
 
 package packets
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"strings"
@@ -19,13 +22,13 @@ import (
 )
 
 type StringPair struct {
-	name strings.Builder
-	val  strings.Builder
+	Name strings.Builder
+	Val  strings.Builder
 }
 
 func (sp *StringPair) zero() {
-	sp.name.Reset()
-	sp.val.Reset()
+	sp.Name.Reset()
+	sp.Val.Reset()
 }
 
 type ReasonCode byte
@@ -78,6 +81,18 @@ const (
 	WSnS  ReasonCode = 162 // Wildcard subscriptions not supported
 )
 
+// protocol levels, as they show up in a CONNECT
+const (
+	V31  byte = 3 // with the protocol name MQIsdp
+	V311 byte = 4
+	V5   byte = 5
+)
+
+// MQTT 3.1.1 packets are the same as 5's without properties or most of the
+// reason codes, so the decode and encode functions take nil props to mean
+// the 3.1.1 form of their packet. 3.1 packets are the same as 3.1.1's as far
+// as the server is concerned
+
 const multMax uint32 = 128 * 128 * 128
 
 func decodeVarByteInt(data []byte) (uint32, int) {
@@ -90,6 +105,10 @@ func decodeVarByteInt(data []byte) (uint32, int) {
 			return val, -1
 		}
 
+		if i >= len(data) {
+			return val, -1
+		}
+
 		b := data[i]
 		// PERF: making a u32 every time, maybe can keep things at byte level
 		val += uint32(b&127) * mult
@@ -120,10 +139,14 @@ func encodeVarByteInt(buf []byte, num int) int {
 
 var InvalidUtf8 = errors.New("Invalid utf8 string")
 
+// decoders never index into data without checking its length first, so
+// malformed packets come back as errors instead of panics. the helpers here
+// return -1 when data is too short, or otherwise bad
+
 // str must be empty when passed to this function
 func decodeUtf8(data []byte, str *strings.Builder) int {
-	// check for safe slice indexing
-	if len(data) <= 2 {
+	// check for safe slice indexing, an empty string is just its length
+	if len(data) < 2 {
 		return -1
 	}
 	l := int(binary.BigEndian.Uint16(data[0:2]))
@@ -133,8 +156,9 @@ func decodeUtf8(data []byte, str *strings.Builder) int {
 
 	off := 2
 	for off < l+2 {
-		r, size := utf8.DecodeRune(data[off:])
-		if r == utf8.RuneError {
+		// a rune can't run past the end of the string
+		r, size := utf8.DecodeRune(data[off : l+2])
+		if r == utf8.RuneError && size <= 1 {
 			return -1
 		}
 		// NOTE: looks like go already throws out U+D800 and U+DFFF,
@@ -151,6 +175,23 @@ func decodeUtf8(data []byte, str *strings.Builder) int {
 	return off
 }
 
+// viewUtf8 is decodeUtf8 without the copy, the string is returned as a slice
+// of data
+func viewUtf8(data []byte) ([]byte, int) {
+	if len(data) < 2 {
+		return nil, -1
+	}
+	l := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < l+2 {
+		return nil, -1
+	}
+	str := data[2 : l+2]
+	if !utf8.Valid(str) || bytes.IndexByte(str, 0) != -1 {
+		return nil, -1
+	}
+	return str, l + 2
+}
+
 // TODO: think about if we want to take a string builder here
 func encodeUtf8(data []byte, str string) int {
 	binary.BigEndian.PutUint16(data[:2], uint16(len(str)))
@@ -158,8 +199,30 @@ func encodeUtf8(data []byte, str string) int {
 	return 2 + len(str)
 }
 
-func decodeBinary(data []byte, buf []byte) int {
-	l := binary.BigEndian.Uint16(data[0:2])
-	buf = append(buf, data[2:l+2]...)
-	return int(l) + 2
+func encodeBinary(data []byte, b []byte) int {
+	binary.BigEndian.PutUint16(data[:2], uint16(len(b)))
+	copy(data[2:2+len(b)], b)
+	return 2 + len(b)
+}
+
+// decoded data gets appended to buf
+func decodeBinary(data []byte, buf *[]byte) int {
+	b, l := viewBinary(data)
+	if l == -1 {
+		return -1
+	}
+	*buf = append(*buf, b...)
+	return l
+}
+
+// viewBinary is decodeBinary without the copy, like viewUtf8
+func viewBinary(data []byte) ([]byte, int) {
+	if len(data) < 2 {
+		return nil, -1
+	}
+	l := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < l+2 {
+		return nil, -1
+	}
+	return data[2 : l+2], l + 2
 }
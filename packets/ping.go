@@ -0,0 +1,34 @@
+package packets
+
+import "errors"
+
+// PINGREQ and PINGRESP are only a fixed header, so there's nothing to them
+// but checking that they're empty
+
+var MalPingPacket = errors.New("Malformed ping packet")
+
+func EncodePingreq(buf []byte) int {
+	buf[0] = byte(PINGREQ) << 4
+	buf[1] = 0
+	return 2
+}
+
+func DecodePingreq(data []byte) error {
+	if len(data) != 0 {
+		return MalPingPacket
+	}
+	return nil
+}
+
+func EncodePingresp(buf []byte) int {
+	buf[0] = byte(PINGRESP) << 4
+	buf[1] = 0
+	return 2
+}
+
+func DecodePingresp(data []byte) error {
+	if len(data) != 0 {
+		return MalPingPacket
+	}
+	return nil
+}
@@ -3,7 +3,7 @@ package packets
 import (
 	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
 	"strings"
 )
 
@@ -42,140 +42,328 @@ type Properties struct {
 	Mq byte // maximum qos
 }
 
-var MalProps = errors.New("Malformed properties")
-var InvalidPropId = errors.New("Invalid property identifier")
+var (
+	MalProps       = errors.New("Malformed properties")
+	InvalidPropId  = errors.New("Invalid property identifier")
+	PropNotAllowed = errors.New("Property not allowed in packet")
+	DupProp        = errors.New("Duplicate property")
+	InvalidPropVal = errors.New("Invalid property value")
+)
+
+// PropsReasonCode gives the reason code to reject a packet whose properties
+// failed to decode with err. the spec makes repeated properties and bad
+// values protocol errors, everything else is a malformed packet
+func PropsReasonCode(err error) ReasonCode {
+	if errors.Is(err, DupProp) || errors.Is(err, InvalidPropVal) {
+		return PE
+	}
+	return MP
+}
+
+// will properties aren't a packet of their own, but they have their own
+// rules, so they get a type for DecodeProps past the real ones
+const willPropsType PacketType = AUTH + 1
+
+func packetTypes(pts ...PacketType) uint32 {
+	var set uint32
+	for _, pt := range pts {
+		set |= 1 << pt
+	}
+	return set
+}
 
-func DecodeProps(p *Properties, data []byte) int {
+type propRule struct {
+	// how many bytes the value takes, 0 for strings, binary data and var byte
+	// ints, which check their own lengths
+	len int
+	// the packet types the property can be in
+	in uint32
+}
+
+// propRules are indexed by property identifier, ones that aren't in here
+// don't exist
+var propRules = [...]propRule{
+	// payload format indicator
+	1: {1, packetTypes(PUBLISH, willPropsType)},
+	// message expiry interval
+	2: {4, packetTypes(PUBLISH, willPropsType)},
+	// content type
+	3: {0, packetTypes(PUBLISH, willPropsType)},
+	// response topic
+	8: {0, packetTypes(PUBLISH, willPropsType)},
+	// correlation data
+	9: {0, packetTypes(PUBLISH, willPropsType)},
+	// subscription identifier
+	11: {0, packetTypes(PUBLISH, SUBSCRIBE)},
+	// session expiry interval
+	17: {4, packetTypes(CONNECT, CONNACK, DISCONNECT)},
+	// assigned client identifier
+	18: {0, packetTypes(CONNACK)},
+	// server keep alive
+	19: {2, packetTypes(CONNACK)},
+	// authentication method
+	21: {0, packetTypes(CONNECT, CONNACK, AUTH)},
+	// authentication data
+	22: {0, packetTypes(CONNECT, CONNACK, AUTH)},
+	// request problem information
+	23: {1, packetTypes(CONNECT)},
+	// will delay interval
+	24: {4, packetTypes(willPropsType)},
+	// request response information
+	25: {1, packetTypes(CONNECT)},
+	// response information
+	26: {0, packetTypes(CONNACK)},
+	// server reference
+	28: {0, packetTypes(CONNACK, DISCONNECT)},
+	// reason string
+	31: {0, packetTypes(
+		CONNACK,
+		PUBACK,
+		PUBREC,
+		PUBREL,
+		PUBCOMP,
+		SUBACK,
+		UNSUBACK,
+		DISCONNECT,
+		AUTH,
+	)},
+	// receive maximum
+	33: {2, packetTypes(CONNECT, CONNACK)},
+	// topic alias maximum
+	34: {2, packetTypes(CONNECT, CONNACK)},
+	// topic alias
+	35: {2, packetTypes(PUBLISH)},
+	// maximum qos
+	36: {1, packetTypes(CONNACK)},
+	// retain available
+	37: {1, packetTypes(CONNACK)},
+	// user property
+	38: {0, packetTypes(
+		CONNECT,
+		CONNACK,
+		PUBLISH,
+		willPropsType,
+		PUBACK,
+		PUBREC,
+		PUBREL,
+		PUBCOMP,
+		SUBSCRIBE,
+		SUBACK,
+		UNSUBSCRIBE,
+		UNSUBACK,
+		DISCONNECT,
+		AUTH,
+	)},
+	// maximum packet size
+	39: {4, packetTypes(CONNECT, CONNACK)},
+	// wildcard subscription available
+	40: {1, packetTypes(CONNACK)},
+	// subscription identifier available
+	41: {1, packetTypes(CONNACK)},
+	// shared subscription available
+	42: {1, packetTypes(CONNACK)},
+}
+
+// DecodeProps decodes the properties of a packet of type pt, returning how
+// many bytes they took. properties that pt can't have, ones that show up more
+// than once when they can't, and values the spec doesn't allow are all
+// errors, see PropsReasonCode for what to reject the packet with
+func DecodeProps(p *Properties, pt PacketType, data []byte) (int, error) {
+	return decodeProps(p, nil, pt, data)
+}
+
+// ValidateProps checks the properties of a packet of type pt just like
+// DecodeProps does, without decoding them into anything
+func ValidateProps(pt PacketType, data []byte) (int, error) {
+	return decodeProps(nil, nil, pt, data)
+}
+
+// decodeProps reads everything in place, and only copies it out into p if
+// there is one. present gets a bit set for each property identifier that
+// showed up, if it isn't nil
+func decodeProps(
+	p *Properties,
+	present *uint64,
+	pt PacketType,
+	data []byte,
+) (int, error) {
 	l, offset := decodeVarByteInt(data)
 	if offset == -1 {
-		return -1
+		return 0, MalProps
 	}
 
 	end := offset + int(l)
+	if end > len(data) {
+		return 0, MalProps
+	}
+	// so nothing can be read past the end of the properties
+	data = data[:end]
+	var seen uint64
 	for offset < end {
-		switch data[offset] {
-		case 1: // payload format indicator
-			p.Pfi = data[offset+1]
-			offset += 2
-		case 2: // message expiry interval
-			p.Mei = binary.BigEndian.Uint32(data[offset+1 : offset+5])
-			offset += 5
-		case 3: // content type
-			off := decodeUtf8(data[offset+1:], &p.Ct)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
-		case 8: // response topic
-			off := decodeUtf8(data[offset+1:], &p.Rt)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
-		case 9: // correlation data
-			off := decodeBinary(data[offset+1:], p.Cd)
-			offset += off + 1
+		id := int(data[offset])
+		if id >= len(propRules) || propRules[id].in == 0 {
+			return 0, fmt.Errorf("%w: %d", InvalidPropId, id)
+		}
+		rule := propRules[id]
+		if rule.in&(1<<pt) == 0 {
+			return 0, fmt.Errorf("%w: %d in %s", PropNotAllowed, id, pt)
+		}
+		// user properties can repeat, and so can subscription identifiers
+		// in a PUBLISH, one for each subscription it matched
+		// TODO: keep all the subscription identifiers
+		if seen&(1<<id) != 0 && id != 38 && !(id == 11 && pt == PUBLISH) {
+			return 0, fmt.Errorf("%w: %d", DupProp, id)
+		}
+		seen |= 1 << id
+		if offset+1+rule.len > end {
+			return 0, MalProps
+		}
+
+		// the values of fixed size properties
+		var val propVal
+		switch rule.len {
+		case 1:
+			val.b = data[offset+1]
+		case 2:
+			val.u16 = binary.BigEndian.Uint16(data[offset+1 : offset+3])
+		case 4:
+			val.u32 = binary.BigEndian.Uint32(data[offset+1 : offset+5])
+		}
+		// bytes that can only be 0 or 1
+		if rule.len == 1 && id != 36 && val.b > 1 {
+			return 0, fmt.Errorf("%w: %d can't be %d", InvalidPropVal, id, val.b)
+		}
+
+		// the rest get read and checked here
+		off := rule.len
+		switch id {
+		case 3, 8, 18, 21, 26, 28, 31: // utf8 strings
+			val.str, off = viewUtf8(data[offset+1:])
+		case 9, 22: // binary data
+			val.str, off = viewBinary(data[offset+1:])
 		case 11: // subscription identifier
-			si, off := decodeVarByteInt(data[offset+1:])
-			if off == -1 {
-				return -1
-			}
-			p.Si = si
-			offset += off + 1
-		case 17: // session expiry interval
-			p.Sei = binary.BigEndian.Uint32(data[offset+1 : offset+5])
-			offset += 5
-		case 18: // assigned client identifier
-			off := decodeUtf8(data[offset+1:], &p.Aci)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
-		case 19: // server keep alive
-			p.Ska = binary.BigEndian.Uint16(data[offset+1 : offset+3])
-			offset += 3
-		case 21: // authentication method
-			off := decodeUtf8(data[offset+1:], &p.Am)
-			if off == -1 {
-				return -1
+			val.u32, off = decodeVarByteInt(data[offset+1:])
+			if off != -1 && val.u32 == 0 {
+				return 0, fmt.Errorf("%w: subscription identifier 0", InvalidPropVal)
 			}
-			offset += off + 1
-		case 22: // authentication data
-			off := decodeBinary(data[offset+1:], p.Ad)
-			offset += off + 1
-		case 23: // request problem information
-			p.Rpi = data[offset+1]
-			offset += 2
-		case 24: // will delay interval
-			p.Wdi = binary.BigEndian.Uint32(data[offset+1 : offset+5])
-			offset += 5
-		case 25: // request response information
-			p.Rri = data[offset+1]
-			offset += 2
-		case 26: // response information
-			off := decodeUtf8(data[offset+1:], &p.Ri)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
-		case 28: // server reference
-			off := decodeUtf8(data[offset+1:], &p.Sr)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
-		case 31: // reason string
-			off := decodeUtf8(data[offset+1:], &p.Rs)
-			if off == -1 {
-				return -1
-			}
-			offset += off + 1
 		case 33: // receive maximum
-			p.Rm = binary.BigEndian.Uint16(data[offset+1 : offset+3])
-			offset += 3
-		case 34: // topic alias maximum
-			p.Tam = binary.BigEndian.Uint16(data[offset+1 : offset+3])
-			offset += 3
+			if val.u16 == 0 {
+				return 0, fmt.Errorf("%w: receive maximum 0", InvalidPropVal)
+			}
 		case 35: // topic alias
-			p.Ta = binary.BigEndian.Uint16(data[offset+1 : offset+3])
-			offset += 3
+			if val.u16 == 0 {
+				return 0, fmt.Errorf("%w: topic alias 0", InvalidPropVal)
+			}
 		case 36: // maximum qos
-			p.Mq = data[offset+1]
-			offset += 2
-		case 37: // retain available
-			p.Ra = data[offset+1]
-			offset += 2
-		case 38: // user property
-			var sp StringPair
-			off := decodeUtf8(data[offset+1:], &sp.name)
-			if off == -1 {
-				return -1
+			if val.b > 1 {
+				return 0, fmt.Errorf("%w: maximum qos %d", InvalidPropVal, val.b)
 			}
-			offset += off + 1
-			off = decodeUtf8(data[offset:], &sp.val)
-			if off == -1 {
-				return -1
+		case 38: // user property
+			val.str, off = viewUtf8(data[offset+1:])
+			if off != -1 {
+				var voff int
+				val.val, voff = viewUtf8(data[offset+1+off:])
+				if voff == -1 {
+					off = -1
+				} else {
+					off += voff
+				}
 			}
-			offset += off + 1
-			p.Up = append(p.Up, sp)
 		case 39: // maximum packet size
-			p.Mps = binary.BigEndian.Uint32(data[offset+1 : offset+5])
-			offset += 5
-		case 40: // wildcard subscription available
-			p.Wsa = data[offset+1]
-			offset += 2
-		case 41: // subscription identifier available
-			p.Sia = data[offset+1]
-			offset += 2
-		case 42: // shared subscription available
-			p.Ssa = data[offset+1]
-			offset += 2
-		default:
-			log.Fatalf("bad prop code: %d\n", data[offset])
+			if val.u32 == 0 {
+				return 0, fmt.Errorf("%w: maximum packet size 0", InvalidPropVal)
+			}
+		}
+		if off == -1 {
+			return 0, MalProps
 		}
+		if p != nil {
+			p.set(id, &val)
+		}
+		offset += off + 1
 	}
 
-	return offset
+	if present != nil {
+		*present = seen
+	}
+	return offset, nil
+}
+
+// propVal is a property's value, pointing into the packet for the variable
+// length ones
+type propVal struct {
+	b   byte
+	u16 uint16
+	u32 uint32
+	str []byte // also binary data, and user property names
+	val []byte // user property values
+}
+
+// set copies a checked value out of the packet into p
+func (p *Properties) set(id int, v *propVal) {
+	switch id {
+	case 1: // payload format indicator
+		p.Pfi = v.b
+	case 2: // message expiry interval
+		p.Mei = v.u32
+	case 3: // content type
+		p.Ct.Write(v.str)
+	case 8: // response topic
+		p.Rt.Write(v.str)
+	case 9: // correlation data
+		p.Cd = append(p.Cd, v.str...)
+	case 11: // subscription identifier
+		// keep the first one
+		if p.Si == 0 {
+			p.Si = v.u32
+		}
+	case 17: // session expiry interval
+		p.Sei = v.u32
+	case 18: // assigned client identifier
+		p.Aci.Write(v.str)
+	case 19: // server keep alive
+		p.Ska = v.u16
+	case 21: // authentication method
+		p.Am.Write(v.str)
+	case 22: // authentication data
+		p.Ad = append(p.Ad, v.str...)
+	case 23: // request problem information
+		p.Rpi = v.b
+	case 24: // will delay interval
+		p.Wdi = v.u32
+	case 25: // request response information
+		p.Rri = v.b
+	case 26: // response information
+		p.Ri.Write(v.str)
+	case 28: // server reference
+		p.Sr.Write(v.str)
+	case 31: // reason string
+		p.Rs.Write(v.str)
+	case 33: // receive maximum
+		p.Rm = v.u16
+	case 34: // topic alias maximum
+		p.Tam = v.u16
+	case 35: // topic alias
+		p.Ta = v.u16
+	case 36: // maximum qos
+		p.Mq = v.b
+	case 37: // retain available
+		p.Ra = v.b
+	case 38: // user property
+		// write in place, builders can't be copied once written to
+		p.Up = append(p.Up, StringPair{})
+		sp := &p.Up[len(p.Up)-1]
+		sp.Name.Write(v.str)
+		sp.Val.Write(v.val)
+	case 39: // maximum packet size
+		p.Mps = v.u32
+	case 40: // wildcard subscription available
+		p.Wsa = v.b
+	case 41: // subscription identifier available
+		p.Sia = v.b
+	case 42: // shared subscription available
+		p.Ssa = v.b
+	}
 }
 
 func EncodeProps(p *Properties, buf []byte, scratch []byte) int {
@@ -226,11 +414,12 @@ func EncodeProps(p *Properties, buf []byte, scratch []byte) int {
 		ll := encodeUtf8(scratch[l+1:], p.Ri.String())
 		l += ll + 1
 	}
-	for _, up := range p.Up {
+	// user properties have to stay in the order they were added
+	for i := range p.Up {
 		scratch[l] = 38
-		lln := encodeUtf8(scratch[l+1:], up.name.String())
-		llv := encodeUtf8(scratch[lln+1:], up.val.String())
-		l += lln + llv + 1
+		l += 1
+		l += encodeUtf8(scratch[l:], p.Up[i].Name.String())
+		l += encodeUtf8(scratch[l:], p.Up[i].Val.String())
 	}
 	if p.Sei != 0 {
 		scratch[l] = 17
@@ -274,13 +463,14 @@ func EncodeProps(p *Properties, buf []byte, scratch []byte) int {
 	}
 	if len(p.Cd) != 0 {
 		scratch[l] = 9
-		copy(scratch[l+1:], p.Cd)
-		l += len(p.Cd) + 1
+		binary.BigEndian.PutUint16(scratch[l+1:l+3], uint16(len(p.Cd)))
+		copy(scratch[l+3:], p.Cd)
+		l += len(p.Cd) + 3
 	}
 	if p.Si != 0 {
 		scratch[l] = 11
-		binary.BigEndian.PutUint32(scratch[l+1:l+5], p.Si)
-		l += 5
+		ll := encodeVarByteInt(scratch[l+1:], int(p.Si))
+		l += ll + 1
 	}
 	if p.Ta != 0 {
 		scratch[l] = 35
@@ -359,3 +549,37 @@ func (p *Properties) Zero() {
 
 	p.Mq = 2
 }
+
+// CopyPublish copies the properties that get forwarded on a PUBLISH from
+// from into p, which should be zeroed. subscription identifiers and topic
+// aliases only mean something on the connection they came in on, so they're
+// left out along with everything that can't go on a PUBLISH at all
+func (p *Properties) CopyPublish(from *Properties) {
+	p.Pfi = from.Pfi
+	p.Mei = from.Mei
+	p.Ct.WriteString(from.Ct.String())
+	p.Rt.WriteString(from.Rt.String())
+	p.Cd = append(p.Cd, from.Cd...)
+	for i := range from.Up {
+		p.AddUserProp(from.Up[i].Name.String(), from.Up[i].Val.String())
+	}
+}
+
+// AddUserProp appends a user property, keeping the order they were added in
+func (p *Properties) AddUserProp(name string, val string) {
+	p.Up = append(p.Up, StringPair{})
+	sp := &p.Up[len(p.Up)-1]
+	sp.Name.WriteString(name)
+	sp.Val.WriteString(val)
+}
+
+// UserProp returns the value of the first user property with the given name,
+// user properties can repeat, so range over Up if you need all of them
+func (p *Properties) UserProp(name string) (string, bool) {
+	for i := range p.Up {
+		if p.Up[i].Name.String() == name {
+			return p.Up[i].Val.String(), true
+		}
+	}
+	return "", false
+}
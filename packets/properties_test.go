@@ -0,0 +1,112 @@
+package packets
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecodePropsRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pt   PacketType
+		data []byte
+		err  error
+		rc   ReasonCode
+	}{
+		{"allowed", CONNECT, []byte{5, 17, 0, 0, 0, 60}, nil, S},
+		{"will", willPropsType, []byte{5, 24, 0, 0, 0, 5}, nil, S},
+		{"not allowed", PUBLISH, []byte{5, 17, 0, 0, 0, 60}, PropNotAllowed, MP},
+		{"will only", CONNECT, []byte{5, 24, 0, 0, 0, 5}, PropNotAllowed, MP},
+		{"invalid id", PUBLISH, []byte{2, 0x7f, 0}, InvalidPropId, MP},
+		{"duplicate", PUBLISH, []byte{4, 1, 1, 1, 1}, DupProp, PE},
+		{"user props repeat", PUBACK, []byte{
+			11,
+			38, 0, 1, 'k', 0, 0,
+			38, 0, 0, 0, 0,
+		}, nil, S},
+		{"subscription ids repeat in publish", PUBLISH, []byte{4, 11, 1, 11, 2}, nil, S},
+		{"subscription ids don't in subscribe", SUBSCRIBE, []byte{4, 11, 1, 11, 2}, DupProp, PE},
+		{"subscription id 0", SUBSCRIBE, []byte{2, 11, 0}, InvalidPropVal, PE},
+		{"receive maximum 0", CONNECT, []byte{3, 33, 0, 0}, InvalidPropVal, PE},
+		{"maximum packet size 0", CONNECT, []byte{5, 39, 0, 0, 0, 0}, InvalidPropVal, PE},
+		{"topic alias 0", PUBLISH, []byte{3, 35, 0, 0}, InvalidPropVal, PE},
+		{"maximum qos 1", CONNACK, []byte{2, 36, 1}, nil, S},
+		{"maximum qos 2", CONNACK, []byte{2, 36, 2}, InvalidPropVal, PE},
+		{"payload format 2", PUBLISH, []byte{2, 1, 2}, InvalidPropVal, PE},
+		{"request problem information 2", CONNECT, []byte{2, 23, 2}, InvalidPropVal, PE},
+		{"truncated", PUBLISH, []byte{2, 2, 0}, MalProps, MP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			props := newProps()
+			_, err := DecodeProps(props, tc.pt, tc.data)
+			if _, verr := ValidateProps(tc.pt, tc.data); !errors.Is(verr, tc.err) {
+				t.Fatalf("validate err = %v, want %v", verr, tc.err)
+			}
+			if tc.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if rc := PropsReasonCode(err); rc != tc.rc {
+				t.Fatalf("reason code = %d, want %d", rc, tc.rc)
+			}
+		})
+	}
+}
+
+func TestDecodePropsErrorsWrapped(t *testing.T) {
+	// the packet decoders keep the property error, so the broker can pick
+	// the reason code
+	p := Puback{}
+	err := DecodePuback(&p, newProps(), []byte{0, 1, 0, 4, 1, 1, 1, 1})
+	if !errors.Is(err, MalPubackPacket) || !errors.Is(err, PropNotAllowed) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCopyPublish(t *testing.T) {
+	from := newProps()
+	from.Pfi = 1
+	from.Mei = 30
+	from.Ct.WriteString("text/plain")
+	from.Rt.WriteString("replies")
+	from.Cd = []byte{1, 2}
+	from.AddUserProp("k", "v")
+	from.Si = 5
+	from.Ta = 1
+	from.Sei = 60
+	from.Rs.WriteString("reason")
+	from.Wsa = 0
+	from.Mq = 1
+
+	want := newProps()
+	want.Pfi = 1
+	want.Mei = 30
+	want.Ct.WriteString("text/plain")
+	want.Rt.WriteString("replies")
+	want.Cd = []byte{1, 2}
+	want.AddUserProp("k", "v")
+
+	got := newProps()
+	got.CopyPublish(from)
+	encode := func(p *Properties) []byte {
+		buf := make([]byte, 128)
+		n := EncodeProps(p, buf, make([]byte, 128))
+		return buf[:n]
+	}
+	if !bytes.Equal(encode(got), encode(want)) {
+		t.Fatalf("copy = %x, want %x", encode(got), encode(want))
+	}
+
+	// nothing is shared with from
+	got.Cd[0] = 9
+	got.Up[0].Val.WriteString("2")
+	if from.Cd[0] != 1 || from.Up[0].Val.String() != "v" {
+		t.Fatalf("copy shares with from")
+	}
+}
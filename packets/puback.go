@@ -1,26 +1,105 @@
 package packets
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 type Puback struct {
-	reasonCode ReasonCode
-	packetId   uint16
+	ReasonCode ReasonCode
+	PacketId   uint16
 }
 
+var (
+	MalPubackPacket = errors.New("Malformed puback packet")
+
+	errAckLen = errors.New("wrong length")
+)
+
+// with nil props, the reason code is left off, 3.1.1 doesn't have it
 func EncodePuback(
 	p *Puback,
 	props *Properties,
 	buf []byte,
 	scratch []byte,
 ) int {
-	buf[0] = 0b01000000
+	return encodeAck(PUBACK, 0, p.PacketId, p.ReasonCode, props, buf, scratch)
+}
+
+// with nil props, the reason code is always S, 3.1.1 doesn't have it
+func DecodePuback(p *Puback, props *Properties, data []byte) error {
+	var err error
+	p.PacketId, p.ReasonCode, err = decodeAck(PUBACK, props, data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubackPacket, err)
+	}
+	return nil
+}
 
-	binary.BigEndian.PutUint16(scratch, p.packetId)
-	scratch[2] = byte(p.reasonCode)
-	sl := 3
-	sl += EncodeProps(props, scratch[sl:], buf[1:])
+func (p *Puback) Zero() {
+	p.ReasonCode = 0
+	p.PacketId = 0
+}
+
+// PUBACK, PUBREC, PUBREL and PUBCOMP all look the same other than their
+// type, so they share these
+
+func encodeAck(
+	pt PacketType,
+	flags byte,
+	packetId uint16,
+	rc ReasonCode,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(pt)<<4 | flags
+
+	binary.BigEndian.PutUint16(scratch, packetId)
+	sl := 2
+	if props != nil {
+		scratch[2] = byte(rc)
+		sl += 1
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
 	bl := encodeVarByteInt(buf[1:], sl)
 	copy(buf[bl+1:], scratch[:sl])
 
 	return bl + sl + 1
 }
+
+func decodeAck(
+	pt PacketType,
+	props *Properties,
+	data []byte,
+) (uint16, ReasonCode, error) {
+	if len(data) < 2 {
+		return 0, 0, errAckLen
+	}
+	packetId := binary.BigEndian.Uint16(data[0:2])
+
+	if props == nil {
+		if len(data) != 2 {
+			return 0, 0, errAckLen
+		}
+		return packetId, S, nil
+	}
+	// the reason code can be left off when it's 0, and the properties when
+	// there aren't any
+	if len(data) == 2 {
+		return packetId, S, nil
+	}
+	rc := ReasonCode(data[2])
+	if len(data) == 3 {
+		return packetId, rc, nil
+	}
+	off, err := DecodeProps(props, pt, data[3:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if off+3 != len(data) {
+		return 0, 0, errAckLen
+	}
+	return packetId, rc, nil
+}
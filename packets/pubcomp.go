@@ -0,0 +1,38 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Pubcomp struct {
+	ReasonCode ReasonCode
+	PacketId   uint16
+}
+
+var MalPubcompPacket = errors.New("Malformed pubcomp packet")
+
+// with nil props, the reason code is left off, 3.1.1 doesn't have it
+func EncodePubcomp(
+	p *Pubcomp,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	return encodeAck(PUBCOMP, 0, p.PacketId, p.ReasonCode, props, buf, scratch)
+}
+
+// with nil props, the reason code is always S, 3.1.1 doesn't have it
+func DecodePubcomp(p *Pubcomp, props *Properties, data []byte) error {
+	var err error
+	p.PacketId, p.ReasonCode, err = decodeAck(PUBCOMP, props, data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubcompPacket, err)
+	}
+	return nil
+}
+
+func (p *Pubcomp) Zero() {
+	p.ReasonCode = 0
+	p.PacketId = 0
+}
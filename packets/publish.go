@@ -3,6 +3,7 @@ package packets
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -30,24 +31,55 @@ func DecodePublish(
 
 	if fh.Flags&0b00000010 > 0 || fh.Flags&0b00000100 > 0 {
 		// extract packet id
+		if len(rest) < 2 {
+			return MalPubPacket
+		}
 		publish.PacketId = binary.BigEndian.Uint16(rest[:2])
 		rest = rest[2:]
 		l += 2
 	}
 
-	off := DecodeProps(props, rest)
-	if off == -1 {
-		return MalPubPacket
+	if props != nil {
+		off, err := DecodeProps(props, PUBLISH, rest)
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalPubPacket, err)
+		}
+		rest = rest[off:]
+		l += off
 	}
-
-	rest = rest[off:]
-	l += off
 	// TODO: would like copying here
 	publish.Payload = append(publish.Payload, rest...)
 
 	return nil
 }
 
+// buf needs to be big enough for the whole packet, including the payload
+func EncodePublish(
+	fh *FixedHeader,
+	publish *Publish,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(PUBLISH)<<4 | fh.Flags&0b00001111
+
+	// encode variable header into scratch
+	sl := encodeUtf8(scratch, publish.Topic.String())
+	if fh.Flags&0b00000010 > 0 || fh.Flags&0b00000100 > 0 {
+		binary.BigEndian.PutUint16(scratch[sl:sl+2], publish.PacketId)
+		sl += 2
+	}
+	if props != nil {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
+
+	bl := encodeVarByteInt(buf[1:], sl+len(publish.Payload))
+	copy(buf[bl+1:], scratch[:sl])
+	copy(buf[bl+sl+1:], publish.Payload)
+
+	return bl + sl + len(publish.Payload) + 1
+}
+
 func (p *Publish) Zero() {
 	p.Topic.Reset()
 	p.PacketId = 0
@@ -0,0 +1,38 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Pubrec struct {
+	ReasonCode ReasonCode
+	PacketId   uint16
+}
+
+var MalPubrecPacket = errors.New("Malformed pubrec packet")
+
+// with nil props, the reason code is left off, 3.1.1 doesn't have it
+func EncodePubrec(
+	p *Pubrec,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	return encodeAck(PUBREC, 0, p.PacketId, p.ReasonCode, props, buf, scratch)
+}
+
+// with nil props, the reason code is always S, 3.1.1 doesn't have it
+func DecodePubrec(p *Pubrec, props *Properties, data []byte) error {
+	var err error
+	p.PacketId, p.ReasonCode, err = decodeAck(PUBREC, props, data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubrecPacket, err)
+	}
+	return nil
+}
+
+func (p *Pubrec) Zero() {
+	p.ReasonCode = 0
+	p.PacketId = 0
+}
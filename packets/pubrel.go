@@ -0,0 +1,47 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Pubrel struct {
+	ReasonCode ReasonCode
+	PacketId   uint16
+}
+
+var MalPubrelPacket = errors.New("Malformed pubrel packet")
+
+// with nil props, the reason code is left off, 3.1.1 doesn't have it. the
+// fixed header flags of a PUBREL are always 0b0010
+func EncodePubrel(
+	p *Pubrel,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	return encodeAck(
+		PUBREL,
+		0b0010,
+		p.PacketId,
+		p.ReasonCode,
+		props,
+		buf,
+		scratch,
+	)
+}
+
+// with nil props, the reason code is always S, 3.1.1 doesn't have it
+func DecodePubrel(p *Pubrel, props *Properties, data []byte) error {
+	var err error
+	p.PacketId, p.ReasonCode, err = decodeAck(PUBREL, props, data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubrelPacket, err)
+	}
+	return nil
+}
+
+func (p *Pubrel) Zero() {
+	p.ReasonCode = 0
+	p.PacketId = 0
+}
@@ -0,0 +1,698 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+// every packet gets encoded, decoded, and then encoded again, both
+// encodings have to be the same, and the fields we care about have to
+// survive the trip
+
+func roundTrip(
+	t *testing.T,
+	pt PacketType,
+	encode func(buf, scratch []byte) int,
+	decode func(fh *FixedHeader, data []byte) error,
+	reencode func(buf, scratch []byte) int,
+) {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	scratch := make([]byte, 1024)
+	n := encode(buf, scratch)
+	first := append([]byte(nil), buf[:n]...)
+
+	fh := FixedHeader{}
+	offset := DecodeFixedHeader(&fh, first)
+	if offset == -1 {
+		t.Fatal("decoding fixed header failed")
+	}
+	if fh.Pt != pt {
+		t.Fatalf("packet type = %s, want %s", fh.Pt, pt)
+	}
+	if int(fh.RemLen) != n-offset {
+		t.Fatalf("remaining length = %d, want %d", fh.RemLen, n-offset)
+	}
+
+	err := decode(&fh, first[offset:])
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	clear(buf)
+	clear(scratch)
+	n = reencode(buf, scratch)
+	if !bytes.Equal(first, buf[:n]) {
+		t.Fatalf("reencoded\n%v\nwant\n%v", buf[:n], first)
+	}
+}
+
+func testProps() *Properties {
+	props := &Properties{}
+	props.Zero()
+	props.AddUserProp("k", "v")
+	props.AddUserProp("k", "v2")
+	return props
+}
+
+func newProps() *Properties {
+	props := &Properties{}
+	props.Zero()
+	return props
+}
+
+// versionProps gives the props to encode and decode with, nil for 3.1.1
+func versionProps(v5 bool, props *Properties) *Properties {
+	if !v5 {
+		return nil
+	}
+	return props
+}
+
+var versions = []struct {
+	name string
+	v5   bool
+}{
+	{"v5", true},
+	{"v311", false},
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	for _, version := range []byte{V5, V311, V31} {
+		t.Run(string('0'+version), func(t *testing.T) {
+			in := Connect{}
+			in.Zero()
+			in.Version = version
+			in.Keepalive = 30
+			// clean start, will with qos 1 and retain, username and password
+			in.Flags = 0b11101110
+			in.Id.WriteString("client")
+			in.Username.WriteString("user")
+			in.Password = []byte("pass")
+			in.WillTopic.WriteString("will/topic")
+			in.WillPayload = []byte("gone")
+			props := testProps()
+			props.Sei = 60
+			props.Rm = 10
+			willProps := testProps()
+			willProps.Wdi = 5
+
+			out := Connect{}
+			out.Zero()
+			outProps := newProps()
+			outWillProps := newProps()
+			roundTrip(
+				t,
+				CONNECT,
+				func(buf, scratch []byte) int {
+					return EncodeConnect(&in, props, willProps, buf, scratch)
+				},
+				func(_ *FixedHeader, data []byte) error {
+					return DecodeConnect(&out, data, outProps, outWillProps)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeConnect(
+						&out,
+						outProps,
+						outWillProps,
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.Version != version ||
+				out.Id.String() != "client" ||
+				out.Username.String() != "user" ||
+				string(out.Password) != "pass" ||
+				out.WillTopic.String() != "will/topic" ||
+				string(out.WillPayload) != "gone" ||
+				out.Keepalive != 30 ||
+				out.Flags != in.Flags {
+				t.Fatalf("decoded connect doesn't match")
+			}
+			if version == V5 && (outProps.Sei != 60 || outWillProps.Wdi != 5) {
+				t.Fatalf("decoded connect props don't match")
+			}
+		})
+	}
+}
+
+func TestConnackRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Connack{SessionPresent: true, ReasonCode: S}
+			props := testProps()
+			props.Aci.WriteString("assigned")
+
+			out := Connack{}
+			outProps := newProps()
+			roundTrip(
+				t,
+				CONNACK,
+				func(buf, scratch []byte) int {
+					return EncodeConnack(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(_ *FixedHeader, data []byte) error {
+					return DecodeConnack(&out, versionProps(v.v5, outProps), data)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeConnack(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if !out.SessionPresent || out.ReasonCode != S {
+				t.Fatalf("decoded connack doesn't match")
+			}
+			if v.v5 && outProps.Aci.String() != "assigned" {
+				t.Fatalf("decoded connack props don't match")
+			}
+		})
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		for _, qos := range []byte{0, 1, 2} {
+			t.Run(v.name+"/qos"+string('0'+qos), func(t *testing.T) {
+				inFh := FixedHeader{Flags: qos<<1 | 1}
+				in := Publish{}
+				in.Zero()
+				in.Topic.WriteString("a/b")
+				in.Payload = []byte("hello")
+				if qos > 0 {
+					in.PacketId = 7
+				}
+				props := testProps()
+				props.Ct.WriteString("text/plain")
+
+				out := Publish{}
+				out.Zero()
+				outProps := newProps()
+				var outFh FixedHeader
+				roundTrip(
+					t,
+					PUBLISH,
+					func(buf, scratch []byte) int {
+						return EncodePublish(
+							&inFh,
+							&in,
+							versionProps(v.v5, props),
+							buf,
+							scratch,
+						)
+					},
+					func(fh *FixedHeader, data []byte) error {
+						outFh = *fh
+						return DecodePublish(
+							fh,
+							&out,
+							versionProps(v.v5, outProps),
+							data,
+						)
+					},
+					func(buf, scratch []byte) int {
+						return EncodePublish(
+							&outFh,
+							&out,
+							versionProps(v.v5, outProps),
+							buf,
+							scratch,
+						)
+					},
+				)
+
+				if out.Topic.String() != "a/b" ||
+					string(out.Payload) != "hello" ||
+					out.PacketId != in.PacketId ||
+					outFh.Flags != inFh.Flags {
+					t.Fatalf("decoded publish doesn't match")
+				}
+				if v.v5 && outProps.Ct.String() != "text/plain" {
+					t.Fatalf("decoded publish props don't match")
+				}
+			})
+		}
+	}
+}
+
+// ack is what PUBACK, PUBREC, PUBREL and PUBCOMP have in common
+type ack struct {
+	pt     PacketType
+	encode func(id uint16, rc ReasonCode, props *Properties, buf, scratch []byte) int
+	decode func(props *Properties, data []byte) (uint16, ReasonCode, error)
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	acks := []ack{
+		{
+			PUBACK,
+			func(id uint16, rc ReasonCode, props *Properties, buf, scratch []byte) int {
+				return EncodePuback(&Puback{rc, id}, props, buf, scratch)
+			},
+			func(props *Properties, data []byte) (uint16, ReasonCode, error) {
+				p := Puback{}
+				err := DecodePuback(&p, props, data)
+				return p.PacketId, p.ReasonCode, err
+			},
+		},
+		{
+			PUBREC,
+			func(id uint16, rc ReasonCode, props *Properties, buf, scratch []byte) int {
+				return EncodePubrec(&Pubrec{rc, id}, props, buf, scratch)
+			},
+			func(props *Properties, data []byte) (uint16, ReasonCode, error) {
+				p := Pubrec{}
+				err := DecodePubrec(&p, props, data)
+				return p.PacketId, p.ReasonCode, err
+			},
+		},
+		{
+			PUBREL,
+			func(id uint16, rc ReasonCode, props *Properties, buf, scratch []byte) int {
+				return EncodePubrel(&Pubrel{rc, id}, props, buf, scratch)
+			},
+			func(props *Properties, data []byte) (uint16, ReasonCode, error) {
+				p := Pubrel{}
+				err := DecodePubrel(&p, props, data)
+				return p.PacketId, p.ReasonCode, err
+			},
+		},
+		{
+			PUBCOMP,
+			func(id uint16, rc ReasonCode, props *Properties, buf, scratch []byte) int {
+				return EncodePubcomp(&Pubcomp{rc, id}, props, buf, scratch)
+			},
+			func(props *Properties, data []byte) (uint16, ReasonCode, error) {
+				p := Pubcomp{}
+				err := DecodePubcomp(&p, props, data)
+				return p.PacketId, p.ReasonCode, err
+			},
+		},
+	}
+
+	for _, a := range acks {
+		for _, v := range versions {
+			t.Run(a.pt.String()+"/"+v.name, func(t *testing.T) {
+				rc := PInF
+				if !v.v5 {
+					rc = S
+				}
+				props := testProps()
+				props.Rs.WriteString("reason")
+
+				var id uint16
+				var outRc ReasonCode
+				outProps := newProps()
+				roundTrip(
+					t,
+					a.pt,
+					func(buf, scratch []byte) int {
+						return a.encode(
+							300,
+							rc,
+							versionProps(v.v5, props),
+							buf,
+							scratch,
+						)
+					},
+					func(fh *FixedHeader, data []byte) error {
+						if a.pt == PUBREL && fh.Flags != 0b0010 {
+							t.Fatalf("pubrel flags = %04b", fh.Flags)
+						}
+						var err error
+						id, outRc, err = a.decode(
+							versionProps(v.v5, outProps),
+							data,
+						)
+						return err
+					},
+					func(buf, scratch []byte) int {
+						return a.encode(
+							id,
+							outRc,
+							versionProps(v.v5, outProps),
+							buf,
+							scratch,
+						)
+					},
+				)
+
+				if id != 300 || outRc != rc {
+					t.Fatalf("decoded %s doesn't match", a.pt)
+				}
+				if v.v5 && outProps.Rs.String() != "reason" {
+					t.Fatalf("decoded %s props don't match", a.pt)
+				}
+			})
+		}
+	}
+}
+
+func TestAckShortForms(t *testing.T) {
+	// the reason code and properties can be left off in v5
+	p := Puback{}
+	err := DecodePuback(&p, newProps(), []byte{0, 1})
+	if err != nil || p.PacketId != 1 || p.ReasonCode != S {
+		t.Fatalf("puback without reason code: %+v, %v", p, err)
+	}
+	err = DecodePuback(&p, newProps(), []byte{0, 2, byte(NMS)})
+	if err != nil || p.PacketId != 2 || p.ReasonCode != NMS {
+		t.Fatalf("puback without props: %+v, %v", p, err)
+	}
+	err = DecodePuback(&p, nil, []byte{0, 1, 0})
+	if err == nil {
+		t.Fatalf("3.1.1 puback with a reason code should fail")
+	}
+}
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Subscribe{}
+			in.Zero()
+			in.PacketId = 9
+			in.TopicFilters = make([]TopicFilter, 2)
+			in.TopicFilters[0].Filter.WriteString("a/+")
+			in.TopicFilters[0].Qos = 1
+			in.TopicFilters[1].Filter.WriteString("b/#")
+			in.TopicFilters[1].Qos = 2
+			if v.v5 {
+				in.TopicFilters[1].NoLocal = true
+				in.TopicFilters[1].RetainAsPublished = true
+				in.TopicFilters[1].RetainHandling = 2
+			}
+			props := testProps()
+			props.Si = 12
+
+			out := Subscribe{}
+			out.Zero()
+			outProps := newProps()
+			roundTrip(
+				t,
+				SUBSCRIBE,
+				func(buf, scratch []byte) int {
+					return EncodeSubscribe(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(fh *FixedHeader, data []byte) error {
+					if fh.Flags != 0b0010 {
+						t.Fatalf("subscribe flags = %04b", fh.Flags)
+					}
+					return DecodeSubscribe(
+						&out,
+						versionProps(v.v5, outProps),
+						data,
+					)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeSubscribe(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.PacketId != 9 || len(out.TopicFilters) != 2 {
+				t.Fatalf("decoded subscribe doesn't match")
+			}
+			for i := range in.TopicFilters {
+				want, got := &in.TopicFilters[i], &out.TopicFilters[i]
+				if want.Filter.String() != got.Filter.String() ||
+					want.Qos != got.Qos ||
+					want.NoLocal != got.NoLocal ||
+					want.RetainAsPublished != got.RetainAsPublished ||
+					want.RetainHandling != got.RetainHandling {
+					t.Fatalf("decoded topic filter %d doesn't match", i)
+				}
+			}
+			if v.v5 && outProps.Si != 12 {
+				t.Fatalf("decoded subscribe props don't match")
+			}
+		})
+	}
+}
+
+func TestSubackRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Suback{PacketId: 9, ReasonCodes: []byte{byte(GQ1), 0x80}}
+			if v.v5 {
+				in.ReasonCodes[1] = byte(NA)
+			}
+			props := testProps()
+
+			out := Suback{}
+			out.Zero()
+			outProps := newProps()
+			roundTrip(
+				t,
+				SUBACK,
+				func(buf, scratch []byte) int {
+					return EncodeSuback(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(_ *FixedHeader, data []byte) error {
+					return DecodeSuback(&out, versionProps(v.v5, outProps), data)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeSuback(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.PacketId != 9 || !bytes.Equal(out.ReasonCodes, in.ReasonCodes) {
+				t.Fatalf("decoded suback doesn't match")
+			}
+		})
+	}
+}
+
+func TestUnsubscribeRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Unsubscribe{PacketId: 4, TopicFilters: []string{"a/+", "b/#"}}
+			props := testProps()
+
+			out := Unsubscribe{}
+			out.Zero()
+			outProps := newProps()
+			roundTrip(
+				t,
+				UNSUBSCRIBE,
+				func(buf, scratch []byte) int {
+					return EncodeUnsubscribe(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(fh *FixedHeader, data []byte) error {
+					if fh.Flags != 0b0010 {
+						t.Fatalf("unsubscribe flags = %04b", fh.Flags)
+					}
+					return DecodeUnsubscribe(
+						&out,
+						versionProps(v.v5, outProps),
+						data,
+					)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeUnsubscribe(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.PacketId != 4 ||
+				len(out.TopicFilters) != 2 ||
+				out.TopicFilters[0] != "a/+" ||
+				out.TopicFilters[1] != "b/#" {
+				t.Fatalf("decoded unsubscribe doesn't match")
+			}
+		})
+	}
+}
+
+func TestUnsubackRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Unsuback{PacketId: 4}
+			if v.v5 {
+				in.ReasonCodes = []byte{byte(S), byte(NSE)}
+			}
+			props := testProps()
+			props.Rs.WriteString("reason")
+
+			out := Unsuback{}
+			out.Zero()
+			outProps := newProps()
+			roundTrip(
+				t,
+				UNSUBACK,
+				func(buf, scratch []byte) int {
+					return EncodeUnsuback(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(_ *FixedHeader, data []byte) error {
+					return DecodeUnsuback(
+						&out,
+						versionProps(v.v5, outProps),
+						data,
+					)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeUnsuback(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.PacketId != 4 || !bytes.Equal(out.ReasonCodes, in.ReasonCodes) {
+				t.Fatalf("decoded unsuback doesn't match")
+			}
+		})
+	}
+}
+
+func TestPingRoundTrip(t *testing.T) {
+	for _, ping := range []struct {
+		pt     PacketType
+		encode func(buf []byte) int
+		decode func(data []byte) error
+	}{
+		{PINGREQ, EncodePingreq, DecodePingreq},
+		{PINGRESP, EncodePingresp, DecodePingresp},
+	} {
+		t.Run(ping.pt.String(), func(t *testing.T) {
+			encode := func(buf, _ []byte) int { return ping.encode(buf) }
+			roundTrip(
+				t,
+				ping.pt,
+				encode,
+				func(_ *FixedHeader, data []byte) error {
+					return ping.decode(data)
+				},
+				encode,
+			)
+			if ping.decode([]byte{0}) == nil {
+				t.Fatalf("%s with a body should fail", ping.pt)
+			}
+		})
+	}
+}
+
+func TestDisconnectRoundTrip(t *testing.T) {
+	for _, v := range versions {
+		t.Run(v.name, func(t *testing.T) {
+			in := Disconnect{ReasonCode: ND}
+			if v.v5 {
+				in.ReasonCode = SSD
+			}
+			props := testProps()
+			props.Sr.WriteString("other.host")
+
+			out := Disconnect{}
+			outProps := newProps()
+			roundTrip(
+				t,
+				DISCONNECT,
+				func(buf, scratch []byte) int {
+					return EncodeDisconnect(
+						&in,
+						versionProps(v.v5, props),
+						buf,
+						scratch,
+					)
+				},
+				func(_ *FixedHeader, data []byte) error {
+					return DecodeDisconnect(
+						&out,
+						versionProps(v.v5, outProps),
+						data,
+					)
+				},
+				func(buf, scratch []byte) int {
+					return EncodeDisconnect(
+						&out,
+						versionProps(v.v5, outProps),
+						buf,
+						scratch,
+					)
+				},
+			)
+
+			if out.ReasonCode != in.ReasonCode {
+				t.Fatalf("decoded disconnect doesn't match")
+			}
+			if v.v5 && outProps.Sr.String() != "other.host" {
+				t.Fatalf("decoded disconnect props don't match")
+			}
+		})
+	}
+}
+
+func TestAuthRoundTrip(t *testing.T) {
+	in := Auth{ReasonCode: CA}
+	props := testProps()
+	props.Am.WriteString("SCRAM-SHA-1")
+	props.Ad = []byte{1, 2, 3}
+
+	out := Auth{}
+	outProps := newProps()
+	roundTrip(
+		t,
+		AUTH,
+		func(buf, scratch []byte) int {
+			return EncodeAuth(&in, props, buf, scratch)
+		},
+		func(_ *FixedHeader, data []byte) error {
+			return DecodeAuth(&out, outProps, data)
+		},
+		func(buf, scratch []byte) int {
+			return EncodeAuth(&out, outProps, buf, scratch)
+		},
+	)
+
+	if out.ReasonCode != CA ||
+		outProps.Am.String() != "SCRAM-SHA-1" ||
+		!bytes.Equal(outProps.Ad, props.Ad) {
+		t.Fatalf("decoded auth doesn't match")
+	}
+}
@@ -1,12 +1,20 @@
 package packets
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 type Suback struct {
 	PacketId    uint16
 	ReasonCodes []byte
 }
 
+var MalSubackPacket = errors.New("Malformed suback packet")
+
+// with nil props, failure reason codes are all sent as the 3.1.1 failure
+// return code
 func EncodeSuback(
 	p *Suback,
 	props *Properties,
@@ -17,8 +25,15 @@ func EncodeSuback(
 
 	binary.BigEndian.PutUint16(scratch[0:2], p.PacketId)
 	sl := 2
-	sl += EncodeProps(props, scratch[sl:], buf[1:])
-	copy(scratch[sl:], p.ReasonCodes)
+	if props != nil {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+		copy(scratch[sl:], p.ReasonCodes)
+	} else {
+		for i, rc := range p.ReasonCodes {
+			// 3.1.1 only has the granted qos and 0x80 for failure
+			scratch[sl+i] = min(rc, 0x80)
+		}
+	}
 	sl += len(p.ReasonCodes)
 
 	bl := encodeVarByteInt(buf[1:], sl)
@@ -27,6 +42,26 @@ func EncodeSuback(
 	return bl + sl + 1
 }
 
+// with nil props, the reason codes are the 3.1.1 return codes
+func DecodeSuback(p *Suback, props *Properties, data []byte) error {
+	if len(data) < 2 {
+		return MalSubackPacket
+	}
+	p.PacketId = binary.BigEndian.Uint16(data[0:2])
+	rest := data[2:]
+
+	if props != nil {
+		offset, err := DecodeProps(props, SUBACK, rest)
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalSubackPacket, err)
+		}
+		rest = rest[offset:]
+	}
+	p.ReasonCodes = append(p.ReasonCodes, rest...)
+
+	return nil
+}
+
 func (p *Suback) Zero() {
 	p.PacketId = 0
 	clear(p.ReasonCodes)
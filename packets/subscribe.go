@@ -3,41 +3,57 @@ package packets
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strings"
 )
 
 type Subscribe struct {
 	TopicFilters []TopicFilter
-	PackedId     uint16
+	PacketId     uint16
 }
 
+// the fields other than Filter and Qos are subscription options 3.1.1
+// doesn't have, so they're left as zero for it
 type TopicFilter struct {
-	Filter  strings.Builder
-	NoLocal bool
+	Filter            strings.Builder
+	Qos               byte
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
 }
 
 var MalSubPacket = errors.New("Malformed subscribe packet")
 
 func DecodeSubscribe(s *Subscribe, props *Properties, data []byte) error {
-	s.PackedId = binary.BigEndian.Uint16(data[0:2])
+	if len(data) < 2 {
+		return MalSubPacket
+	}
+	s.PacketId = binary.BigEndian.Uint16(data[0:2])
 	rest := data[2:]
 
-	offset := DecodeProps(props, rest)
-	if offset == -1 {
-		return MalSubPacket
+	if props != nil {
+		offset, err := DecodeProps(props, SUBSCRIBE, rest)
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalSubPacket, err)
+		}
+		rest = rest[offset:]
 	}
-	rest = rest[offset:]
 
-	offset = 0
+	offset := 0
 	for offset < len(rest) {
 		var tf TopicFilter
 		// decode topic filters
 		off := decodeUtf8(rest[offset:], &tf.Filter)
-		if off == -1 {
+		if off == -1 || offset+off >= len(rest) {
 			return MalSubPacket
 		}
 		opts := rest[offset+off]
-		tf.NoLocal = (opts & 0b00000100) != 0
+		tf.Qos = opts & 0b00000011
+		if props != nil {
+			tf.NoLocal = (opts & 0b00000100) != 0
+			tf.RetainAsPublished = (opts & 0b00001000) != 0
+			tf.RetainHandling = (opts >> 4) & 0b11
+		}
 		s.TopicFilters = append(
 			s.TopicFilters,
 			tf,
@@ -48,8 +64,45 @@ func DecodeSubscribe(s *Subscribe, props *Properties, data []byte) error {
 	return nil
 }
 
+// with nil props, only the qos of each filter's options is sent
+func EncodeSubscribe(
+	s *Subscribe,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(SUBSCRIBE)<<4 | 0b0010
+
+	binary.BigEndian.PutUint16(scratch[0:2], s.PacketId)
+	sl := 2
+	if props != nil {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
+	for i := range s.TopicFilters {
+		tf := &s.TopicFilters[i]
+		sl += encodeUtf8(scratch[sl:], tf.Filter.String())
+		opts := tf.Qos & 0b11
+		if props != nil {
+			if tf.NoLocal {
+				opts |= 0b00000100
+			}
+			if tf.RetainAsPublished {
+				opts |= 0b00001000
+			}
+			opts |= (tf.RetainHandling & 0b11) << 4
+		}
+		scratch[sl] = opts
+		sl += 1
+	}
+
+	bl := encodeVarByteInt(buf[1:], sl)
+	copy(buf[bl+1:], scratch[:sl])
+
+	return bl + sl + 1
+}
+
 func (s *Subscribe) Zero() {
-	s.PackedId = 0
+	s.PacketId = 0
 	clear(s.TopicFilters)
 	s.TopicFilters = s.TopicFilters[:0]
 }
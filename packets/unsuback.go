@@ -1,12 +1,19 @@
 package packets
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 type Unsuback struct {
 	PacketId    uint16
 	ReasonCodes []byte
 }
 
+var MalUnsubackPacket = errors.New("Malformed unsuback packet")
+
+// with nil props, the reason codes are left off, 3.1.1 doesn't have them
 func EncodeUnsuback(
 	u *Unsuback,
 	props *Properties,
@@ -17,9 +24,11 @@ func EncodeUnsuback(
 
 	binary.BigEndian.PutUint16(scratch[0:2], u.PacketId)
 	sl := 2
-	sl += EncodeProps(props, scratch[sl:], buf[1:])
-	copy(scratch[sl:], u.ReasonCodes)
-	sl += len(u.ReasonCodes)
+	if props != nil {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+		copy(scratch[sl:], u.ReasonCodes)
+		sl += len(u.ReasonCodes)
+	}
 
 	bl := encodeVarByteInt(buf[1:], sl)
 	copy(buf[bl+1:], scratch[:sl])
@@ -27,6 +36,29 @@ func EncodeUnsuback(
 	return bl + sl + 1
 }
 
+// with nil props, there aren't any reason codes to decode
+func DecodeUnsuback(u *Unsuback, props *Properties, data []byte) error {
+	if len(data) < 2 {
+		return MalUnsubackPacket
+	}
+	u.PacketId = binary.BigEndian.Uint16(data[0:2])
+	rest := data[2:]
+
+	if props == nil {
+		if len(rest) != 0 {
+			return MalUnsubackPacket
+		}
+		return nil
+	}
+	offset, err := DecodeProps(props, UNSUBACK, rest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalUnsubackPacket, err)
+	}
+	u.ReasonCodes = append(u.ReasonCodes, rest[offset:]...)
+
+	return nil
+}
+
 func (u *Unsuback) Zero() {
 	u.PacketId = 0
 	clear(u.ReasonCodes)
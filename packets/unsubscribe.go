@@ -3,6 +3,7 @@ package packets
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -14,16 +15,21 @@ type Unsubscribe struct {
 var MalUnsubPacket = errors.New("Malformed unsubscribe packet")
 
 func DecodeUnsubscribe(u *Unsubscribe, props *Properties, data []byte) error {
+	if len(data) < 2 {
+		return MalUnsubPacket
+	}
 	u.PacketId = binary.BigEndian.Uint16(data[0:2])
 	rest := data[2:]
 
-	offset := DecodeProps(props, rest)
-	if offset == -1 {
-		return MalUnsubPacket
+	if props != nil {
+		offset, err := DecodeProps(props, UNSUBSCRIBE, rest)
+		if err != nil {
+			return fmt.Errorf("%w: %w", MalUnsubPacket, err)
+		}
+		rest = rest[offset:]
 	}
-	rest = rest[offset:]
 
-	offset = 0
+	offset := 0
 	for offset < len(rest) {
 		var tf strings.Builder
 		off := decodeUtf8(rest[offset:], &tf)
@@ -41,6 +47,29 @@ func DecodeUnsubscribe(u *Unsubscribe, props *Properties, data []byte) error {
 	return nil
 }
 
+func EncodeUnsubscribe(
+	u *Unsubscribe,
+	props *Properties,
+	buf []byte,
+	scratch []byte,
+) int {
+	buf[0] = byte(UNSUBSCRIBE)<<4 | 0b0010
+
+	binary.BigEndian.PutUint16(scratch[0:2], u.PacketId)
+	sl := 2
+	if props != nil {
+		sl += EncodeProps(props, scratch[sl:], buf[1:])
+	}
+	for _, tf := range u.TopicFilters {
+		sl += encodeUtf8(scratch[sl:], tf)
+	}
+
+	bl := encodeVarByteInt(buf[1:], sl)
+	copy(buf[bl+1:], scratch[:sl])
+
+	return bl + sl + 1
+}
+
 func (u *Unsubscribe) Zero() {
 	u.PacketId = 0
 	clear(u.TopicFilters)
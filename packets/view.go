@@ -0,0 +1,128 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// views read a packet where it sits in the buffer it came in, instead of
+// copying it out into builders and slices like the decoders do. everything
+// a view returns points into that buffer, so it's only good for as long as
+// the buffer is, and mustn't be changed
+
+// PublishView is a PUBLISH read in place, for routing and forwarding
+// messages without decoding them
+type PublishView struct {
+	flags    byte
+	topic    []byte
+	packetId uint16
+	props    []byte
+	payload  []byte
+
+	// which property identifiers are in props, once they've been checked
+	present uint64
+}
+
+// DecodePublishView checks that data is a well formed PUBLISH and points v
+// at its parts. with v5 false it's read as a 3.1.1 PUBLISH, which doesn't
+// have properties. the properties only get checked for their length here,
+// DecodeProps checks the rest
+func DecodePublishView(
+	v *PublishView,
+	fh *FixedHeader,
+	data []byte,
+	v5 bool,
+) error {
+	v.flags = fh.Flags
+
+	topic, l := viewUtf8(data)
+	if l == -1 {
+		return MalPubPacket
+	}
+	v.topic = topic
+	rest := data[l:]
+
+	v.packetId = 0
+	if fh.Flags&0b00000010 > 0 || fh.Flags&0b00000100 > 0 {
+		if len(rest) < 2 {
+			return MalPubPacket
+		}
+		v.packetId = binary.BigEndian.Uint16(rest[:2])
+		rest = rest[2:]
+	}
+
+	v.props = nil
+	v.present = 0
+	if v5 {
+		pl, off := decodeVarByteInt(rest)
+		if off == -1 || off+int(pl) > len(rest) {
+			return MalPubPacket
+		}
+		v.props = rest[:off+int(pl)]
+		rest = rest[off+int(pl):]
+	}
+	v.payload = rest
+
+	return nil
+}
+
+func (v *PublishView) Topic() []byte {
+	return v.topic
+}
+
+func (v *PublishView) Qos() byte {
+	return (v.flags >> 1) & 0b11
+}
+
+// PacketId is 0 for qos 0 messages, they don't have one
+func (v *PublishView) PacketId() uint16 {
+	return v.packetId
+}
+
+func (v *PublishView) Payload() []byte {
+	return v.payload
+}
+
+// Props are the encoded properties, length and all, nil for 3.1.1
+func (v *PublishView) Props() []byte {
+	return v.props
+}
+
+// ValidateProps checks the properties where they are, like ValidateProps.
+// for 3.1.1 there aren't any
+func (v *PublishView) ValidateProps() error {
+	if v.props == nil {
+		return nil
+	}
+	_, err := decodeProps(nil, &v.present, PUBLISH, v.props)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubPacket, err)
+	}
+	return nil
+}
+
+// DecodeProps decodes the properties into p, copying them out like any
+// other DecodeProps. for 3.1.1 there aren't any, and p is left alone
+func (v *PublishView) DecodeProps(p *Properties) error {
+	if v.props == nil {
+		return nil
+	}
+	_, err := decodeProps(p, &v.present, PUBLISH, v.props)
+	if err != nil {
+		return fmt.Errorf("%w: %w", MalPubPacket, err)
+	}
+	return nil
+}
+
+// HasSubscriptionId is whether the properties have a subscription
+// identifier, which only servers can send. false until the properties have
+// been checked
+func (v *PublishView) HasSubscriptionId() bool {
+	return v.present&(1<<11) != 0
+}
+
+// HasTopicAlias is whether the properties have a topic alias, false until
+// the properties have been checked
+func (v *PublishView) HasTopicAlias() bool {
+	return v.present&(1<<35) != 0
+}
@@ -0,0 +1,223 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+// encodedPublish is the body of a PUBLISH like the broker sees all the
+// time, along with its fixed header
+func encodedPublish(qos byte, v5 bool) (FixedHeader, []byte) {
+	fh := FixedHeader{Pt: PUBLISH, Flags: qos << 1}
+	pub := Publish{Payload: make([]byte, 64)}
+	pub.Topic.WriteString("bench/room1/temp")
+	if qos > 0 {
+		pub.PacketId = 7
+	}
+	props := newProps()
+	props.Ct.WriteString("application/json")
+
+	buf := make([]byte, 256)
+	scratch := make([]byte, 256)
+	n := EncodePublish(&fh, &pub, versionProps(v5, props), buf, scratch)
+	off := DecodeFixedHeader(&fh, buf[:n])
+	return fh, buf[off:n]
+}
+
+func TestPublishView(t *testing.T) {
+	for _, v := range versions {
+		for _, qos := range []byte{0, 1} {
+			t.Run(v.name+"/qos"+string('0'+qos), func(t *testing.T) {
+				fh, data := encodedPublish(qos, v.v5)
+
+				view := PublishView{}
+				err := DecodePublishView(&view, &fh, data, v.v5)
+				if err != nil {
+					t.Fatalf("decode view: %v", err)
+				}
+				props := newProps()
+				err = view.DecodeProps(props)
+				if err != nil {
+					t.Fatalf("decode view props: %v", err)
+				}
+
+				if string(view.Topic()) != "bench/room1/temp" ||
+					view.Qos() != qos ||
+					!bytes.Equal(view.Payload(), make([]byte, 64)) {
+					t.Fatalf("view doesn't match")
+				}
+				if qos > 0 && view.PacketId() != 7 {
+					t.Fatalf("packet id = %d", view.PacketId())
+				}
+				if v.v5 && props.Ct.String() != "application/json" {
+					t.Fatalf("view props don't match")
+				}
+				if !v.v5 && view.Props() != nil {
+					t.Fatalf("3.1.1 view has props")
+				}
+
+				// it's all in place
+				if &view.Payload()[0] != &data[len(data)-64] {
+					t.Fatalf("payload was copied")
+				}
+			})
+		}
+	}
+}
+
+func TestPublishViewPresent(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		set   func(p *Properties)
+		si    bool
+		alias bool
+	}{
+		{"neither", func(p *Properties) {}, false, false},
+		{"subscription id", func(p *Properties) { p.Si = 5 }, true, false},
+		{"topic alias", func(p *Properties) { p.Ta = 1 }, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh := FixedHeader{Pt: PUBLISH}
+			pub := Publish{}
+			pub.Topic.WriteString("a")
+			props := newProps()
+			tc.set(props)
+			buf := make([]byte, 64)
+			scratch := make([]byte, 64)
+			n := EncodePublish(&fh, &pub, props, buf, scratch)
+			off := DecodeFixedHeader(&fh, buf[:n])
+
+			view := PublishView{}
+			err := DecodePublishView(&view, &fh, buf[off:n], true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// nothing is known until they're checked
+			if view.HasSubscriptionId() || view.HasTopicAlias() {
+				t.Fatalf("props present before they were checked")
+			}
+			if err := view.ValidateProps(); err != nil {
+				t.Fatal(err)
+			}
+			if view.HasSubscriptionId() != tc.si ||
+				view.HasTopicAlias() != tc.alias {
+				t.Fatalf(
+					"subscription id %v, topic alias %v",
+					view.HasSubscriptionId(), view.HasTopicAlias(),
+				)
+			}
+		})
+	}
+}
+
+func TestPublishViewMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags byte
+		data  []byte
+	}{
+		{"empty", 0, []byte{}},
+		{"topic past end", 0, []byte{0, 5, 'a'}},
+		{"invalid utf8 topic", 0, []byte{0, 1, 0xff, 0}},
+		{"null in topic", 0, []byte{0, 1, 0, 0}},
+		{"no packet id", 0b0010, []byte{0, 1, 'a', 0}},
+		{"props past end", 0, []byte{0, 1, 'a', 5, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh := FixedHeader{Pt: PUBLISH, Flags: tc.flags}
+			view := PublishView{}
+			if DecodePublishView(&view, &fh, tc.data, true) == nil {
+				t.Fatalf("decoded %v", tc.data)
+			}
+		})
+	}
+}
+
+// the view has to accept and reject the same packets the decoder does, and
+// read the same things out of them
+func FuzzDecodePublishView(f *testing.F) {
+	f.Fuzz(func(t *testing.T, v5 bool, flags byte, data []byte) {
+		fh := FixedHeader{Pt: PUBLISH, Flags: flags & 0b1111}
+		pub := Publish{}
+		pub.Zero()
+		err := DecodePublish(&fh, &pub, fuzzProps(v5), data)
+
+		view := PublishView{}
+		verr := DecodePublishView(&view, &fh, data, v5)
+		if verr == nil {
+			verr = view.ValidateProps()
+			if derr := view.DecodeProps(newProps()); (derr == nil) != (verr == nil) {
+				t.Fatalf("validate: %v, decode: %v", verr, derr)
+			}
+		}
+
+		if (err == nil) != (verr == nil) {
+			t.Fatalf("decoder: %v, view: %v", err, verr)
+		}
+		if err != nil {
+			return
+		}
+		if string(view.Topic()) != pub.Topic.String() ||
+			view.PacketId() != pub.PacketId ||
+			!bytes.Equal(view.Payload(), pub.Payload) {
+			t.Fatalf("view doesn't match decoder")
+		}
+	})
+}
+
+func BenchmarkDecodePublish(b *testing.B) {
+	for _, v := range versions {
+		fh, data := encodedPublish(1, v.v5)
+		b.Run(v.name+"/decoder", func(b *testing.B) {
+			pub := Publish{}
+			props := newProps()
+			b.ReportAllocs()
+			for range b.N {
+				pub.Zero()
+				props.Zero()
+				err := DecodePublish(&fh, &pub, versionProps(v.v5, props), data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(v.name+"/view", func(b *testing.B) {
+			view := PublishView{}
+			b.ReportAllocs()
+			for range b.N {
+				err := DecodePublishView(&view, &fh, data, v.v5)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(v.name+"/view+validate", func(b *testing.B) {
+			view := PublishView{}
+			b.ReportAllocs()
+			for range b.N {
+				err := DecodePublishView(&view, &fh, data, v.v5)
+				if err == nil {
+					err = view.ValidateProps()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(v.name+"/view+props", func(b *testing.B) {
+			view := PublishView{}
+			props := newProps()
+			b.ReportAllocs()
+			for range b.N {
+				props.Zero()
+				err := DecodePublishView(&view, &fh, data, v.v5)
+				if err == nil {
+					err = view.DecodeProps(props)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// an Authenticator checks the credentials a client sends in its CONNECT,
+// it's only used for clients that don't use enhanced authentication
+type Authenticator interface {
+	// Authenticate returns nil to accept the connection. returning an error
+	// that wraps BadCredentials sends a CONNACK with BUNoP, any other error
+	// sends NA
+	Authenticate(creds *Credentials) error
+}
+
+// Credentials is everything a client presented when it connected
+type Credentials struct {
+	ClientId    string
+	Username    string
+	Password    []byte
+	HasUsername bool
+	HasPassword bool
+	RemoteAddr  net.Addr
+
+	// the verified client certificate for TLS connections that sent one,
+	// if the listener takes the username from the certificate, Username is
+	// already set from it
+	PeerCert *x509.Certificate
+}
+
+var (
+	BadCredentials = errors.New("bad username or password")
+	NotAuthorized  = errors.New("not authorized")
+)
+
+// SetAuthenticator sets the Authenticator every non enhanced authentication
+// CONNECT gets checked against. this is not safe to call once the server has
+// started
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.authenticator = a
+}
+
+// FileAuthenticator checks usernames and passwords against a password file.
+// each line of the file is "username:hash", where hash is either a bcrypt
+// hash ($2a$, $2b$ or $2y$) or an argon2id hash in PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash). blank lines and lines
+// starting with # are skipped
+type FileAuthenticator struct {
+	// AllowAnonymous lets clients that don't send a username connect
+	AllowAnonymous bool
+
+	path   string
+	lock   sync.RWMutex
+	hashes map[string]string
+}
+
+var MalPasswordFile = errors.New("malformed password file")
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	fa := &FileAuthenticator{path: path}
+	err := fa.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return fa, nil
+}
+
+// Reload rereads the password file, if there's an error the old
+// credentials are kept
+func (fa *FileAuthenticator) Reload() error {
+	f, err := os.Open(fa.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string, 16)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(l, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("%w: line %d", MalPasswordFile, line)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$2"):
+		case strings.HasPrefix(hash, "$argon2id$"):
+			// bad parameters would panic in argon2, or ask it for more
+			// memory than we have, so they're caught here instead of on
+			// the first login
+			if _, err := parseArgon2id(hash); err != nil {
+				return fmt.Errorf("%w: line %d", err, line)
+			}
+		default:
+			return fmt.Errorf(
+				"%w: line %d: unsupported hash",
+				MalPasswordFile,
+				line,
+			)
+		}
+		hashes[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fa.lock.Lock()
+	fa.hashes = hashes
+	fa.lock.Unlock()
+
+	return nil
+}
+
+func (fa *FileAuthenticator) Authenticate(creds *Credentials) error {
+	if !creds.HasUsername {
+		if fa.AllowAnonymous {
+			return nil
+		}
+		return NotAuthorized
+	}
+
+	fa.lock.RLock()
+	hash, ok := fa.hashes[creds.Username]
+	fa.lock.RUnlock()
+
+	// unknown users still pay for a hash, so how long this takes doesn't
+	// give away which usernames exist
+	if !ok {
+		hash = dummyHash
+	}
+	match, err := checkHash(hash, creds.Password)
+	if err != nil {
+		return err
+	}
+	if !ok || !match || !creds.HasPassword {
+		return BadCredentials
+	}
+	return nil
+}
+
+// dummyHash is a bcrypt hash at the default cost, of a password nobody has
+const dummyHash = "$2a$10$1c7jz5j8tyuKHM8/jPwCe.08S/z1BBw2tfdH.hYNVSi9cKxakYwzS"
+
+func checkHash(hash string, password []byte) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HashArgon2id hashes a password into the PHC string format the
+// FileAuthenticator understands, using the RFC 9106 recommended parameters
+// for memory constrained environments
+func HashArgon2id(password string) string {
+	const (
+		time    = 3
+		memory  = 64 * 1024
+		threads = 4
+	)
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, 32)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		memory,
+		time,
+		threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+// maxArgon2Memory is the most memory, in KiB, a hash in the password file
+// can make us use for every login, 1 GiB
+const maxArgon2Memory = 1024 * 1024
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(hash string) (argon2idHash, error) {
+	var h argon2idHash
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return h, MalPasswordFile
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return h, MalPasswordFile
+	}
+	_, err = fmt.Sscanf(
+		parts[3],
+		"m=%d,t=%d,p=%d",
+		&h.memory,
+		&h.time,
+		&h.threads,
+	)
+	if err != nil {
+		return h, MalPasswordFile
+	}
+	if h.time < 1 || h.threads < 1 || h.memory > maxArgon2Memory {
+		return h, fmt.Errorf("%w: bad argon2id parameters", MalPasswordFile)
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(h.salt) == 0 {
+		return h, MalPasswordFile
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 {
+		return h, MalPasswordFile
+	}
+	return h, nil
+}
+
+func checkArgon2id(hash string, password []byte) (bool, error) {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey(
+		password,
+		h.salt,
+		h.time,
+		h.memory,
+		h.threads,
+		uint32(len(h.key)),
+	)
+	return subtle.ConstantTimeCompare(h.key, other) == 1, nil
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writePasswordFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "passwords")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcrypt pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writePasswordFile(t, "# users\n\n"+
+		"alice:"+string(bc)+"\n"+
+		"bob:"+HashArgon2id("argon pw")+"\n",
+	)
+	fa, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		creds     Credentials
+		anonymous bool
+		err       error
+	}{
+		{"bcrypt", creds("alice", "bcrypt pw"), false, nil},
+		{"bcrypt wrong password", creds("alice", "argon pw"), false, BadCredentials},
+		{"argon2id", creds("bob", "argon pw"), false, nil},
+		{"argon2id wrong password", creds("bob", "bcrypt pw"), false, BadCredentials},
+		{"unknown user", creds("carol", "bcrypt pw"), false, BadCredentials},
+		{"no password", Credentials{Username: "alice", HasUsername: true}, false, BadCredentials},
+		{"anonymous", Credentials{}, false, NotAuthorized},
+		{"anonymous allowed", Credentials{}, true, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fa.AllowAnonymous = tc.anonymous
+			err := fa.Authenticate(&tc.creds)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func creds(username, password string) Credentials {
+	return Credentials{
+		Username:    username,
+		Password:    []byte(password),
+		HasUsername: true,
+		HasPassword: true,
+	}
+}
+
+func TestPasswordFileMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+	}{
+		{"no separator", "alice\n"},
+		{"no username", ":$2a$10$abc\n"},
+		{"unsupported hash", "alice:plaintext\n"},
+		{"argon2i", "alice:$argon2i$v=19$m=16,t=1,p=1$c2FsdA$a2V5\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFileAuthenticator(writePasswordFile(t, tc.contents))
+			if !errors.Is(err, MalPasswordFile) {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestArgon2idMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=16,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=16,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=16$c2FsdA$a2V5",
+		"$argon2id$v=19$m=16,t=1,p=1$!!$a2V5",
+		"$argon2id$v=19$m=16,t=1,p=1$c2FsdA$!!",
+		// these would panic, or run us out of memory, in argon2
+		"$argon2id$v=19$m=16,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=16,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=16,t=1,p=1$c2FsdA$",
+		"$argon2id$v=19$m=16,t=1,p=1$$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5",
+	} {
+		_, err := checkArgon2id(hash, []byte("pw"))
+		if !errors.Is(err, MalPasswordFile) {
+			t.Fatalf("%s: err = %v", hash, err)
+		}
+
+		// and they're caught when the file is loaded, not on the first
+		// login
+		_, err = NewFileAuthenticator(writePasswordFile(t, "alice:"+hash+"\n"))
+		if !errors.Is(err, MalPasswordFile) {
+			t.Fatalf("%s: loaded with err = %v", hash, err)
+		}
+	}
+}
+
+func TestPasswordFileReload(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writePasswordFile(t, "alice:"+string(bc)+"\n")
+	fa, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a broken file keeps the old credentials
+	os.WriteFile(path, []byte("alice\n"), 0o600)
+	if fa.Reload() == nil {
+		t.Fatalf("reloaded a malformed file")
+	}
+	c := creds("alice", "pw")
+	if err := fa.Authenticate(&c); err != nil {
+		t.Fatalf("old credentials dropped: %v", err)
+	}
+
+	os.WriteFile(path, []byte("bob:"+string(bc)+"\n"), 0o600)
+	if err := fa.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fa.Authenticate(&c); !errors.Is(err, BadCredentials) {
+		t.Fatalf("removed user still authenticates: %v", err)
+	}
+}
@@ -1,10 +1,31 @@
 package mqtt
 
-import "github.com/andrew-r-thomas/mqtt/packets"
+import (
+	"sync/atomic"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// PoolStats counts how often a pool had something ready to hand out (a hit),
+// and how often it had to allocate (a miss)
+type PoolStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type poolStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (ps *poolStats) load() PoolStats {
+	return PoolStats{Hits: ps.hits.Load(), Misses: ps.misses.Load()}
+}
 
 type BufPool struct {
 	bufCap int
 	pool   chan []byte
+	stats  *poolStats
 }
 
 func NewBufPool(capacity int, bufCap int) BufPool {
@@ -12,28 +33,40 @@ func NewBufPool(capacity int, bufCap int) BufPool {
 	for range capacity {
 		pool <- make([]byte, bufCap)
 	}
-	return BufPool{pool: pool, bufCap: bufCap}
+	return BufPool{pool: pool, bufCap: bufCap, stats: &poolStats{}}
 }
 
 func (bp *BufPool) GetBuf() []byte {
 	select {
 	case buf := <-bp.pool:
+		bp.stats.hits.Add(1)
 		return buf
 	default:
+		bp.stats.misses.Add(1)
 		return make([]byte, bp.bufCap)
 	}
 }
 
+func (bp *BufPool) Stats() PoolStats {
+	return bp.stats.load()
+}
+
 func (bp *BufPool) ReturnBuf(buf []byte) {
+	// bufs come back resliced, so grow them back out to their full size
+	buf = buf[:cap(buf)]
+	if len(buf) < bp.bufCap {
+		return
+	}
 	clear(buf)
 	select {
-	case bp.pool <- buf[:min(bp.bufCap, len(buf))]:
+	case bp.pool <- buf[:bp.bufCap]:
 	default:
 	}
 }
 
 type FHPool struct {
-	pool chan packets.FixedHeader
+	pool  chan packets.FixedHeader
+	stats *poolStats
 }
 
 func NewFHPool(capacity int) FHPool {
@@ -43,20 +76,26 @@ func NewFHPool(capacity int) FHPool {
 		fh.Zero()
 		pool <- fh
 	}
-	return FHPool{pool: pool}
+	return FHPool{pool: pool, stats: &poolStats{}}
 }
 
 func (fp *FHPool) GetFH() packets.FixedHeader {
 	select {
 	case fh := <-fp.pool:
+		fp.stats.hits.Add(1)
 		return fh
 	default:
+		fp.stats.misses.Add(1)
 		fh := packets.FixedHeader{}
 		fh.Zero()
 		return fh
 	}
 }
 
+func (fp *FHPool) Stats() PoolStats {
+	return fp.stats.load()
+}
+
 func (fp *FHPool) ReturnFH(fh packets.FixedHeader) {
 	fh.Zero()
 	select {
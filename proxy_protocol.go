@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PROXY protocol v1 and v2, from haproxy's proxy-protocol.txt. load
+// balancers put a header in front of the connection with the address of the
+// client they're proxying for, which becomes the conn's RemoteAddr.
+// the header is read before anything else, including the TLS handshake
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var MalProxyHeader = errors.New("malformed PROXY protocol header")
+
+// proxyListener wraps accepted connections in proxyConns
+type proxyListener struct {
+	net.Listener
+}
+
+func (pl proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn reads the PROXY header the first time it's read from, or when
+// readHeader is called
+type proxyConn struct {
+	net.Conn
+
+	once   sync.Once
+	err    error
+	remote net.Addr // nil if the header didn't have an address for us
+}
+
+func (pc *proxyConn) readHeader() error {
+	pc.once.Do(func() {
+		pc.remote, pc.err = readProxyHeader(pc.Conn)
+	})
+	return pc.err
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	err := pc.readHeader()
+	if err != nil {
+		return 0, err
+	}
+	return pc.Conn.Read(b)
+}
+
+// RemoteAddr is the address from the header, once it's been read
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads exactly the header from conn, and nothing past it
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	// the shortest v1 header is "PROXY UNKNOWN\r\n",
+	// so reading the length of the v2 signature is always safe
+	buf := make([]byte, 12, 232)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(buf, proxyV2Sig):
+		return readProxyV2(conn, buf)
+	case bytes.HasPrefix(buf, proxyV1Prefix):
+		return readProxyV1(conn, buf)
+	default:
+		return nil, MalProxyHeader
+	}
+}
+
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", at most 107 bytes
+func readProxyV1(conn net.Conn, buf []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == 107 {
+			return nil, MalProxyHeader
+		}
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+
+	fields := strings.Fields(string(buf[:len(buf)-2]))
+	if len(fields) < 2 {
+		return nil, MalProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, MalProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, MalProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, MalProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(conn net.Conn, buf []byte) (net.Addr, error) {
+	// version and command, family and protocol, then the address length
+	buf = buf[:16]
+	_, err := io.ReadFull(conn, buf[12:16])
+	if err != nil {
+		return nil, err
+	}
+	if buf[12]>>4 != 2 {
+		return nil, MalProxyHeader
+	}
+	cmd := buf[12] & 0x0f
+	fam := buf[13]
+	l := int(binary.BigEndian.Uint16(buf[14:16]))
+
+	// we have to read the addresses (and any TLVs) even if we don't use
+	// them, to get to the start of the MQTT stream
+	addrs := make([]byte, l)
+	_, err = io.ReadFull(conn, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0: // LOCAL, the proxy talking to us for itself, like health checks
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, MalProxyHeader
+	}
+
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if l < 12 {
+			return nil, MalProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrs[0:4]),
+			Port: int(binary.BigEndian.Uint16(addrs[8:10])),
+		}, nil
+	case 2: // AF_INET6
+		if l < 36 {
+			return nil, MalProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrs[0:16]),
+			Port: int(binary.BigEndian.Uint16(addrs[32:34])),
+		}, nil
+	default: // AF_UNSPEC and AF_UNIX don't tell us anything useful
+		return nil, nil
+	}
+}
@@ -0,0 +1,198 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd byte, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, 0x20|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func proxyV2Inet(src net.IP, srcPort uint16) []byte {
+	b := append([]byte{}, src.To4()...)
+	b = append(b, 10, 0, 0, 1)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, 1883)
+}
+
+func proxyV2Inet6(src net.IP, srcPort uint16) []byte {
+	b := append([]byte{}, src.To16()...)
+	b = append(b, net.IPv6loopback...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, 1883)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		want   string // empty for no address
+		err    error
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n"),
+			want:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"),
+			want:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name: "v1 unknown with addresses",
+			header: []byte(
+				"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n",
+			),
+		},
+		{
+			name:   "v2 inet",
+			header: proxyV2Header(1, 0x11, proxyV2Inet(net.IPv4(10, 1, 2, 3), 4000)),
+			want:   "10.1.2.3:4000",
+		},
+		{
+			name: "v2 inet6",
+			header: proxyV2Header(
+				1, 0x21, proxyV2Inet6(net.ParseIP("2001:db8::1"), 4000),
+			),
+			want: "[2001:db8::1]:4000",
+		},
+		{
+			name: "v2 tlvs",
+			header: proxyV2Header(1, 0x11, append(
+				proxyV2Inet(net.IPv4(10, 1, 2, 3), 4000),
+				0x01, 0x00, 0x02, 'h', '2',
+			)),
+			want: "10.1.2.3:4000",
+		},
+		{
+			name:   "v2 local",
+			header: proxyV2Header(0, 0x00, nil),
+		},
+		{
+			name:   "v2 unspec",
+			header: proxyV2Header(1, 0x00, nil),
+		},
+		{
+			name:   "v2 unix",
+			header: proxyV2Header(1, 0x31, make([]byte, 216)),
+		},
+		{
+			name:   "not a proxy header",
+			header: []byte{0x10, 0x10, 0x00, 0x04, 'M', 'Q', 'T', 'T', 5, 2, 0, 60},
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v1 no crlf",
+			header: append([]byte("PROXY TCP4 "), make([]byte, 120)...),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v1 bad protocol",
+			header: []byte("PROXY UDP4 192.168.0.1 192.168.0.11 56324 1883\r\n"),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v1 missing port",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n"),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v1 bad address",
+			header: []byte("PROXY TCP4 192.168.0.300 192.168.0.11 56324 1883\r\n"),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v1 bad port",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 1883\r\n"),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v2 bad version",
+			header: append(proxyV2Header(1, 0x11, nil)[:12], 0x31, 0x11, 0, 0),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v2 bad command",
+			header: proxyV2Header(2, 0x11, proxyV2Inet(net.IPv4(10, 1, 2, 3), 4000)),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v2 short inet",
+			header: proxyV2Header(1, 0x11, make([]byte, 8)),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v2 short inet6",
+			header: proxyV2Header(1, 0x21, make([]byte, 12)),
+			err:    MalProxyHeader,
+		},
+		{
+			name:   "v2 truncated",
+			header: proxyV2Header(1, 0x11, make([]byte, 12))[:20],
+			err:    io.ErrUnexpectedEOF,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				// the header is followed by the start of the MQTT stream,
+				// which readProxyHeader must leave alone
+				client.Write(append(tc.header, "MQTT"...))
+				client.Close()
+			}()
+
+			addr, err := readProxyHeader(server)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			switch {
+			case tc.want == "" && addr != nil:
+				t.Fatalf("addr = %v, want none", addr)
+			case tc.want != "" && (addr == nil || addr.String() != tc.want):
+				t.Fatalf("addr = %v, want %v", addr, tc.want)
+			}
+
+			rest, err := io.ReadAll(server)
+			if err != nil || string(rest) != "MQTT" {
+				t.Fatalf("rest = %q, %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestProxyConnRemoteAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\nMQTT"))
+		client.Close()
+	}()
+
+	pc := &proxyConn{Conn: server}
+	if pc.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("addr before the header = %v", pc.RemoteAddr())
+	}
+	rest, err := io.ReadAll(pc)
+	if err != nil || string(rest) != "MQTT" {
+		t.Fatalf("rest = %q, %v", rest, err)
+	}
+	if pc.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Fatalf("addr = %v", pc.RemoteAddr())
+	}
+}
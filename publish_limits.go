@@ -0,0 +1,165 @@
+package mqtt
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// PublishLimits caps how fast each client can send PUBLISH packets, so one
+// chatty device can't flood the fan out. zero rates mean no limit, and zero
+// bursts mean a second's worth
+type PublishLimits struct {
+	// PUBLISH packets per second, and how many can come in a burst
+	MsgRate  float64
+	MsgBurst int
+	// PUBLISH bytes per second, counting the whole packet, and how many can
+	// come in a burst. packets bigger than the burst get through once the
+	// bucket is full
+	ByteRate  float64
+	ByteBurst int
+
+	// what to do with packets over the limit
+	Overflow PublishOverflow
+}
+
+type PublishOverflow byte
+
+const (
+	// stop reading from the client until it's back under the limit, which
+	// pushes back on the sender through TCP flow control
+	OverflowThrottle PublishOverflow = iota
+	// drop QoS 0 packets over the limit, QoS 1 and 2 still get throttled
+	// since the client is waiting on an ack for those
+	OverflowDropQoS0
+	// disconnect the client, with MRtH if it went over the message rate and
+	// QE if it went over the byte rate
+	OverflowDisconnect
+)
+
+// PublishLimitStats counts what the publish limits have done, across all
+// clients since the server started
+type PublishLimitStats struct {
+	Throttled    uint64 // packets that were held back before being read
+	Dropped      uint64 // QoS 0 packets that were dropped
+	Disconnected uint64 // clients that were disconnected
+}
+
+// SetPublishLimits sets the limits every client's PUBLISH packets are held
+// to, this is safe to call while the server is running. clients pick up the
+// new limits on their next PUBLISH, starting over with full buckets
+func (s *Server) SetPublishLimits(limits PublishLimits) {
+	s.publishLimits.Store(&limits)
+}
+
+func (s *Server) PublishLimitStats() PublishLimitStats {
+	return PublishLimitStats{
+		Throttled:    s.pubStats.throttled.Load(),
+		Dropped:      s.pubStats.dropped.Load(),
+		Disconnected: s.pubStats.disconnected.Load(),
+	}
+}
+
+type publishStats struct {
+	throttled    atomic.Uint64
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// publishLimiter is a client's buckets, it's only touched by the readPump
+type publishLimiter struct {
+	limits *PublishLimits // what the buckets were made from
+	msgs   tokenBucket
+	bytes  tokenBucket
+}
+
+type pubVerdict byte
+
+const (
+	pubDeliver pubVerdict = iota
+	pubDrop
+	pubStop
+)
+
+// limitPublish decides what happens to a packet of size bytes that's just
+// been read, blocking if the client needs to be throttled. on pubStop the
+// readPump stops, and if the client is being disconnected the DISCONNECT is
+// queued behind whatever the writePump hasn't sent yet
+func (c *Client) limitPublish(
+	ctx context.Context,
+	fh *packets.FixedHeader,
+	size int,
+) pubVerdict {
+	if fh.Pt != packets.PUBLISH {
+		return pubDeliver
+	}
+	limits := c.server.publishLimits.Load()
+	if limits == nil {
+		return pubDeliver
+	}
+	pl := &c.pubLimiter
+	if pl.limits != limits {
+		pl.limits = limits
+		msgBurst := limits.MsgBurst
+		if msgBurst == 0 {
+			msgBurst = int(limits.MsgRate)
+		}
+		byteBurst := limits.ByteBurst
+		if byteBurst == 0 {
+			byteBurst = int(limits.ByteRate)
+		}
+		pl.msgs = newTokenBucket(limits.MsgRate, msgBurst)
+		pl.bytes = newTokenBucket(limits.ByteRate, byteBurst)
+	}
+
+	n := min(float64(size), pl.bytes.burst)
+	qos := (fh.Flags >> 1) & 0b11
+	throttled := false
+	for {
+		now := time.Now()
+		var msgWait, byteWait time.Duration
+		if limits.MsgRate > 0 {
+			msgWait = pl.msgs.until(now, 1)
+		}
+		if limits.ByteRate > 0 {
+			byteWait = pl.bytes.until(now, n)
+		}
+		if msgWait == 0 && byteWait == 0 {
+			if limits.MsgRate > 0 {
+				pl.msgs.takeN(now, 1)
+			}
+			if limits.ByteRate > 0 {
+				pl.bytes.takeN(now, n)
+			}
+			return pubDeliver
+		}
+
+		switch {
+		case limits.Overflow == OverflowDisconnect:
+			rc := packets.MRtH
+			if msgWait == 0 {
+				rc = packets.QE
+			}
+			c.server.pubStats.disconnected.Add(1)
+			c.queueDisconnect(rc)
+			return pubStop
+		case limits.Overflow == OverflowDropQoS0 && qos == 0:
+			c.server.pubStats.dropped.Add(1)
+			return pubDrop
+		}
+
+		if !throttled {
+			throttled = true
+			c.server.pubStats.throttled.Add(1)
+		}
+		t := time.NewTimer(max(msgWait, byteWait))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return pubStop
+		}
+	}
+}
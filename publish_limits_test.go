@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+func TestLimitPublish(t *testing.T) {
+	qos0 := &packets.FixedHeader{Pt: packets.PUBLISH}
+	qos1 := &packets.FixedHeader{Pt: packets.PUBLISH, Flags: 1 << 1}
+	ping := &packets.FixedHeader{Pt: packets.PINGREQ}
+
+	type step struct {
+		fh   *packets.FixedHeader
+		size int
+		want pubVerdict
+	}
+	for _, tc := range []struct {
+		name   string
+		limits PublishLimits
+		steps  []step
+		stats  PublishLimitStats
+		end    packets.ReasonCode // UE if the client shouldn't be ended
+	}{
+		{
+			name: "under the limit",
+			limits: PublishLimits{
+				MsgRate: 10, MsgBurst: 2, ByteRate: 100, ByteBurst: 100,
+			},
+			steps: []step{{qos0, 50, pubDeliver}, {qos1, 50, pubDeliver}},
+			end:   packets.UE,
+		},
+		{
+			name:   "other packets are never limited",
+			limits: PublishLimits{MsgRate: 1, MsgBurst: 1},
+			steps: []step{
+				{qos0, 10, pubDeliver}, {ping, 2, pubDeliver},
+				{ping, 2, pubDeliver},
+			},
+			end: packets.UE,
+		},
+		{
+			name: "drop qos 0",
+			limits: PublishLimits{
+				MsgRate: 1, MsgBurst: 1, Overflow: OverflowDropQoS0,
+			},
+			steps: []step{{qos0, 10, pubDeliver}, {qos0, 10, pubDrop}},
+			stats: PublishLimitStats{Dropped: 1},
+			end:   packets.UE,
+		},
+		{
+			// qos 1 is throttled instead, until the context is done
+			name: "drop qos 0 throttles qos 1",
+			limits: PublishLimits{
+				MsgRate: 1, MsgBurst: 1, Overflow: OverflowDropQoS0,
+			},
+			steps: []step{{qos0, 10, pubDeliver}, {qos1, 10, pubStop}},
+			stats: PublishLimitStats{Throttled: 1},
+			end:   packets.UE,
+		},
+		{
+			name:   "throttle",
+			limits: PublishLimits{ByteRate: 100, ByteBurst: 100},
+			steps:  []step{{qos0, 100, pubDeliver}, {qos0, 10, pubStop}},
+			stats:  PublishLimitStats{Throttled: 1},
+			end:    packets.UE,
+		},
+		{
+			name: "disconnect on messages",
+			limits: PublishLimits{
+				MsgRate: 1, MsgBurst: 1, Overflow: OverflowDisconnect,
+			},
+			steps: []step{{qos0, 10, pubDeliver}, {qos0, 10, pubStop}},
+			stats: PublishLimitStats{Disconnected: 1},
+			end:   packets.MRtH,
+		},
+		{
+			name: "disconnect on bytes",
+			limits: PublishLimits{
+				ByteRate: 100, ByteBurst: 100, Overflow: OverflowDisconnect,
+			},
+			steps: []step{{qos0, 60, pubDeliver}, {qos0, 60, pubStop}},
+			stats: PublishLimitStats{Disconnected: 1},
+			end:   packets.QE,
+		},
+		{
+			// bigger than the burst, so it waits for a full bucket
+			name: "bigger than the burst",
+			limits: PublishLimits{
+				ByteRate: 100, ByteBurst: 100, Overflow: OverflowDisconnect,
+			},
+			steps: []step{{qos0, 500, pubDeliver}, {qos0, 1, pubStop}},
+			stats: PublishLimitStats{Disconnected: 1},
+			end:   packets.QE,
+		},
+		{
+			// a zero burst is a second's worth
+			name: "default burst",
+			limits: PublishLimits{
+				MsgRate: 2, Overflow: OverflowDisconnect,
+			},
+			steps: []step{
+				{qos0, 10, pubDeliver}, {qos0, 10, pubDeliver},
+				{qos0, 10, pubStop},
+			},
+			stats: PublishLimitStats{Disconnected: 1},
+			end:   packets.MRtH,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer()
+			s.SetPublishLimits(tc.limits)
+			c := benchClient(&s, "c")
+
+			// anything that gets throttled waits past the deadline
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				20*time.Millisecond,
+			)
+			defer cancel()
+			for i, st := range tc.steps {
+				if v := c.limitPublish(ctx, st.fh, st.size); v != st.want {
+					t.Fatalf("step %d = %v, want %v", i, v, st.want)
+				}
+			}
+
+			if stats := s.PublishLimitStats(); stats != tc.stats {
+				t.Fatalf("stats = %+v, want %+v", stats, tc.stats)
+			}
+			if rc, _ := c.endReason(); rc != tc.end {
+				t.Fatalf("end = %v, want %v", rc, tc.end)
+			}
+		})
+	}
+}
+
+func TestLimitPublishThrottleWaits(t *testing.T) {
+	s := NewServer()
+	s.SetPublishLimits(PublishLimits{MsgRate: 20, MsgBurst: 1})
+	c := benchClient(&s, "c")
+	fh := &packets.FixedHeader{Pt: packets.PUBLISH}
+
+	if v := c.limitPublish(context.Background(), fh, 10); v != pubDeliver {
+		t.Fatalf("first = %v, want %v", v, pubDeliver)
+	}
+	start := time.Now()
+	if v := c.limitPublish(context.Background(), fh, 10); v != pubDeliver {
+		t.Fatalf("second = %v, want %v", v, pubDeliver)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("second went through after %v, want about 50ms", d)
+	}
+	if stats := s.PublishLimitStats(); stats.Throttled != 1 {
+		t.Fatalf("throttled = %d, want 1", stats.Throttled)
+	}
+}
+
+func TestLimitPublishNewLimits(t *testing.T) {
+	s := NewServer()
+	s.SetPublishLimits(PublishLimits{
+		MsgRate: 1, MsgBurst: 1, Overflow: OverflowDropQoS0,
+	})
+	c := benchClient(&s, "c")
+	fh := &packets.FixedHeader{Pt: packets.PUBLISH}
+
+	ctx := context.Background()
+	c.limitPublish(ctx, fh, 10)
+	if v := c.limitPublish(ctx, fh, 10); v != pubDrop {
+		t.Fatalf("over the limit = %v, want %v", v, pubDrop)
+	}
+
+	// new limits start over with full buckets
+	s.SetPublishLimits(PublishLimits{
+		MsgRate: 1, MsgBurst: 1, Overflow: OverflowDropQoS0,
+	})
+	if v := c.limitPublish(ctx, fh, 10); v != pubDeliver {
+		t.Fatalf("after new limits = %v, want %v", v, pubDeliver)
+	}
+}
+
+func TestLimitPublishDisconnectQueued(t *testing.T) {
+	s := NewServer()
+	s.SetPublishLimits(PublishLimits{
+		MsgRate: 1, MsgBurst: 1, Overflow: OverflowDisconnect,
+	})
+	pl := testServer(t, &s)
+	conn := testConnect(t, pl, "c")
+	testSubscribe(t, conn, "t")
+
+	publish := func() {
+		fh := packets.FixedHeader{Pt: packets.PUBLISH}
+		p := packets.Publish{Payload: []byte("hi")}
+		p.Topic.WriteString("t")
+		props := packets.Properties{}
+		props.Zero()
+		testWrite(t, conn, func(buf, scratch []byte) int {
+			return packets.EncodePublish(&fh, &p, &props, buf, scratch)
+		})
+	}
+	publish()
+	if fh, _ := testRead(t, conn); fh.Pt != packets.PUBLISH {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PUBLISH)
+	}
+
+	// the DISCONNECT goes out through the writePump, which then hangs up
+	publish()
+	fh, body := testRead(t, conn)
+	if fh.Pt != packets.DISCONNECT || body[0] != byte(packets.MRtH) {
+		t.Fatalf("got packet type %d, %v", fh.Pt, body)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open: %v", err)
+	}
+}
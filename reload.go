@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Reload applies a new config to a running server made with
+// NewServerFromConfig, without dropping any connections. the log level,
+// rate limits, password and ACL files and TLS certificates are reloaded,
+// anything else that changed is left alone and returned as needing a
+// restart. if the new config isn't valid, or one of the files fails to
+// load, nothing changes
+func (s *Server) Reload(cfg *ServerConfig) (needRestart []string, err error) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config == nil {
+		return nil, errors.New("server wasn't made with NewServerFromConfig")
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	old := s.config
+
+	// everything that can only change with a restart
+	for _, setting := range []struct {
+		name     string
+		old, new any
+	}{
+		{"listeners", old.Listeners, cfg.Listeners},
+		{"max_packet_size", old.MaxPacketSize, cfg.MaxPacketSize},
+		{"connect_timeout", old.ConnectTimeout, cfg.ConnectTimeout},
+		{"buf_pool_size", old.BufPoolSize, cfg.BufPoolSize},
+		{"buf_size", old.BufSize, cfg.BufSize},
+		{
+			"fixed_header_pool_size",
+			old.FixedHeaderPoolSize,
+			cfg.FixedHeaderPoolSize,
+		},
+		{"log.format", old.Log.Format, cfg.Log.Format},
+		{"auth.password_file", old.Auth.PasswordFile, cfg.Auth.PasswordFile},
+		{
+			"auth.allow_anonymous",
+			old.Auth.AllowAnonymous,
+			cfg.Auth.AllowAnonymous,
+		},
+		{"auth.acl_file", old.Auth.ACLFile, cfg.Auth.ACLFile},
+		{"queue", old.Queue, cfg.Queue},
+		{
+			"validate_payload_format",
+			old.ValidatePayloadFormat,
+			cfg.ValidatePayloadFormat,
+		},
+		{"user_properties", old.UserProperties, cfg.UserProperties},
+		{"allow_mqtt31", old.AllowMQTT31, cfg.AllowMQTT31},
+		{"metrics_addr", old.MetricsAddr, cfg.MetricsAddr},
+		{"admin_addr", old.AdminAddr, cfg.AdminAddr},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			needRestart = append(needRestart, setting.name)
+		}
+	}
+
+	// the files get reread in place, since their paths can't change
+	if fa, ok := s.authenticator.(*FileAuthenticator); ok {
+		err = fa.Reload()
+		if err != nil {
+			return nil, fmt.Errorf("password file: %w", err)
+		}
+	}
+	if acl, ok := s.authorizer.(*ACL); ok {
+		err = acl.Reload()
+		if err != nil {
+			return nil, fmt.Errorf("acl file: %w", err)
+		}
+	}
+	err = s.ReloadTLS()
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	level, _ := parseLogLevel(cfg.Log.Level)
+	s.SetLogLevel(level)
+	s.applyLimits(cfg)
+
+	// only keep what was actually applied, so the next reload still reports
+	// the settings waiting on a restart
+	applied := *old
+	applied.Log.Level = cfg.Log.Level
+	applied.Limits = cfg.Limits
+	s.config = &applied
+
+	s.logger.Info("reloaded config", "needs_restart", needRestart)
+	return needRestart, nil
+}
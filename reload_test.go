@@ -0,0 +1,224 @@
+package mqtt
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"testing"
+)
+
+// reloadServer makes a server from cfg to reload, logging nowhere
+func reloadServer(t *testing.T, cfg *ServerConfig) *Server {
+	t.Helper()
+	s, err := NewServerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewServerFromConfig: %v", err)
+	}
+	s.SetLogOutput(io.Discard, LogText)
+	return s
+}
+
+func TestReloadNeedRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(cfg *ServerConfig)
+		want   []string
+	}{
+		{"nothing", func(cfg *ServerConfig) {}, nil},
+		{
+			"reloadable",
+			func(cfg *ServerConfig) {
+				cfg.Log.Level = "debug"
+				cfg.Limits.MaxConns = 10
+			},
+			nil,
+		},
+		{
+			"listeners",
+			func(cfg *ServerConfig) {
+				cfg.Listeners = append(slices.Clone(cfg.Listeners), ListenerConfig{
+					Name: "other", Type: "tcp", Addr: ":1884",
+				})
+			},
+			[]string{"listeners"},
+		},
+		{
+			"max packet size",
+			func(cfg *ServerConfig) { cfg.MaxPacketSize = 8 * KB },
+			[]string{"max_packet_size"},
+		},
+		{
+			"log format",
+			func(cfg *ServerConfig) { cfg.Log.Format = "json" },
+			[]string{"log.format"},
+		},
+		{
+			"several",
+			func(cfg *ServerConfig) {
+				cfg.Log.Level = "debug"
+				cfg.Auth.AllowAnonymous = true
+				cfg.Queue.MaxMsgs = 10
+				cfg.AllowMQTT31 = true
+				cfg.MetricsAddr = ":9100"
+			},
+			[]string{
+				"auth.allow_anonymous",
+				"queue",
+				"allow_mqtt31",
+				"metrics_addr",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := reloadServer(t, DefaultConfig())
+			cfg := DefaultConfig()
+			tc.change(cfg)
+
+			got, err := s.Reload(cfg)
+			if err != nil {
+				t.Fatalf("Reload: %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("need restart = %v, want %v", got, tc.want)
+			}
+
+			// still waiting on a restart the next time around
+			got, err = s.Reload(cfg)
+			if err != nil {
+				t.Fatalf("second Reload: %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("second need restart = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReloadApplies(t *testing.T) {
+	s := reloadServer(t, DefaultConfig())
+
+	cfg := DefaultConfig()
+	cfg.Log.Level = "debug"
+	cfg.Limits.MaxConnsPerIP = 3
+	cfg.Limits.PublishMsgRate = 10
+	cfg.Limits.PublishMsgBurst = 20
+	cfg.Limits.PublishOverflow = "disconnect"
+	if _, err := s.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if level := s.LogLevel().Level(); level != slog.LevelDebug {
+		t.Fatalf("log level = %v, want %v", level, slog.LevelDebug)
+	}
+	if n := s.connLimiter.limits.MaxConnsPerIP; n != 3 {
+		t.Fatalf("max conns per ip = %d, want 3", n)
+	}
+	want := PublishLimits{MsgRate: 10, MsgBurst: 20, Overflow: OverflowDisconnect}
+	if pl := s.publishLimits.Load(); pl == nil || *pl != want {
+		t.Fatalf("publish limits = %+v, want %+v", pl, want)
+	}
+
+	// and taking the limits back out turns them off
+	cfg = DefaultConfig()
+	if _, err := s.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if level := s.LogLevel().Level(); level != slog.LevelInfo {
+		t.Fatalf("log level = %v, want %v", level, slog.LevelInfo)
+	}
+	if n := s.connLimiter.limits.MaxConnsPerIP; n != 0 {
+		t.Fatalf("max conns per ip = %d, want 0", n)
+	}
+	if pl := s.publishLimits.Load(); pl != nil {
+		t.Fatalf("publish limits = %+v, want none", pl)
+	}
+}
+
+func TestReloadFiles(t *testing.T) {
+	hash := HashArgon2id("pw")
+	cfg := DefaultConfig()
+	cfg.Auth.PasswordFile = writePasswordFile(t, "alice:"+hash+"\n")
+	cfg.Auth.ACLFile = writeACLFile(t, "readwrite alice a/#\n")
+	s := reloadServer(t, cfg)
+
+	authenticates := func(username string) bool {
+		c := creds(username, "pw")
+		return s.authenticator.Authenticate(&c) == nil
+	}
+	writes := func(username, topic string) bool {
+		return s.authorizer.Authorize("c", username, topic, AccessWrite)
+	}
+	write := func(path, contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files get reread even though the config didn't change
+	write(cfg.Auth.PasswordFile, "bob:"+hash+"\n")
+	write(cfg.Auth.ACLFile, "readwrite bob b/#\n")
+	if _, err := s.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if authenticates("alice") || !authenticates("bob") {
+		t.Fatalf("password file wasn't reloaded")
+	}
+	if writes("alice", "a/1") || !writes("bob", "b/1") {
+		t.Fatalf("acl file wasn't reloaded")
+	}
+
+	// a file that doesn't load leaves everything as it was
+	for _, tc := range []struct {
+		name string
+		path string
+		good string
+	}{
+		{"password file", cfg.Auth.PasswordFile, "bob:" + hash + "\n"},
+		{"acl file", cfg.Auth.ACLFile, "readwrite bob b/#\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.path, "not a valid line\n")
+			defer write(tc.path, tc.good)
+
+			next := DefaultConfig()
+			next.Auth = cfg.Auth
+			next.Log.Level = "error"
+			next.Limits.MaxConns = 1
+			if _, err := s.Reload(next); err == nil {
+				t.Fatalf("Reload succeeded")
+			}
+			if !authenticates("bob") || !writes("bob", "b/1") {
+				t.Fatalf("files changed")
+			}
+			if level := s.LogLevel().Level(); level != slog.LevelInfo {
+				t.Fatalf("log level = %v, want %v", level, slog.LevelInfo)
+			}
+			if n := s.connLimiter.limits.MaxConns; n != 0 {
+				t.Fatalf("max conns = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	s := reloadServer(t, DefaultConfig())
+	cfg := DefaultConfig()
+	cfg.Log.Level = "loud"
+	cfg.Limits.MaxConns = 1
+	if _, err := s.Reload(cfg); err == nil {
+		t.Fatalf("Reload of an invalid config succeeded")
+	}
+	if level := s.LogLevel().Level(); level != slog.LevelInfo {
+		t.Fatalf("log level = %v, want %v", level, slog.LevelInfo)
+	}
+	if n := s.connLimiter.limits.MaxConns; n != 0 {
+		t.Fatalf("max conns = %d, want 0", n)
+	}
+
+	// servers that didn't come from a config have nothing to reload
+	plain := NewServer()
+	if _, err := plain.Reload(DefaultConfig()); err == nil {
+		t.Fatalf("Reload of a server without a config succeeded")
+	}
+}
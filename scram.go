@@ -0,0 +1,191 @@
+package mqtt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// ScramSha256 is the SCRAM-SHA-256 mechanism from RFC 7677, without channel
+// binding. the client first message goes in the CONNECT authentication data,
+// the client final message in an AUTH, and the server final message comes
+// back in the CONNACK
+type ScramSha256 struct {
+	Lookup func(username string) (cred ScramCredential, ok bool)
+}
+
+const ScramSha256Method = "SCRAM-SHA-256"
+
+// a ScramCredential is what the server stores for a user,
+// the password itself is never kept around
+type ScramCredential struct {
+	Salt      []byte
+	Iters     int
+	StoredKey []byte
+	ServerKey []byte
+}
+
+// NewScramCredential derives the stored credential for a password
+func NewScramCredential(
+	password string,
+	salt []byte,
+	iters int,
+) ScramCredential {
+	salted := scramHi([]byte(password), salt, iters)
+	clientKey := scramHmac(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	return ScramCredential{
+		Salt:      salt,
+		Iters:     iters,
+		StoredKey: storedKey[:],
+		ServerKey: scramHmac(salted, []byte("Server Key")),
+	}
+}
+
+func (ss *ScramSha256) Method() string { return ScramSha256Method }
+
+func (ss *ScramSha256) Start() AuthExchange {
+	return &scramExchange{lookup: ss.Lookup}
+}
+
+type scramExchange struct {
+	lookup func(username string) (ScramCredential, bool)
+
+	username        string
+	cred            ScramCredential
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (se *scramExchange) Step(data []byte) ([]byte, bool, error) {
+	if se.serverFirst == "" {
+		return se.clientFirst(string(data))
+	}
+	return se.clientFinal(string(data))
+}
+
+func (se *scramExchange) Username() string { return se.username }
+
+// client-first-message = gs2-header client-first-message-bare
+func (se *scramExchange) clientFirst(msg string) ([]byte, bool, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	// we don't do channel binding, so the flag has to be "n" or "y"
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, false, AuthFailed
+	}
+	se.gs2Header = parts[0] + "," + parts[1] + ","
+	se.clientFirstBare = parts[2]
+
+	attrs := scramAttrs(se.clientFirstBare)
+	username, ok := attrs["n"]
+	if !ok {
+		return nil, false, AuthFailed
+	}
+	cnonce, ok := attrs["r"]
+	if !ok || cnonce == "" {
+		return nil, false, AuthFailed
+	}
+	username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(username)
+
+	cred, ok := se.lookup(username)
+	if !ok {
+		return nil, false, AuthFailed
+	}
+	se.username = username
+	se.cred = cred
+
+	snonce := make([]byte, 18)
+	rand.Read(snonce)
+	se.nonce = cnonce + base64.StdEncoding.EncodeToString(snonce)
+	se.serverFirst = "r=" + se.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(cred.Salt) +
+		",i=" + strconv.Itoa(cred.Iters)
+
+	return []byte(se.serverFirst), false, nil
+}
+
+// client-final-message = client-final-message-without-proof "," proof
+func (se *scramExchange) clientFinal(msg string) ([]byte, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i == -1 {
+		return nil, false, AuthFailed
+	}
+	withoutProof := msg[:i]
+
+	attrs := scramAttrs(withoutProof)
+	cbind := base64.StdEncoding.EncodeToString([]byte(se.gs2Header))
+	if attrs["c"] != cbind || attrs["r"] != se.nonce {
+		return nil, false, AuthFailed
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, AuthFailed
+	}
+
+	authMsg := []byte(
+		se.clientFirstBare + "," + se.serverFirst + "," + withoutProof,
+	)
+
+	// ClientKey = ClientProof XOR ClientSignature,
+	// and it has to hash to the StoredKey
+	clientSig := scramHmac(se.cred.StoredKey, authMsg)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSig[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], se.cred.StoredKey) {
+		return nil, false, AuthFailed
+	}
+
+	serverSig := scramHmac(se.cred.ServerKey, authMsg)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)),
+		true,
+		nil
+}
+
+// scramAttrs splits a message like "n=user,r=nonce" into its attributes
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string, 4)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs
+}
+
+func scramHmac(key []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// Hi from RFC 5802, which is PBKDF2 with HMAC-SHA-256 and a single block
+func scramHi(password []byte, salt []byte, iters int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	out := make([]byte, len(u))
+	copy(out, u)
+	for range iters - 1 {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range out {
+			out[i] ^= u[i]
+		}
+	}
+	return out
+}
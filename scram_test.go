@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// the SCRAM-SHA-256 example from RFC 7677 section 3
+const (
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfc7677Scram() *ScramSha256 {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	cred := NewScramCredential("pencil", salt, 4096)
+	return &ScramSha256{
+		Lookup: func(username string) (ScramCredential, bool) {
+			return cred, username == "user"
+		},
+	}
+}
+
+// rfc7677Exchange runs the client first message, and then swaps in the
+// server nonce from the RFC for the random one
+func rfc7677Exchange(t *testing.T) *scramExchange {
+	t.Helper()
+	se := rfc7677Scram().Start().(*scramExchange)
+	resp, done, err := se.Step([]byte(rfc7677ClientFirst))
+	if err != nil || done {
+		t.Fatalf("client first: %v, %v", done, err)
+	}
+	if !strings.HasPrefix(string(resp), "r=rOprNGfwEbeRWgbNEkqO") ||
+		!strings.HasSuffix(string(resp), ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096") {
+		t.Fatalf("server first = %s", resp)
+	}
+	se.serverFirst = rfc7677ServerFirst
+	se.nonce = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	return se
+}
+
+func TestScramRFC7677(t *testing.T) {
+	se := rfc7677Exchange(t)
+	resp, done, err := se.Step([]byte(rfc7677ClientFinal))
+	if err != nil || !done {
+		t.Fatalf("client final: %v, %v", done, err)
+	}
+	if string(resp) != rfc7677ServerFinal {
+		t.Fatalf("server final = %s", resp)
+	}
+	if se.Username() != "user" {
+		t.Fatalf("username = %q", se.Username())
+	}
+}
+
+func TestScramClientFirstRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  string
+	}{
+		{"channel binding", "p=tls-unique,,n=user,r=abc"},
+		{"no gs2 header", "n=user,r=abc"},
+		{"no username", "n,,r=abc"},
+		{"no nonce", "n,,n=user"},
+		{"empty nonce", "n,,n=user,r="},
+		{"unknown user", "n,,n=someone,r=abc"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := rfc7677Scram().Start().Step([]byte(tc.msg))
+			if !errors.Is(err, AuthFailed) {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestScramClientFinalRejected(t *testing.T) {
+	nonce := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	for _, tc := range []struct {
+		name string
+		msg  string
+	}{
+		{"wrong proof", "c=biws," + nonce + ",p=" +
+			base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		{"short proof", "c=biws," + nonce + ",p=AAAA"},
+		{"proof not base64", "c=biws," + nonce + ",p=!!!!"},
+		{"no proof", "c=biws," + nonce},
+		{"wrong nonce", "c=biws,r=rOprNGfwEbeRWgbNEkqO," +
+			"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="},
+		{"wrong channel binding", "c=eSws," + nonce +
+			",p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, done, err := rfc7677Exchange(t).Step([]byte(tc.msg))
+			if !errors.Is(err, AuthFailed) || done {
+				t.Fatalf("done = %v, err = %v", done, err)
+			}
+		})
+	}
+}
+
+func TestScramUsernameEscapes(t *testing.T) {
+	var looked string
+	ss := &ScramSha256{
+		Lookup: func(username string) (ScramCredential, bool) {
+			looked = username
+			return NewScramCredential("pw", []byte("salt"), 1), true
+		},
+	}
+	_, _, err := ss.Start().Step([]byte("n,,n=a=2Cb=3Dc,r=abc"))
+	if err != nil || looked != "a,b=c" {
+		t.Fatalf("looked up %q: %v", looked, err)
+	}
+}
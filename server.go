@@ -3,11 +3,11 @@ package mqtt
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"strings"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrew-r-thomas/mqtt/packets"
@@ -21,386 +21,217 @@ type Server struct {
 	bp BufPool
 	fp FHPool
 
-	clientsLock sync.RWMutex
-	clients     map[string]Session
+	clientsLock  sync.RWMutex
+	clients      map[string]*Client
+	internalSubs map[string]*internalSub // also under clientsLock
+	internalSeq  atomic.Uint64
 
 	topicTrie TopicTrie
 
+	userPropRules []UserPropRule
+	validatePfi   bool
+	allowV31      bool
+	authMechs     map[string]AuthMechanism
+	authenticator Authenticator
+	authorizer    Authorizer
+	hooks         []Hook
+
+	listenersLock sync.Mutex
+	listeners     []*Listener
+	connLimiter   *connLimiter
+	publishLimits atomic.Pointer[PublishLimits]
+	pubStats      publishStats
+	queuePolicy   QueuePolicy
+	queueStats    queueStats
+	metrics       *metrics
+	logger        *slog.Logger
+	logLevel      *slog.LevelVar
+	config        *ServerConfig // only if made with NewServerFromConfig
+	configLock    sync.Mutex
+	httpServers   []*http.Server
+	closing       atomic.Bool
+
 	maxPacketSize int
 	connDeadline  time.Duration
 
 	wg sync.WaitGroup
 
-	ctx context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // TODO: instantiate from persistent storage
 func NewServer() Server {
 	bp := NewBufPool(100, DefaultBufSize)
 	fp := NewFHPool(100)
+	logLevel := &slog.LevelVar{}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return Server{
 		bp: bp,
 		fp: fp,
 
 		clientsLock: sync.RWMutex{},
-		clients:     make(map[string]Session, 8),
+		clients:     make(map[string]*Client, 8),
+
+		internalSubs: make(map[string]*internalSub),
 
 		topicTrie: NewTopicTrie(),
 
+		connLimiter: newConnLimiter(),
+		metrics:     newMetrics(),
+		logger:      newLogger(logLevel),
+		logLevel:    logLevel,
+
 		maxPacketSize: 4 * KB,
+
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 func (s *Server) Start(addr string) error {
-	listener, err := net.Listen("tcp", addr)
+	l, err := ListenTCP("tcp", addr, ListenerPolicy{})
 	if err != nil {
 		return err
 	}
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			return err
-		}
-
-		go s.handleConn(conn)
-	}
+	return s.Serve(l)
 }
 
-func (s *Server) handleConn(conn net.Conn) {
-	// wait for connect packet
-	conn.SetDeadline(time.Now().Add(time.Second))
-	buf := s.bp.GetBuf()
-	n, err := conn.Read(buf)
+func (s *Server) handleConn(conn net.Conn, l *Listener) {
+	c, err := SetupClient(conn, s, l)
 	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-		} else {
-			log.Fatalf(
-				"unexpected error setting up conn: %v\n",
-				err,
-			)
-		}
-	}
-	// TODO: read until n is enough for fixedheader len
-	fh := s.fp.GetFH()
-	off := packets.DecodeFixedHeader(&fh, buf)
-	if off == -1 {
-		// TODO:
-		log.Fatalf("error decoding fixed header\n")
-	}
-	for n < off+int(fh.RemLen) {
-		// TODO: validate that the len isnt crazy
-		b := s.bp.GetBuf()
-		nn, err := conn.Read(b)
-		if err != nil {
-			// TODO:
-		}
-		buf = append(buf, b...)
-		s.bp.ReturnBuf(b)
-		n += nn
-	}
-
-	ctx, cancel := context.WithCancel(s.ctx)
-	readChan := make(chan Packet, 100)
-	writeChan := make(chan []byte, 100)
-
-	go s.readPump(conn, ctx, readChan)
-	go s.writePump(conn, ctx, writeChan)
-
-	select {
-	case packet := <-readChan:
-		if packet.fh.Pt != packets.CONNECT {
-			// TODO:
-		}
-		// TODO: do all the setup stuff
-	case <-time.After(time.Second):
-		cancel()
+		s.logger.Warn(
+			"error setting up client",
+			"remote_addr", conn.RemoteAddr().String(),
+			"listener", l.Name,
+			"err", err,
+		)
+		conn.Close()
 		return
 	}
-	// s.clientsLock.Lock()
-	// s.clients[connect.Id.String()] = Session{
-	// 	writeChan: writeChan,
-	// }
-	// s.clientsLock.Unlock()
-
-	for p := range readChan {
-		offset := len(p.buf) - int(p.fh.RemLen)
-
-		switch p.fh.Pt {
-		case packets.PINGREQ:
-			clear(p.buf)
-			p.buf[0] = 0b11010000
-			p.buf[1] = 0
-			writeChan <- p.buf[:2]
-		case packets.SUBSCRIBE:
-			log.Printf("got sub\n")
-			props := packets.Properties{}
-			props.Zero()
-			sub := packets.Subscribe{}
-			sub.Zero()
-
-			err := packets.DecodeSubscribe(
-				&sub,
-				&props,
-				p.buf[offset:],
-			)
-			if err != nil {
-				log.Fatalf(
-					"%s: error decoding subscribe packet: %v\n",
-					connect.Id.String(),
-					err,
-				)
-			}
-
-			suback := packets.Suback{}
-			suback.Zero()
-			suback.PacketId = sub.PackedId
-
-			for _, filter := range sub.TopicFilters {
-				// TODO: filter cleaning
-				sub := strings.Split(filter.Filter.String(), "/")
-				s.topicTrie.AddSubscription(sub, connect.Id.String())
-				suback.ReasonCodes = append(
-					suback.ReasonCodes, 0,
-				)
-			}
-
-			props.Zero()
-			clear(p.buf)
-
-			scratch := s.bp.GetBuf()
-			i := packets.EncodeSuback(
-				&suback,
-				&props,
-				p.buf,
-				scratch,
-			)
-			s.bp.ReturnBuf(scratch)
-
-			writeChan <- p.buf[:i]
-		case packets.PUBLISH:
-			log.Printf("got pub\n")
-			props := packets.Properties{}
-			props.Zero()
-			pub := packets.Publish{}
-			pub.Zero()
-
-			err := packets.DecodePublish(
-				p.fh,
-				&pub,
-				&props,
-				p.buf[offset:],
-			)
-			if err != nil {
-				log.Fatalf(
-					"%s: error decoding pub: %v\n",
-					connect.Id.String(),
-					err,
-				)
-			}
-			// TODO: topic cleaning
-			topic := strings.Split(pub.Topic.String(), "/")
-			matches := s.topicTrie.FindMatches(topic)
-			s.clientsLock.RLock()
-			for _, match := range matches {
-				log.Printf("sending pub to %s\n", match)
-				s.clients[match].writeChan <- p.buf
-			}
-			s.clientsLock.RUnlock()
-		case packets.DISCONNECT:
-			log.Printf("%s: disconnected\n", connect.Id.String())
-
-			// remove subs
-			s.topicTrie.RemoveSubs(connect.Id.String())
-
-			// remove from clients
-			s.clientsLock.Lock()
-			delete(s.clients, connect.Id.String())
-			s.clientsLock.Unlock()
-
-			// stop writePump
-			close(writeChan)
-
-			// yeet on outa here
-			return
-		default:
-			log.Fatalf(
-				"invalid packet type from %s: %s\n",
-				connect.Id.String(),
-				p.fh.Pt.String(),
-			)
-		}
-	}
-}
 
-// TODO: make all these errors graceful
-func (s *Server) readPump(
-	conn net.Conn,
-	ctx context.Context,
-	send chan<- Packet,
-) {
-	buf := make([]byte, s.maxPacketSize)
-	accum := 0
-
-pump:
-	for {
-		select {
-		case <-ctx.Done():
-			close(send)
-			return
-		default:
-			// read some data into a buffer
-			n, err := conn.Read(buf[accum:])
-			if err != nil {
-				log.Fatalf(
-					"error reading from conn: %v\n",
-					err,
-				)
-			}
-			accum += n
-
-			// parse up all the packets from the buffer
-			for {
-				if accum < 2 {
-					// not enough data to read a fixed header
-					continue pump
-				}
-
-				fh := s.fp.GetFH()
-
-				offset := packets.DecodeFixedHeader(
-					&fh,
-					buf,
-				)
-				if offset == -1 {
-					if accum > 5 {
-						// we have enough data for a full fixed header,
-						// so this is a true error
-						log.Fatalf(
-							"error decoding fixed header\n",
-						)
-					}
-
-					// we might not have read enough
-					// for the full fixed header
-					s.fp.ReturnFH(fh)
-					continue pump
-				}
-
-				if offset+int(fh.RemLen) > accum {
-					// PERF: this means we're doing extra fh decoding
-					continue pump
-				}
-
-				b := s.bp.GetBuf()
-				nn := copy(b, buf[:offset+int(fh.RemLen)])
-				if nn < offset+int(fh.RemLen) {
-					b = append(
-						b,
-						buf[nn:offset+int(fh.RemLen)]...,
-					)
-				}
-
-				send <- Packet{
-					fh:  &fh,
-					buf: b[:offset+int(fh.RemLen)],
-				}
-
-				clear(buf[:offset+int(fh.RemLen)])
-				copy(buf, buf[offset+int(fh.RemLen):])
-				accum -= offset + int(fh.RemLen)
-			}
-		}
+	s.clientsLock.Lock()
+	if s.closing.Load() {
+		// Shutdown has already told everyone to go and might be waiting on
+		// s.wg, which can't be added to once it's at zero
+		s.clientsLock.Unlock()
+		c.sendDisconnect(packets.SSD)
+		conn.Close()
+		c.queue.close()
+		s.connLimiter.release(conn.RemoteAddr())
+		return
 	}
+	old, takeover := s.clients[c.id]
+	if takeover {
+		// TODO: send DISCONNECT with STO to the old connection
+		old.conn.Close()
+		// the old session ends with its connection, which is what the
+		// CONNACK told the new one, but the old client's removeClient
+		// won't find itself in the map anymore to clear it
+		s.topicTrie.RemoveSubs(c.id)
+	}
+	s.clients[c.id] = c
+	// added while holding clientsLock, so either Shutdown sees this client
+	// or we saw it closing
+	s.wg.Add(1)
+	s.clientsLock.Unlock()
+	if takeover {
+		s.sessionExpired(c.id)
+	}
+
+	for _, h := range s.hooks {
+		h.OnConnect(c)
+	}
+	c.Run(s.ctx)
+	s.wg.Done()
+	s.connLimiter.release(conn.RemoteAddr())
 }
 
-func (s *Server) writePump(
-	conn net.Conn,
-	ctx context.Context,
-	recv <-chan []byte,
-) {
-	for {
-		select {
-		case <-ctx.Done():
-		case buf := <-recv:
-			n, err := conn.Write(buf)
-			if err != nil {
-				log.Fatalf("error writting to conn: %v\n", err)
-			}
-			if n != len(buf) {
-				log.Fatalf("did not write full buf\n")
-			}
-			s.bp.ReturnBuf(buf)
-		}
-	}
-}
+var ServerClosed = errors.New("server closed")
 
-func (s *Server) setupClient(
-	conn net.Conn,
-) (packets.Connect, packets.Properties) {
-	// timeout and wait for CONNECT packet
-	buf := s.bp.GetBuf()
-	fh := s.fp.GetFH()
+// Shutdown stops the server gracefully. it stops accepting connections,
+// sends every client a DISCONNECT with SSD, and waits for them to finish
+// until ctx is done. Serve returns ServerClosed once this has been called
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
 
-	n, err := conn.Read(buf)
-	if err != nil {
-		log.Fatalf("error reading from conn: %v\n", err)
+	s.listenersLock.Lock()
+	for _, l := range s.listeners {
+		l.Close()
 	}
-	offset := packets.DecodeFixedHeader(&fh, buf)
-	if offset == -1 {
-		log.Fatalf("error decoding fixed header\n")
+	httpServers := s.httpServers
+	s.listenersLock.Unlock()
+	for _, hs := range httpServers {
+		hs.Shutdown(ctx)
 	}
-	if fh.Pt != packets.CONNECT {
-		log.Fatalf("client sent packet other than connect first\n")
+
+	// every client gets what's already queued for it, then the DISCONNECT,
+	// and is closed once that's written. anyone still going when ctx is
+	// done gets cut off
+	s.clientsLock.RLock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
 	}
-	for n < int(fh.RemLen)+offset {
-		b := s.bp.GetBuf()
-		nn, err := conn.Read(b)
-		if err != nil {
-			log.Fatalf("error readind from conn: %v\n", err)
-		}
-		buf = append(buf, b...)
-		n += nn
-		s.bp.ReturnBuf(b)
+	s.clientsLock.RUnlock()
+	for _, c := range clients {
+		c.queueDisconnect(packets.SSD)
 	}
 
-	connect := packets.Connect{}
-	connect.Zero()
-	willProps := packets.Properties{}
-	willProps.Zero()
-	props := packets.Properties{}
-	props.Zero()
-	err = packets.DecodeConnect(
-		&connect,
-		buf[offset:n],
-		&props,
-		&willProps,
-	)
-	if err != nil {
-		log.Fatalf("ahh! error decoding connect:\n%v", err)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	defer s.cancel()
+	select {
+	case <-done:
+		s.logger.Info("server shut down")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	// set up buf and packets for connack
-	clear(buf)
-	props.Zero()
-	connack := packets.Connack{}
-	connack.Zero()
-	scratch := s.bp.GetBuf()
+// ValidatePayloadFormat makes the server check that PUBLISH payloads with a
+// payload format indicator of 1 are valid utf8, clients that send one that
+// isn't get disconnected with PFI. this is not safe to call once the server
+// has started
+func (s *Server) ValidatePayloadFormat(validate bool) {
+	s.validatePfi = validate
+}
 
-	// encode connack packet and write to connection
-	l := packets.EncodeConnack(&connack, &props, buf, scratch)
-	n, err = conn.Write(buf[:l])
-	if err != nil {
-		log.Fatalf("ahh error writing to conn: %v\n", err)
-	}
+// AllowMQTT31 makes the server accept MQTT 3.1 clients, the ones that
+// connect with the protocol name MQIsdp, alongside 3.1.1 and 5 ones. they're
+// turned away by default. this is not safe to call once the server has
+// started
+func (s *Server) AllowMQTT31(allow bool) {
+	s.allowV31 = allow
+}
 
-	// cleanup
-	s.bp.ReturnBuf(scratch)
-	s.bp.ReturnBuf(buf)
+// removeClient drops all the server state for a client, it's a noop if the
+// client has already been replaced by a newer connection with the same id
+func (s *Server) removeClient(c *Client) {
+	s.clientsLock.Lock()
+	if s.clients[c.id] != c {
+		s.clientsLock.Unlock()
+		return
+	}
+	s.topicTrie.RemoveSubs(c.id)
+	delete(s.clients, c.id)
+	s.clientsLock.Unlock()
 
-	return connect, willProps
+	s.sessionExpired(c.id)
+}
 
+// sessionExpired runs the hooks for a session that's been thrown away
+func (s *Server) sessionExpired(id string) {
+	// TODO: once sessions outlive their connections, this moves to wherever
+	// they expire
+	for _, h := range s.hooks {
+		h.OnSessionExpired(id)
+	}
 }
 
 type Packet struct {
@@ -0,0 +1,354 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// testServer serves s on an in memory listener until the test is done
+func testServer(t *testing.T, s *Server) *PipeListener {
+	t.Helper()
+	return testServerPolicy(t, s, ListenerPolicy{})
+}
+
+// testServerPolicy is testServer with a listener that has policy
+func testServerPolicy(
+	t *testing.T,
+	s *Server,
+	policy ListenerPolicy,
+) *PipeListener {
+	t.Helper()
+	pl := NewPipeListener()
+	testServe(t, s, NewListener("test", pl, policy))
+	return pl
+}
+
+// testServe serves s on listeners until the test is done
+func testServe(t *testing.T, s *Server, listeners ...*Listener) {
+	t.Helper()
+	s.SetLogOutput(io.Discard, LogText)
+	go s.Serve(listeners...)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+}
+
+// testWrite writes whatever encode puts in buf to conn
+func testWrite(t *testing.T, conn net.Conn, encode func(buf, scratch []byte) int) {
+	t.Helper()
+	buf := make([]byte, 4*KB)
+	scratch := make([]byte, 4*KB)
+	n := encode(buf, scratch)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := conn.Write(buf[:n])
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// testRead reads a whole packet from conn, returning its fixed header and
+// the rest of it
+func testRead(t *testing.T, conn net.Conn) (packets.FixedHeader, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	fh := packets.FixedHeader{}
+	off := -1
+	for n := 0; off == -1 && n < 5; n++ {
+		_, err := io.ReadFull(conn, buf[n:n+1])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if n >= 1 {
+			off = packets.DecodeFixedHeader(&fh, buf[:n+1])
+		}
+	}
+	body := make([]byte, fh.RemLen)
+	_, err := io.ReadFull(conn, body)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return fh, body
+}
+
+// testConnect connects a clean start v5 client with id and checks that
+// it's accepted
+func testConnect(t *testing.T, pl *PipeListener, id string) net.Conn {
+	t.Helper()
+	conn, rc := testConnectRc(t, pl, id)
+	if rc != packets.S {
+		t.Fatalf("connect rejected with %d", rc)
+	}
+	return conn
+}
+
+// testConnectRc connects a clean start v5 client with id, returning the
+// CONNACK's reason code
+func testConnectRc(
+	t *testing.T,
+	pl *PipeListener,
+	id string,
+) (net.Conn, packets.ReasonCode) {
+	t.Helper()
+	connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	connect.Id.WriteString(id)
+	return testConnectPacket(t, pl, &connect)
+}
+
+// testConnectPacket sends connect, returning the CONNACK's reason code, or
+// for 3.1.1 and 3.1 its return code as it was sent
+func testConnectPacket(
+	t *testing.T,
+	pl *PipeListener,
+	connect *packets.Connect,
+) (net.Conn, packets.ReasonCode) {
+	t.Helper()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, testConnectConn(t, conn, connect)
+}
+
+// testConnectConn sends connect over a connection that's already open,
+// returning the CONNACK's reason code like testConnectPacket
+func testConnectConn(
+	t *testing.T,
+	conn net.Conn,
+	connect *packets.Connect,
+) packets.ReasonCode {
+	t.Helper()
+	props := packets.Properties{}
+	props.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeConnect(connect, &props, &props, buf, scratch)
+	})
+
+	fh, body := testRead(t, conn)
+	connack := packets.Connack{}
+	props.Zero()
+	var connackProps *packets.Properties
+	if connect.Version == packets.V5 {
+		connackProps = &props
+	}
+	err := packets.DecodeConnack(&connack, connackProps, body)
+	if fh.Pt != packets.CONNACK || err != nil {
+		t.Fatalf("expected connack, got %d: %v", fh.Pt, err)
+	}
+	return connack.ReasonCode
+}
+
+// testSubscribe subscribes conn to filter and waits for the SUBACK
+// testPing round trips a PINGREQ. the CONNACK goes out before the server
+// adds the client to its clients, so this is how tests know it's there
+func testPing(t *testing.T, conn net.Conn) {
+	t.Helper()
+	testWrite(t, conn, func(buf, _ []byte) int {
+		return packets.EncodePingreq(buf)
+	})
+	if fh, _ := testRead(t, conn); fh.Pt != packets.PINGRESP {
+		t.Fatalf("got packet type %d, want %d", fh.Pt, packets.PINGRESP)
+	}
+}
+
+func testSubscribe(t *testing.T, conn net.Conn, filter string) {
+	t.Helper()
+	sub := packets.Subscribe{PacketId: 1}
+	sub.TopicFilters = make([]packets.TopicFilter, 1)
+	sub.TopicFilters[0].Filter.WriteString(filter)
+	props := packets.Properties{}
+	props.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeSubscribe(&sub, &props, buf, scratch)
+	})
+	fh, _ := testRead(t, conn)
+	if fh.Pt != packets.SUBACK {
+		t.Fatalf("expected suback, got %d", fh.Pt)
+	}
+}
+
+// sessionHook reports clients connecting and sessions expiring
+type sessionHook struct {
+	HookBase
+	connected chan string
+	expired   chan string
+}
+
+func newSessionHook() *sessionHook {
+	return &sessionHook{
+		connected: make(chan string, 8),
+		expired:   make(chan string, 8),
+	}
+}
+
+func (h *sessionHook) OnConnect(c *Client) {
+	h.connected <- c.Id()
+}
+
+func (h *sessionHook) OnSessionExpired(id string) {
+	h.expired <- id
+}
+
+func testRecv(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestTakeoverClearsSession(t *testing.T) {
+	s := NewServer()
+	hook := newSessionHook()
+	s.AddHook(hook)
+	pl := testServer(t, &s)
+
+	old := testConnect(t, pl, "c")
+	testRecv(t, hook.connected, "c")
+	testSubscribe(t, old, "a/b")
+
+	testConnect(t, pl, "c")
+	testRecv(t, hook.connected, "c")
+	testRecv(t, hook.expired, "c")
+
+	// the new connection was told it has no session, so it can't have the
+	// old one's subscriptions
+	matches := s.topicTrie.FindMatches(strings.Split("a/b", "/"))
+	if len(matches) != 0 {
+		t.Fatalf("old subscriptions survived the takeover: %v", matches)
+	}
+}
+
+func TestShutdownFlushesQueues(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	conn := testConnect(t, pl, "c")
+	testSubscribe(t, conn, "a/b")
+
+	// the client isn't reading yet, so this is still waiting to be written
+	// when the DISCONNECT gets queued
+	_, err := s.Publish("a/b", []byte("last"), PublishOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	for _, pt := range []packets.PacketType{packets.PUBLISH, packets.DISCONNECT} {
+		fh, body := testRead(t, conn)
+		if fh.Pt != pt {
+			t.Fatalf("got packet type %d, want %d", fh.Pt, pt)
+		}
+		if pt == packets.DISCONNECT && body[0] != byte(packets.SSD) {
+			t.Fatalf("disconnected with %d", body[0])
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+// gateHook holds clients up in OnConnectAuthenticate until open is closed
+type gateHook struct {
+	HookBase
+	entered chan struct{}
+	open    chan struct{}
+}
+
+func (h *gateHook) OnConnectAuthenticate(c *Client, creds *Credentials) error {
+	h.entered <- struct{}{}
+	<-h.open
+	return nil
+}
+
+func TestShutdownDuringConnect(t *testing.T) {
+	s := NewServer()
+	hook := &gateHook{entered: make(chan struct{}, 1), open: make(chan struct{})}
+	s.AddHook(hook)
+	pl := testServer(t, &s)
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	connect.Id.WriteString("late")
+	props := packets.Properties{}
+	props.Zero()
+	testWrite(t, conn, func(buf, scratch []byte) int {
+		return packets.EncodeConnect(&connect, &props, &props, buf, scratch)
+	})
+	<-hook.entered
+
+	// the client finishes connecting after Shutdown has gone looking for
+	// clients to disconnect
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	for !s.closing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	close(hook.open)
+
+	for _, pt := range []packets.PacketType{packets.CONNACK, packets.DISCONNECT} {
+		fh, body := testRead(t, conn)
+		if fh.Pt != pt {
+			t.Fatalf("got packet type %d, want %d", fh.Pt, pt)
+		}
+		if pt == packets.DISCONNECT && body[0] != byte(packets.SSD) {
+			t.Fatalf("disconnected with %d", body[0])
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection still open: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestShutdownHonorsContext(t *testing.T) {
+	s := NewServer()
+	pl := testServer(t, &s)
+	for _, id := range []string{"a", "b", "c"} {
+		testConnect(t, pl, id)
+	}
+
+	// none of the clients read their DISCONNECT, so they can't finish
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("shutdown took %v", d)
+	}
+}
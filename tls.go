@@ -0,0 +1,244 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions configures a TLS listener, see ListenTLS
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// if ClientCAFile is set, client certificates are verified against the
+	// CA bundle in it, and if RequireClientCert is set clients without one
+	// are rejected during the handshake
+	ClientCAFile      string
+	RequireClientCert bool
+
+	// which part of a verified client certificate, if any, to use as the
+	// client's username or client id. the certificate identity wins over
+	// whatever the client sent in its CONNECT
+	UsernameFromCert CertIdentity
+	ClientIdFromCert CertIdentity
+
+	// how often to check the cert, key and CA files for changes,
+	// zero means DefaultCertPollInterval
+	PollInterval time.Duration
+}
+
+type CertIdentity byte
+
+const (
+	CertNone       CertIdentity = iota
+	CertCommonName              // the subject common name
+	CertSubject                 // the whole subject, like "CN=foo,O=bar"
+)
+
+const DefaultCertPollInterval = 10 * time.Second
+
+var NoCertIdentity = errors.New("client certificate has no usable identity")
+
+// ListenTLS listens for MQTT over TLS, which usually runs on port 8883.
+// certificates are reloaded whenever their files change, new connections
+// pick up the new certificates and existing ones are left alone
+func ListenTLS(
+	name string,
+	addr string,
+	opts TLSOptions,
+	policy ListenerPolicy,
+) (*Listener, error) {
+	if opts.RequireClientCert && opts.ClientCAFile == "" {
+		return nil, errors.New("RequireClientCert needs a ClientCAFile")
+	}
+
+	cr := &certReloader{opts: opts}
+	err := cr.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{
+		Name:   name,
+		Policy: policy,
+		ln:     tls.NewListener(proxyWrap(ln, policy), cr.config()),
+		certs:  cr,
+	}, nil
+}
+
+// StartTLS is like Start, but for MQTT over TLS, see ListenTLS
+func (s *Server) StartTLS(addr string, opts TLSOptions) error {
+	l, err := ListenTLS("tls", addr, opts, ListenerPolicy{})
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ReloadTLS rereads the certificates for every TLS listener right away,
+// instead of waiting for the next poll
+func (s *Server) ReloadTLS() error {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	var errs []error
+	for _, l := range s.listeners {
+		if l.certs != nil {
+			errs = append(errs, l.certs.Reload())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// peerCert returns the verified leaf certificate of a TLS client, or nil.
+// the handshake has already happened by the time the CONNECT is read
+func peerCert(conn net.Conn) *x509.Certificate {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+func (ci CertIdentity) from(cert *x509.Certificate) string {
+	switch ci {
+	case CertCommonName:
+		return cert.Subject.CommonName
+	case CertSubject:
+		return cert.Subject.String()
+	default:
+		return ""
+	}
+}
+
+// certReloader holds the current certificates for a TLS listener,
+// swapping them out when the files on disk change
+type certReloader struct {
+	opts TLSOptions
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	cas     *x509.CertPool
+	modTime time.Time
+}
+
+func (cr *certReloader) Reload() error {
+	modTime := cr.latestModTime()
+
+	cert, err := tls.LoadX509KeyPair(cr.opts.CertFile, cr.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var cas *x509.CertPool
+	if cr.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(cr.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in client CA file")
+		}
+	}
+
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.cas = cas
+	cr.modTime = modTime
+	cr.lock.Unlock()
+
+	return nil
+}
+
+func (cr *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{
+		cr.opts.CertFile,
+		cr.opts.KeyFile,
+		cr.opts.ClientCAFile,
+	} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (cr *certReloader) watch(ctx context.Context, logger *slog.Logger) {
+	interval := cr.opts.PollInterval
+	if interval == 0 {
+		interval = DefaultCertPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cr.lock.RLock()
+			changed := cr.latestModTime().After(cr.modTime)
+			cr.lock.RUnlock()
+			if !changed {
+				continue
+			}
+
+			// the files might be halfway through being replaced,
+			// in which case we just try again on the next tick
+			err := cr.Reload()
+			if err != nil {
+				logger.Error("error reloading certificates", "err", err)
+			} else {
+				logger.Info("reloaded certificates", "cert_file", cr.opts.CertFile)
+			}
+		}
+	}
+}
+
+func (cr *certReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.lock.RLock()
+			defer cr.lock.RUnlock()
+
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+			}
+			if cr.cas != nil {
+				conf.ClientCAs = cr.cas
+				conf.ClientAuth = tls.VerifyClientCertIfGiven
+				if cr.opts.RequireClientCert {
+					conf.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return conf, nil
+		},
+	}
+}
@@ -0,0 +1,443 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// testCA signs certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating ca: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing ca: %v", err)
+	}
+	return testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue signs a leaf certificate for subject, returning the cert and key
+// as pem. server certs are good for 127.0.0.1
+func (ca testCA) issue(
+	t *testing.T,
+	subject pkix.Name,
+	server bool,
+) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("generating serial: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert is issue for a client, as something tls.Config can use
+func (ca testCA) clientCert(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, subject, false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("loading client cert: %v", err)
+	}
+	return cert
+}
+
+// writeServerCert issues a server cert named name and writes it and its key
+// over the files in opts
+func (ca testCA) writeServerCert(t *testing.T, opts TLSOptions, name string) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, pkix.Name{CommonName: name}, true)
+	if err := os.WriteFile(opts.CertFile, certPEM, 0o600); err != nil {
+		t.Fatalf("writing cert: %v", err)
+	}
+	if err := os.WriteFile(opts.KeyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+}
+
+// tlsServer serves s over TLS on localhost with a server cert named
+// "server-a" signed by ca, and client certs checked against ca
+func tlsServer(
+	t *testing.T,
+	s *Server,
+	ca testCA,
+	opts TLSOptions,
+) (string, TLSOptions) {
+	t.Helper()
+	dir := t.TempDir()
+	opts.CertFile = filepath.Join(dir, "server.pem")
+	opts.KeyFile = filepath.Join(dir, "server.key")
+	opts.ClientCAFile = filepath.Join(dir, "ca.pem")
+	ca.writeServerCert(t, opts, "server-a")
+	if err := os.WriteFile(opts.ClientCAFile, ca.pem, 0o600); err != nil {
+		t.Fatalf("writing ca: %v", err)
+	}
+
+	l, err := ListenTLS("tls", "127.0.0.1:0", opts, ListenerPolicy{})
+	if err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	testServe(t, s, l)
+	return l.Addr().String(), opts
+}
+
+// tlsDial connects to addr trusting ca, presenting certs if there are any
+func tlsDial(
+	t *testing.T,
+	addr string,
+	ca testCA,
+	certs ...tls.Certificate,
+) *tls.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: certs,
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// serverName is the common name of the cert the server handed conn
+func serverName(conn *tls.Conn) string {
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// tlsConnect is a v5 CONNECT for id, with username if it isn't empty
+func tlsConnect(id, username string) *packets.Connect {
+	connect := packets.Connect{Version: packets.V5, Flags: 0b00000010}
+	connect.Id.WriteString(id)
+	if username != "" {
+		connect.Flags |= 0b10000000
+		connect.Username.WriteString(username)
+	}
+	return &connect
+}
+
+// expectClosed checks the server hangs up on conn without a CONNACK
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	props := packets.Properties{}
+	props.Zero()
+	buf, scratch := make([]byte, 256), make([]byte, 256)
+	n := packets.EncodeConnect(tlsConnect("c", ""), &props, &props, buf, scratch)
+	// the write can fail too, if the handshake already has
+	conn.Write(buf[:n])
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err == nil {
+		t.Fatalf("read %d bytes, want the connection closed", n)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("connection left open")
+	}
+}
+
+func TestTLSCertIdentity(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	subject := pkix.Name{CommonName: "sensor-1", Organization: []string{"acme"}}
+
+	tests := []struct {
+		name         string
+		opts         TLSOptions
+		wantId       string
+		wantUsername string
+	}{
+		{
+			name:         "none",
+			opts:         TLSOptions{},
+			wantId:       "c",
+			wantUsername: "",
+		},
+		{
+			name:         "common name",
+			opts:         TLSOptions{UsernameFromCert: CertCommonName},
+			wantId:       "c",
+			wantUsername: "sensor-1",
+		},
+		{
+			name:         "subject",
+			opts:         TLSOptions{UsernameFromCert: CertSubject},
+			wantId:       "c",
+			wantUsername: "CN=sensor-1,O=acme",
+		},
+		{
+			name: "client id",
+			opts: TLSOptions{
+				ClientIdFromCert: CertCommonName,
+				UsernameFromCert: CertCommonName,
+			},
+			wantId:       "sensor-1",
+			wantUsername: "sensor-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			hook := &credsHook{creds: make(chan Credentials, 1)}
+			s.AddHook(hook)
+			addr, _ := tlsServer(t, &s, ca, tt.opts)
+
+			conn := tlsDial(t, addr, ca, ca.clientCert(t, subject))
+			rc := testConnectConn(t, conn, tlsConnect("c", ""))
+			if rc != packets.S {
+				t.Fatalf("connack = %v, want %v", rc, packets.S)
+			}
+
+			creds := <-hook.creds
+			if creds.ClientId != tt.wantId {
+				t.Fatalf("client id = %q, want %q", creds.ClientId, tt.wantId)
+			}
+			if creds.Username != tt.wantUsername {
+				t.Fatalf("username = %q, want %q", creds.Username, tt.wantUsername)
+			}
+			if creds.HasUsername != (tt.wantUsername != "") {
+				t.Fatalf("has username = %v", creds.HasUsername)
+			}
+			if creds.PeerCert == nil || creds.PeerCert.Subject.CommonName != "sensor-1" {
+				t.Fatalf("peer cert = %v, want sensor-1's", creds.PeerCert)
+			}
+		})
+	}
+}
+
+func TestTLSMissingCertIdentity(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+
+	tests := []struct {
+		name string
+		opts TLSOptions
+		want packets.ReasonCode
+	}{
+		{
+			name: "username",
+			opts: TLSOptions{UsernameFromCert: CertCommonName},
+			want: packets.BUNoP,
+		},
+		{
+			name: "client id",
+			opts: TLSOptions{ClientIdFromCert: CertCommonName},
+			want: packets.CInV,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			addr, _ := tlsServer(t, &s, ca, tt.opts)
+
+			// no client cert at all
+			conn := tlsDial(t, addr, ca)
+			rc := testConnectConn(t, conn, tlsConnect("c", "claimed"))
+			if rc != tt.want {
+				t.Fatalf("connack = %v, want %v", rc, tt.want)
+			}
+
+			// a cert with nothing in the part we're told to use
+			conn = tlsDial(t, addr, ca, ca.clientCert(t, pkix.Name{
+				Organization: []string{"acme"},
+			}))
+			rc = testConnectConn(t, conn, tlsConnect("c", ""))
+			if rc != tt.want {
+				t.Fatalf("connack = %v, want %v", rc, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSRequireClientCert(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	other := newTestCA(t, "other ca")
+	subject := pkix.Name{CommonName: "sensor-1"}
+
+	s := NewServer()
+	addr, _ := tlsServer(t, &s, ca, TLSOptions{RequireClientCert: true})
+
+	t.Run("no cert", func(t *testing.T) {
+		conn := tlsDial(t, addr, ca)
+		expectClosed(t, conn)
+	})
+	t.Run("untrusted cert", func(t *testing.T) {
+		conn := tlsDial(t, addr, ca, other.clientCert(t, subject))
+		expectClosed(t, conn)
+	})
+	t.Run("trusted cert", func(t *testing.T) {
+		conn := tlsDial(t, addr, ca, ca.clientCert(t, subject))
+		rc := testConnectConn(t, conn, tlsConnect("c", ""))
+		if rc != packets.S {
+			t.Fatalf("connack = %v, want %v", rc, packets.S)
+		}
+	})
+
+	_, err := ListenTLS("tls", "127.0.0.1:0", TLSOptions{
+		CertFile:          "server.pem",
+		KeyFile:           "server.key",
+		RequireClientCert: true,
+	}, ListenerPolicy{})
+	if err == nil {
+		t.Fatalf("ListenTLS without a ClientCAFile succeeded")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	s := NewServer()
+	addr, opts := tlsServer(t, &s, ca, TLSOptions{
+		RequireClientCert: true,
+		PollInterval:      time.Hour,
+	})
+	subject := pkix.Name{CommonName: "sensor-1"}
+	client := ca.clientCert(t, subject)
+
+	old := tlsDial(t, addr, ca, client)
+	if rc := testConnectConn(t, old, tlsConnect("old", "")); rc != packets.S {
+		t.Fatalf("connack = %v, want %v", rc, packets.S)
+	}
+	if name := serverName(old); name != "server-a" {
+		t.Fatalf("server cert = %q, want server-a", name)
+	}
+
+	// nothing changes until we reload
+	ca.writeServerCert(t, opts, "server-b")
+	if name := serverName(tlsDial(t, addr, ca, client)); name != "server-a" {
+		t.Fatalf("server cert before reload = %q, want server-a", name)
+	}
+	if err := s.ReloadTLS(); err != nil {
+		t.Fatalf("ReloadTLS: %v", err)
+	}
+	if name := serverName(tlsDial(t, addr, ca, client)); name != "server-b" {
+		t.Fatalf("server cert after reload = %q, want server-b", name)
+	}
+
+	// connections from before the reload keep working
+	testWrite(t, old, func(buf, _ []byte) int {
+		return packets.EncodePingreq(buf)
+	})
+	if fh, _ := testRead(t, old); fh.Pt != packets.PINGRESP {
+		t.Fatalf("got packet %d, want PINGRESP", fh.Pt)
+	}
+
+	// a bad cert file leaves the current certs in place
+	if err := os.WriteFile(opts.CertFile, []byte("junk"), 0o600); err != nil {
+		t.Fatalf("writing cert: %v", err)
+	}
+	if err := s.ReloadTLS(); err == nil {
+		t.Fatalf("ReloadTLS with a bad cert succeeded")
+	}
+	if name := serverName(tlsDial(t, addr, ca, client)); name != "server-b" {
+		t.Fatalf("server cert after failed reload = %q, want server-b", name)
+	}
+
+	// and a new client CA drops clients signed by the old one
+	other := newTestCA(t, "other ca")
+	ca.writeServerCert(t, opts, "server-c")
+	if err := os.WriteFile(opts.ClientCAFile, other.pem, 0o600); err != nil {
+		t.Fatalf("writing ca: %v", err)
+	}
+	if err := s.ReloadTLS(); err != nil {
+		t.Fatalf("ReloadTLS: %v", err)
+	}
+	expectClosed(t, tlsDial(t, addr, ca, client))
+	conn := tlsDial(t, addr, ca, other.clientCert(t, subject))
+	if rc := testConnectConn(t, conn, tlsConnect("c", "")); rc != packets.S {
+		t.Fatalf("connack = %v, want %v", rc, packets.S)
+	}
+}
+
+func TestTLSReloadPoll(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	s := NewServer()
+	addr, opts := tlsServer(t, &s, ca, TLSOptions{
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	// bump the mod time in case the write lands in the same tick of the
+	// file system's clock as the first one
+	ca.writeServerCert(t, opts, "server-b")
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{opts.CertFile, opts.KeyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serverName(tlsDial(t, addr, ca)) != "server-b" {
+		if time.Now().After(deadline) {
+			t.Fatalf("server cert never reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
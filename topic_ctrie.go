@@ -1,7 +1,9 @@
 package mqtt
 
 import (
-	"log"
+	"bytes"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -35,46 +37,93 @@ func (t *TopicTrie) FindMatches(topic []string) (matches []string) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	// TODO:
-	// - might want some kind of set to check if we've added a match already
-	// (for situations where multiple subs for a client match the topic)
-
 	currNodes := []int{0}
 	for _, level := range topic {
-		for i, node := range currNodes {
-			child, ok := t.nodes[node].children[level]
-			if ok {
-				currNodes[i] = child
-			} else {
-				currNodes[i] = currNodes[len(currNodes)-1]
-				currNodes = currNodes[:len(currNodes)-1]
-			}
-
-			wildHash, ok := t.nodes[node].children["#"]
-			if ok {
-				matches = append(
-					matches,
-					t.nodes[wildHash].subs...,
-				)
-			}
-
-			plusHash, ok := t.nodes[node].children["+"]
-			if ok {
-				currNodes = append(currNodes, plusHash)
-			}
-		}
+		currNodes, matches = t.descend(
+			currNodes,
+			matches,
+			func(node int) (int, bool) {
+				child, ok := t.nodes[node].children[level]
+				return child, ok
+			},
+		)
 	}
 
 	for _, node := range currNodes {
-		for _, match := range t.nodes[node].subs {
-			log.Printf("found a match! %s\n", match)
-			matches = append(matches, match)
+		matches = append(matches, t.nodes[node].subs...)
+	}
+
+	return
+}
+
+// FindMatchesBytes is FindMatches for a topic that hasn't been split into
+// levels or made into a string, like one read straight out of a PUBLISH
+func (t *TopicTrie) FindMatchesBytes(topic []byte) (matches []string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	currNodes := []int{0}
+	for {
+		level, rest, more := bytes.Cut(topic, []byte{'/'})
+		currNodes, matches = t.descend(
+			currNodes,
+			matches,
+			func(node int) (int, bool) {
+				// indexing with a converted []byte doesn't allocate
+				child, ok := t.nodes[node].children[string(level)]
+				return child, ok
+			},
+		)
+		if !more {
+			break
 		}
+		topic = rest
+	}
+
+	for _, node := range currNodes {
+		matches = append(matches, t.nodes[node].subs...)
 	}
 
 	return
 }
 
+// descend moves currNodes down a level of the topic, child looks up a
+// node's child for the level. t has to be locked
+func (t *TopicTrie) descend(
+	currNodes []int,
+	matches []string,
+	child func(node int) (int, bool),
+) ([]int, []string) {
+	// TODO:
+	// - might want some kind of set to check if we've added a match already
+	// (for situations where multiple subs for a client match the topic)
+
+	for i, node := range currNodes {
+		c, ok := child(node)
+		if ok {
+			currNodes[i] = c
+		} else {
+			currNodes[i] = currNodes[len(currNodes)-1]
+			currNodes = currNodes[:len(currNodes)-1]
+		}
+
+		wildHash, ok := t.nodes[node].children["#"]
+		if ok {
+			matches = append(
+				matches,
+				t.nodes[wildHash].subs...,
+			)
+		}
+
+		plusHash, ok := t.nodes[node].children["+"]
+		if ok {
+			currNodes = append(currNodes, plusHash)
+		}
+	}
+
+	return currNodes, matches
+}
+
 // add a subscription to the tree
 // topic should be vaild and checked for errors
 func (t *TopicTrie) AddSubscription(topic []string, cid string) {
@@ -101,17 +150,70 @@ func (t *TopicTrie) AddSubscription(topic []string, cid string) {
 	currNode.subs = append(currNode.subs, cid)
 }
 
+// RemoveSubscription removes the client's subscription to topic, returning
+// false if it didn't have one. nodes are left in place even if they end up
+// empty
+func (t *TopicTrie) RemoveSubscription(topic []string, cid string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	currNode := &t.nodes[0] // root
+	for _, level := range topic {
+		child, ok := currNode.children[level]
+		if !ok {
+			return false
+		}
+		currNode = &t.nodes[child]
+	}
+
+	l := len(currNode.subs)
+	currNode.subs = slices.DeleteFunc(
+		currNode.subs,
+		func(s string) bool { return s == cid },
+	)
+	return len(currNode.subs) < l
+}
+
+// NodeCount is how many nodes are in the trie, including the root
+func (t *TopicTrie) NodeCount() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.nodes)
+}
+
+// Subscriptions walks the whole trie, for inspecting it. it's not meant for
+// the hot path
+func (t *TopicTrie) Subscriptions() []SubscriptionInfo {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var subs []SubscriptionInfo
+	var walk func(n int, levels []string)
+	walk = func(n int, levels []string) {
+		for _, cid := range t.nodes[n].subs {
+			subs = append(subs, SubscriptionInfo{
+				ClientId: cid,
+				Filter:   strings.Join(levels, "/"),
+			})
+		}
+		for level, child := range t.nodes[n].children {
+			walk(child, append(levels, level))
+		}
+	}
+	walk(0, nil)
+
+	return subs
+}
+
 // PERF: this is slow as fuck (maybe)
 func (t *TopicTrie) RemoveSubs(cid string) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	for _, n := range t.nodes {
-		for i, s := range n.subs {
-			if s == cid {
-				n.subs[i] = n.subs[len(n.subs)-1]
-				n.subs = n.subs[:len(n.subs)-1]
-			}
-		}
+	for i := range t.nodes {
+		t.nodes[i].subs = slices.DeleteFunc(
+			t.nodes[i].subs,
+			func(s string) bool { return s == cid },
+		)
 	}
 }
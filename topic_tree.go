@@ -11,13 +11,14 @@ TODO:
 package mqtt
 
 import (
-	"log"
+	"log/slog"
 	"strings"
 )
 
 type TopicTree struct {
 	nodes  []topicNode
 	cidMap map[string]chan<- []byte
+	log    *slog.Logger
 
 	pubChan    <-chan PubMsg
 	subChan    <-chan SubMsg
@@ -54,13 +55,15 @@ type RemCliMsg struct {
 // these channels should be buffered,
 // everything you pass to these channels is assumed to be valid input
 // and should be parsed and checked before you send to here, this is because
-// passing errors back along these channels is difficult to do and pretty messy
+// passing errors back along these channels is difficult to do and pretty messy.
+// the tree logs what it's doing to logger at debug level
 func NewTopicTree(
 	pubChan <-chan PubMsg,
 	subChan <-chan SubMsg,
 	addCliChan <-chan AddCliMsg,
 	unSubChan <-chan UnSubMsg,
 	remCliChan <-chan RemCliMsg,
+	logger *slog.Logger,
 ) TopicTree {
 	return TopicTree{
 		nodes: []topicNode{{
@@ -73,6 +76,7 @@ func NewTopicTree(
 		remCliChan: remCliChan,
 		unSubChan:  unSubChan,
 		cidMap:     make(map[string]chan<- []byte),
+		log:        logger,
 	}
 }
 
@@ -111,14 +115,18 @@ func (t *TopicTree) handleSub(sub SubMsg) {
 			}
 			currNode = &t.nodes[child]
 		}
-		log.Printf("adding %s to %v\n", sub.ClientId, currNode)
+		t.log.Debug(
+			"adding subscription",
+			"client_id", sub.ClientId,
+			"filter", strings.Join(filter, "/"),
+		)
 		currNode.subs = append(currNode.subs, sub.ClientId)
 	}
 }
 
 // this is the function we want to optimize our datastructure for
 func (t *TopicTree) handlePub(pub PubMsg) {
-	log.Printf("got a pub in tt\n")
+	t.log.Debug("publishing", "topic", pub.Topic)
 	levels := strings.Split(pub.Topic, "/")
 	currNodes := []int{0}
 	for _, l := range levels {
@@ -140,7 +148,7 @@ func (t *TopicTree) handlePub(pub PubMsg) {
 
 			level, ok := node.children[l]
 			if ok {
-				log.Printf("setting currNodes[%d] to %d\n", i, level)
+				t.log.Debug("matched level", "level", l, "node", level)
 				currNodes[i] = level
 			} else {
 				currNodes[i] = currNodes[len(currNodes)-1]
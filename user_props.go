@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/andrew-r-thomas/mqtt/packets"
+)
+
+// a UserPropRule adds a user property to every PUBLISH the broker forwards,
+// Val is called once per inbound PUBLISH with the publishing client and the
+// time the broker received it
+type UserPropRule struct {
+	Name string
+	Val  func(c *Client, recvd time.Time) string
+}
+
+// NodeProp tags forwarded messages with the name of the receiving broker node
+func NodeProp(name string, node string) UserPropRule {
+	return UserPropRule{
+		Name: name,
+		Val:  func(*Client, time.Time) string { return node },
+	}
+}
+
+// IngressTimeProp tags forwarded messages with the time the broker received
+// them, formatted as RFC 3339 with nanoseconds
+func IngressTimeProp(name string) UserPropRule {
+	return UserPropRule{
+		Name: name,
+		Val: func(_ *Client, recvd time.Time) string {
+			return recvd.UTC().Format(time.RFC3339Nano)
+		},
+	}
+}
+
+// UsernameProp tags forwarded messages with the username the publisher
+// connected with, clients that didn't send a username get an empty value
+func UsernameProp(name string) UserPropRule {
+	return UserPropRule{
+		Name: name,
+		Val:  func(c *Client, _ time.Time) string { return c.username },
+	}
+}
+
+// AddUserPropRule registers a rule to be applied to every forwarded PUBLISH,
+// rules are applied in the order they're added, after the publisher's own
+// user properties. this is not safe to call once the server has started
+func (s *Server) AddUserPropRule(rule UserPropRule) {
+	s.userPropRules = append(s.userPropRules, rule)
+}
+
+// outboundPublish builds what gets fanned out to subscribers for an
+// inbound PUBLISH, pub should already be decoded from p. props are its
+// properties, or if rawProps isn't nil, where they get decoded to from
+// rawProps once something needs them. topic is pub's topic if it's already
+// been made into a string, or "". msg is what the hooks were given, if there
+// are any, since they can change it. user properties are kept in the order
+// the publisher sent them
+func (s *Server) outboundPublish(
+	c *Client,
+	p Packet,
+	pub *packets.PublishView,
+	topic string,
+	props *packets.Properties,
+	rawProps []byte,
+	msg *Message,
+) outPublish {
+	out := outPublish{
+		flags:      p.fh.Flags,
+		topic:      topic,
+		topicBytes: pub.Topic(),
+		payload:    pub.Payload(),
+		props:      props,
+		rawProps:   rawProps,
+	}
+	if msg != nil {
+		// the hooks' Properties might be reused by them, or have things in
+		// them that can't be forwarded, so the rules go on a copy
+		out.topic, out.payload = msg.Topic, msg.Payload
+		out.props, out.rawProps = publishProps(msg.Props), nil
+	}
+	qos := (p.fh.Flags >> 1) & 0b11
+	if len(s.userPropRules) == 0 && qos == 0 && msg == nil {
+		// nothing to change, so we can send along the original bytes to
+		// clients on the same version. handlePublish has already thrown
+		// out anything with a subscription identifier or topic alias, so
+		// there's nothing in them that only meant something to the sender
+		out.setEncoded(c.version, p.buf)
+		return out
+	}
+
+	props = out.properties()
+	recvd := time.Now()
+	for _, rule := range s.userPropRules {
+		props.AddUserProp(rule.Name, rule.Val(c, recvd))
+	}
+
+	// TODO: qos 1 and 2 delivery, for now everything goes out at qos 0
+	out.flags &^= 0b00000110
+
+	return out
+}
@@ -0,0 +1,370 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the websocket transport from the MQTT spec (section 6), the websocket
+// framing is handled here and the MQTT side never knows the difference.
+// packets can be split across frames or share them, so frames are read as
+// one continuous byte stream
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation byte = 0
+	wsText         byte = 1
+	wsBinary       byte = 2
+	wsClose        byte = 8
+	wsPing         byte = 9
+	wsPong         byte = 10
+)
+
+var (
+	WsBadHandshake = errors.New("bad websocket handshake")
+	WsBadFrame     = errors.New("bad websocket frame")
+)
+
+// wsHandshakeTimeout is how long a connection gets to send its PROXY header,
+// if the listener wants one, and its upgrade request, and how long we wait
+// to write the response. once it's upgraded the MQTT side sets its own
+// deadlines
+var wsHandshakeTimeout = 10 * time.Second
+
+// ListenWebSocket listens for MQTT over websockets on addr, upgrading
+// requests to path
+func ListenWebSocket(
+	name string,
+	addr string,
+	path string,
+	policy ListenerPolicy,
+) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := NewWebSocketListener(ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(path, wl)
+	// the PROXY header is read along with the request, so it's under the
+	// same deadline, and hijacking the conn clears them all
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: wsHandshakeTimeout,
+		ReadTimeout:       wsHandshakeTimeout,
+		IdleTimeout:       wsHandshakeTimeout,
+	}
+	wl.srv = srv
+	go func() {
+		err := srv.Serve(proxyWrap(ln, policy))
+		wl.closeWith(err)
+	}()
+
+	return &Listener{Name: name, Policy: policy, ln: wl}, nil
+}
+
+// StartWebSocket is like Start, but for MQTT over websockets,
+// see ListenWebSocket
+func (s *Server) StartWebSocket(addr string, path string) error {
+	l, err := ListenWebSocket("websocket", addr, path, ListenerPolicy{})
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// WebSocketListener is a net.Listener that gets its connections from
+// websocket upgrades, it's an http.Handler so it can be mounted into an
+// existing http server and passed to NewListener
+type WebSocketListener struct {
+	addr  net.Addr
+	srv   *http.Server // only if we own it
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (wl *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+	select {
+	case wl.conns <- conn:
+	case <-wl.done:
+		conn.Close()
+	}
+}
+
+func (wl *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, wl.err
+	}
+}
+
+func (wl *WebSocketListener) Close() error {
+	wl.closeWith(net.ErrClosed)
+	if wl.srv != nil {
+		return wl.srv.Close()
+	}
+	return nil
+}
+
+func (wl *WebSocketListener) closeWith(err error) {
+	wl.once.Do(func() {
+		wl.err = err
+		close(wl.done)
+	})
+}
+
+func (wl *WebSocketListener) Addr() net.Addr {
+	return wl.addr
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, WsBadHandshake.Error(), http.StatusBadRequest)
+		return nil, WsBadHandshake
+	}
+	if !headerHas(r.Header, "Sec-WebSocket-Protocol", "mqtt") {
+		http.Error(w, "mqtt subprotocol required", http.StatusBadRequest)
+		return nil, WsBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't upgrade", http.StatusInternalServerError)
+		return nil, WsBadHandshake
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	conn.SetWriteDeadline(time.Now().Add(wsHandshakeTimeout))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n")
+	rw.WriteString("Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return &wsConn{Conn: conn, br: rw.Reader}, nil
+}
+
+// headerHas checks for a token in a comma separated header, ignoring case
+func headerHas(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn turns a websocket connection back into a plain byte stream
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// what's left of the current data frame
+	remaining uint64
+	mask      [4]byte
+	maskOff   int
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		err := ws.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+	n, err := ws.br.Read(p)
+	for i := range n {
+		p[i] ^= ws.mask[ws.maskOff%4]
+		ws.maskOff += 1
+	}
+	ws.remaining -= uint64(n)
+
+	return n, err
+}
+
+// nextFrame reads frame headers, handling any control frames along the way,
+// until it gets to a data frame
+func (ws *wsConn) nextFrame() error {
+	var head [2]byte
+	_, err := io.ReadFull(ws.br, head[:])
+	if err != nil {
+		return err
+	}
+
+	fin := head[0]&0b10000000 != 0
+	opcode := head[0] & 0b00001111
+	masked := head[1]&0b10000000 != 0
+	l := uint64(head[1] & 0b01111111)
+
+	// clients always have to mask, and extensions aren't supported
+	if !masked || head[0]&0b01110000 != 0 {
+		ws.closeWith(1002)
+		return WsBadFrame
+	}
+
+	switch l {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.br, ext[:])
+		l = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.br, ext[:])
+		l = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(ws.br, ws.mask[:])
+	if err != nil {
+		return err
+	}
+	ws.maskOff = 0
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		ws.remaining = l
+		return nil
+	case wsText:
+		// MQTT has to be sent in binary frames
+		ws.closeWith(1003)
+		return WsBadFrame
+	}
+
+	// control frames have to be small and unfragmented
+	if !fin || l > 125 {
+		ws.closeWith(1002)
+		return WsBadFrame
+	}
+	payload := make([]byte, l)
+	_, err = io.ReadFull(ws.br, payload)
+	if err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= ws.mask[i%4]
+	}
+
+	switch opcode {
+	case wsPing:
+		return ws.writeFrame(wsPong, payload)
+	case wsPong:
+		return nil
+	case wsClose:
+		ws.closeWith(1000)
+		return io.EOF
+	default:
+		ws.closeWith(1002)
+		return WsBadFrame
+	}
+}
+
+// every Write goes out as a single binary frame
+func (ws *wsConn) Write(p []byte) (int, error) {
+	err := ws.writeFrame(wsBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	// servers don't mask
+	head := make([]byte, 2, 10+len(payload))
+	head[0] = 0b10000000 | opcode
+	switch {
+	case len(payload) < 126:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+
+	_, err := ws.Conn.Write(append(head, payload...))
+	return err
+}
+
+// closeWith sends a close frame with the given status code,
+// after which nothing else gets written
+func (ws *wsConn) closeWith(code uint16) {
+	ws.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+
+	ws.writeLock.Lock()
+	ws.closed = true
+	ws.writeLock.Unlock()
+}
+
+func (ws *wsConn) Close() error {
+	ws.writeLock.Lock()
+	closed := ws.closed
+	ws.writeLock.Unlock()
+	if !closed {
+		ws.closeWith(1000)
+	}
+	return ws.Conn.Close()
+}
@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWebSocketHandshakeTimeout(t *testing.T) {
+	old := wsHandshakeTimeout
+	wsHandshakeTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { wsHandshakeTimeout = old })
+
+	for _, tc := range []struct {
+		name  string
+		proxy bool
+		send  string
+	}{
+		{"proxy header", true, ""},
+		{"partial proxy header", true, "PROXY TCP4 "},
+		{"request", false, "GET /mqtt HTTP/1.1\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := ListenWebSocket(
+				"ws", "127.0.0.1:0", "/mqtt",
+				ListenerPolicy{ProxyProtocol: tc.proxy},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tc.send))
+
+			// the server hangs up on us, instead of waiting forever
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("connection wasn't closed: %v", err)
+			}
+		})
+	}
+}
+
+// wsFrame builds a client frame, masked unless told otherwise
+func wsFrame(fin bool, opcode byte, masked bool, payload string) []byte {
+	head := []byte{opcode, 0}
+	if fin {
+		head[0] |= 0b10000000
+	}
+	switch {
+	case len(payload) < 126:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+	if !masked {
+		return append(head, payload...)
+	}
+
+	head[1] |= 0b10000000
+	mask := []byte{1, 2, 3, 4}
+	head = append(head, mask...)
+	for i := range len(payload) {
+		head = append(head, payload[i]^mask[i%4])
+	}
+	return head
+}
+
+// wsServerFrame is what the server sends, which is never masked
+func wsServerFrame(opcode byte, payload string) []byte {
+	return wsFrame(true, opcode, false, payload)
+}
+
+func wsCloseCode(code uint16) string {
+	return string(binary.BigEndian.AppendUint16(nil, code))
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	closeFrame := wsFrame(true, wsClose, true, wsCloseCode(1000))
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		data   string
+		err    error
+		reply  [][]byte
+	}{
+		{
+			name: "binary",
+			frames: [][]byte{
+				wsFrame(true, wsBinary, true, "MQTT"),
+				closeFrame,
+			},
+			data:  "MQTT",
+			err:   io.EOF,
+			reply: [][]byte{wsServerFrame(wsClose, wsCloseCode(1000))},
+		},
+		{
+			name: "extended length",
+			frames: [][]byte{
+				wsFrame(true, wsBinary, true, long),
+				closeFrame,
+			},
+			data:  long,
+			err:   io.EOF,
+			reply: [][]byte{wsServerFrame(wsClose, wsCloseCode(1000))},
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				wsFrame(false, wsBinary, true, "MQ"),
+				wsFrame(false, wsContinuation, true, ""),
+				wsFrame(true, wsContinuation, true, "TT"),
+				closeFrame,
+			},
+			data:  "MQTT",
+			err:   io.EOF,
+			reply: [][]byte{wsServerFrame(wsClose, wsCloseCode(1000))},
+		},
+		{
+			name: "control frames between fragments",
+			frames: [][]byte{
+				wsFrame(false, wsBinary, true, "MQ"),
+				wsFrame(true, wsPing, true, "hello"),
+				wsFrame(true, wsPong, true, "unsolicited"),
+				wsFrame(true, wsContinuation, true, "TT"),
+				closeFrame,
+			},
+			data: "MQTT",
+			err:  io.EOF,
+			reply: [][]byte{
+				wsServerFrame(wsPong, "hello"),
+				wsServerFrame(wsClose, wsCloseCode(1000)),
+			},
+		},
+		{
+			name:   "text",
+			frames: [][]byte{wsFrame(true, wsText, true, "MQTT")},
+			err:    WsBadFrame,
+			reply:  [][]byte{wsServerFrame(wsClose, wsCloseCode(1003))},
+		},
+		{
+			name:   "unmasked",
+			frames: [][]byte{wsFrame(true, wsBinary, false, "MQTT")},
+			err:    WsBadFrame,
+			reply:  [][]byte{wsServerFrame(wsClose, wsCloseCode(1002))},
+		},
+		{
+			name: "reserved bits",
+			frames: [][]byte{
+				append([]byte{0b11000010}, wsFrame(true, wsBinary, true, "MQTT")[1:]...),
+			},
+			err:   WsBadFrame,
+			reply: [][]byte{wsServerFrame(wsClose, wsCloseCode(1002))},
+		},
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{wsFrame(false, wsPing, true, "hello")},
+			err:    WsBadFrame,
+			reply:  [][]byte{wsServerFrame(wsClose, wsCloseCode(1002))},
+		},
+		{
+			name:   "oversized ping",
+			frames: [][]byte{wsFrame(true, wsPing, true, long)},
+			err:    WsBadFrame,
+			reply:  [][]byte{wsServerFrame(wsClose, wsCloseCode(1002))},
+		},
+		{
+			name:   "reserved opcode",
+			frames: [][]byte{wsFrame(true, 0xb, true, "")},
+			err:    WsBadFrame,
+			reply:  [][]byte{wsServerFrame(wsClose, wsCloseCode(1002))},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			ws := &wsConn{Conn: server, br: bufio.NewReader(server)}
+
+			go func() {
+				for _, f := range tc.frames {
+					client.Write(f)
+				}
+			}()
+			replies := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(client)
+				replies <- b
+			}()
+
+			var data []byte
+			buf := make([]byte, 7)
+			var err error
+			for err == nil {
+				var n int
+				n, err = ws.Read(buf)
+				data = append(data, buf[:n]...)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("err = %v, want %v", err, tc.err)
+			}
+			if string(data) != tc.data {
+				t.Fatalf("data = %q, want %q", data, tc.data)
+			}
+
+			// once the server has sent its close frame it doesn't send
+			// another one on Close
+			ws.Close()
+			reply := <-replies
+			if want := bytes.Join(tc.reply, nil); !bytes.Equal(reply, want) {
+				t.Fatalf("reply = %x, want %x", reply, want)
+			}
+		})
+	}
+}